@@ -0,0 +1,221 @@
+package api
+
+import (
+	"io"
+	"fmt"
+	"net/http"
+	"strconv"
+	"crypto/tls"
+	"strings"
+	"path/filepath"
+	"encoding/json"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/LaCumbancha/backup-server/backup-manager/common"
+)
+
+const CLIENTS_RESOURCE = "clients"
+const BACKUPS_RESOURCE = "backups"
+const LATEST_BACKUP = "latest"
+const BEARER_PREFIX = "Bearer "
+
+type BackupApiConfig struct {
+	Port 			string
+	Storage 		*common.BackupStorage
+	Authenticator 	*common.Authenticator
+	TLS 			*tls.Config
+}
+
+type BackupApi struct {
+	port 			string
+	storage 		*common.BackupStorage
+	authenticator 	*common.Authenticator
+	tlsConfig 		*tls.Config
+}
+
+func NewBackupApi(config BackupApiConfig) *BackupApi {
+	backupApi := &BackupApi {
+		port: 		config.Port,
+		storage:	config.Storage,
+		authenticator:	config.Authenticator,
+		tlsConfig:		config.TLS,
+	}
+
+	return backupApi
+}
+
+// Routing requests as /clients[/{id}[/backups/{timestamp|latest}]]
+func (bkpApi *BackupApi) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	log.Infof("New HTTP request received from %s: %s %s.", request.RemoteAddr, request.Method, request.URL.Path)
+	resources := strings.Split(strings.Trim(request.URL.Path, "/"), "/")
+
+	// HTTP requests authenticate with a plain token, as 'Authorization: Bearer <token>'.
+	token := strings.TrimPrefix(request.Header.Get("Authorization"), BEARER_PREFIX)
+	if err := bkpApi.authenticator.CheckToken(token); err != nil {
+		log.Warnf("Authentication failed for HTTP request from %s: %s %s. Err: '%s'", request.RemoteAddr, request.Method, request.URL.Path, err)
+		bkpApi.sendError(writer, err)
+		return
+	}
+
+	if resources[0] != CLIENTS_RESOURCE {
+		bkpApi.sendError(writer, common.NewBackupError(common.CODE_NOT_FOUND, "Resource '%s' not found.", request.URL.Path))
+		return
+	}
+
+	switch {
+	case len(resources) == 1 && request.Method == http.MethodGet:
+		bkpApi.listClients(writer, request)
+	case len(resources) == 1 && request.Method == http.MethodPost:
+		bkpApi.registerClient(writer, request)
+	case len(resources) == 2 && request.Method == http.MethodGet:
+		bkpApi.queryClient(writer, resources[1])
+	case len(resources) == 2 && request.Method == http.MethodDelete:
+		bkpApi.unregisterClient(writer, resources[1])
+	case len(resources) == 4 && resources[2] == BACKUPS_RESOURCE && request.Method == http.MethodGet:
+		bkpApi.restoreBackup(writer, resources[1], resources[3])
+	case len(resources) <= 2 || (len(resources) == 4 && resources[2] == BACKUPS_RESOURCE):
+		bkpApi.sendError(writer, common.NewBackupError(common.CODE_METHOD_NOT_ALLOWED, "Method %s not allowed for '%s'.", request.Method, request.URL.Path))
+	default:
+		bkpApi.sendError(writer, common.NewBackupError(common.CODE_NOT_FOUND, "Resource '%s' not found.", request.URL.Path))
+	}
+}
+
+func (bkpApi *BackupApi) listClients(writer http.ResponseWriter, request *http.Request) {
+	ipFilter := request.URL.Query().Get("ip")
+	pathPrefix := request.URL.Query().Get("path")
+
+	backupClients := bkpApi.storage.ListBackupClients(ipFilter, pathPrefix)
+	message := fmt.Sprintf("Found %d backup clients.", len(backupClients))
+	bkpApi.sendResponse(writer, common.NewSuccessResponse(common.CODE_OK, message, backupClients))
+}
+
+func (bkpApi *BackupApi) registerClient(writer http.ResponseWriter, request *http.Request) {
+	var backupRegister common.BackupRegister
+	if err := json.NewDecoder(request.Body).Decode(&backupRegister); err != nil {
+		bkpApi.sendError(writer, common.NewBackupError(common.CODE_BAD_REQUEST, "Malformed request."))
+		return
+	}
+
+	missingFields := []string{}
+	for _, field := range [][]string{ {"ip", backupRegister.Ip}, {"port", backupRegister.Port}, {"path", backupRegister.Path}, {"freq", backupRegister.Freq} } {
+		if field[1] == "" {
+			missingFields = append(missingFields, field[0])
+		}
+	}
+
+	if len(missingFields) > 0 {
+		bkpApi.sendError(writer, common.NewBackupError(common.CODE_BAD_REQUEST, "Missing mandatory fields for REGISTER: %s.", strings.Join(missingFields, ", ")))
+		return
+	}
+
+	backupId, created, err := bkpApi.storage.AddBackupClient(backupRegister)
+	if err != nil {
+		bkpApi.sendError(writer, err)
+		return
+	}
+
+	if !created {
+		message := fmt.Sprintf("Backup client %s was already registered with the same settings.", backupId)
+		bkpApi.sendResponse(writer, common.NewSuccessResponse(common.CODE_OK, message, map[string]string{ "id": backupId }))
+		return
+	}
+
+	message := fmt.Sprintf("New backup client successfully added with ID %s.", backupId)
+	bkpApi.sendResponse(writer, common.NewSuccessResponse(common.CODE_CREATED, message, map[string]string{ "id": backupId }))
+}
+
+func (bkpApi *BackupApi) queryClient(writer http.ResponseWriter, backupId string) {
+	backupRegister, err := bkpApi.storage.FindBackupClient(backupId)
+	if err != nil {
+		bkpApi.sendError(writer, err)
+		return
+	}
+
+	queryInfo, err := bkpApi.storage.QueryBackupClient(backupRegister)
+	if err != nil {
+		bkpApi.sendError(writer, err)
+		return
+	}
+
+	message := fmt.Sprintf("Found %d backups stored for client %s.", len(queryInfo.Backups), queryInfo.Id)
+	bkpApi.sendResponse(writer, common.NewSuccessResponse(common.CODE_OK, message, queryInfo))
+}
+
+func (bkpApi *BackupApi) unregisterClient(writer http.ResponseWriter, backupId string) {
+	backupRegister, err := bkpApi.storage.FindBackupClient(backupId)
+	if err != nil {
+		bkpApi.sendError(writer, err)
+		return
+	}
+
+	if _, err := bkpApi.storage.RemoveBackupClient(backupRegister); err != nil {
+		bkpApi.sendError(writer, err)
+		return
+	}
+
+	message := fmt.Sprintf("Backup client %s successfully removed.", backupId)
+	bkpApi.sendResponse(writer, common.NewSuccessResponse(common.CODE_OK, message, map[string]string{ "id": backupId }))
+}
+
+func (bkpApi *BackupApi) restoreBackup(writer http.ResponseWriter, backupId string, timestamp string) {
+	backupRegister, err := bkpApi.storage.FindBackupClient(backupId)
+	if err != nil {
+		bkpApi.sendError(writer, err)
+		return
+	}
+
+	if timestamp == LATEST_BACKUP {
+		timestamp = ""
+	}
+
+	backupFile, backupFileSize, err := bkpApi.storage.RetrieveBackup(backupRegister, timestamp)
+	if err != nil {
+		bkpApi.sendError(writer, err)
+		return
+	}
+	defer backupFile.Close()
+
+	backupName := filepath.Base(backupFile.Name())
+	writer.Header().Set("Content-Type", "application/gzip")
+	writer.Header().Set("Content-Length", strconv.FormatInt(backupFileSize, 10))
+	writer.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", backupName))
+	writer.WriteHeader(http.StatusOK)
+
+	sentBytes, err := io.CopyN(writer, backupFile, backupFileSize)
+	if err != nil {
+		log.Errorf("Error sending backup %s over HTTP (%d of %d bytes sent). Err: '%s'", backupName, sentBytes, backupFileSize, err)
+		return
+	}
+
+	log.Infof("Backup %s sent over HTTP for client %s.", backupName, backupId)
+}
+
+func (bkpApi *BackupApi) sendError(writer http.ResponseWriter, err error) {
+	bkpApi.sendResponse(writer, common.NewErrorResponse(err, nil))
+}
+
+func (bkpApi *BackupApi) sendResponse(writer http.ResponseWriter, response common.BackupResponse) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(response.Code)
+
+	if err := json.NewEncoder(writer).Encode(response); err != nil {
+		log.Errorf("Error sending HTTP response. Err: '%s'", err)
+	}
+}
+
+func (bkpApi *BackupApi) Run() {
+	log.Infof("Starting HTTP BackupApi at port %s.", bkpApi.port)
+
+	var err error
+	if bkpApi.tlsConfig == nil {
+		err = http.ListenAndServe(":" + bkpApi.port, bkpApi)
+	} else {
+		server := &http.Server{ Addr: ":" + bkpApi.port, Handler: bkpApi, TLSConfig: bkpApi.tlsConfig }
+		err = server.ListenAndServeTLS("", "")
+	}
+
+	if err != nil {
+		log.Fatalf("Error creating HTTP BackupApi at port %s. Err: '%s'", bkpApi.port, err)
+	}
+}
@@ -0,0 +1,242 @@
+package api
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"compress/gzip"
+	"encoding/json"
+	"net/http/httptest"
+
+	"github.com/LaCumbancha/backup-server/backup-manager/common"
+)
+
+const testToken = "secret"
+const testBackupContent = "backup content"
+
+type testApi struct {
+	api 			*BackupApi
+	clientId 		string
+	backupName 		string
+	emptyClientId 	string
+}
+
+// API over a temporary storage with two registered clients, the first one having a single backup stored.
+func newTestApi(t *testing.T) (*testApi, func()) {
+	dir, err := ioutil.TempDir("", "backup-api-test")
+	if err != nil {
+		t.Fatalf("creating temporary directory: %s", err)
+	}
+
+	storage := common.NewBackupStorage(common.BackupStorageConfig{ Path: dir })
+	storage.BuildBackupStructure()
+
+	clientId, _, err := storage.AddBackupClient(common.BackupRegister{ Ip: "10.0.0.1", Port: "20001", Path: "/var/lib/app", Freq: "1h" })
+	if err != nil {
+		t.Fatalf("registering backup client: %s", err)
+	}
+
+	emptyClientId, _, err := storage.AddBackupClient(common.BackupRegister{ Ip: "10.0.0.2", Port: "20001", Path: "/var/lib/app", Freq: "1h" })
+	if err != nil {
+		t.Fatalf("registering backup client: %s", err)
+	}
+
+	backupFile := storage.AddNewBackup(clientId)
+	if backupFile == nil {
+		t.Fatalf("creating backup file")
+	}
+
+	gzipWriter := gzip.NewWriter(backupFile)
+	gzipWriter.Write([]byte(testBackupContent))
+	gzipWriter.Close()
+	backupFile.Close()
+
+	backupApi := NewBackupApi(BackupApiConfig {
+		Storage:		storage,
+		Authenticator:	common.NewAuthenticator(common.AuthenticatorConfig{ Tokens: []string{ testToken } }),
+	})
+
+	cleanup := func() { os.RemoveAll(dir) }
+	return &testApi{ backupApi, clientId, filepath.Base(backupFile.Name()), emptyClientId }, cleanup
+}
+
+func (api *testApi) serve(method string, path string, authorization string, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(method, path, strings.NewReader(body))
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+
+	recorder := httptest.NewRecorder()
+	api.api.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestRouting(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	timestamp := strings.TrimSuffix(strings.TrimPrefix(api.backupName, common.BACKUP_FILE_PREFIX), common.BACKUP_FILE_EXTENSION)
+	newClient := `{"ip": "10.0.0.3", "port": "20001", "path": "/var/lib/app", "freq": "1h"}`
+	existingClient := `{"ip": "10.0.0.1", "port": "20001", "path": "/var/lib/app", "freq": "1h"}`
+	conflictingClient := `{"ip": "10.0.0.1", "port": "20001", "path": "/var/lib/app", "freq": "2h"}`
+
+	tests := []struct {
+		method 		string
+		path 		string
+		body 		string
+		code 		int
+	}{
+		{ http.MethodGet, "/clients", "", http.StatusOK },
+		{ http.MethodGet, "/clients/", "", http.StatusOK },
+		{ http.MethodPost, "/clients", newClient, http.StatusCreated },
+		{ http.MethodPost, "/clients", existingClient, http.StatusOK },
+		{ http.MethodPost, "/clients", conflictingClient, http.StatusConflict },
+		{ http.MethodPost, "/clients", `{"ip": "10.0.0.3"}`, http.StatusBadRequest },
+		{ http.MethodPost, "/clients", "not json", http.StatusBadRequest },
+		{ http.MethodPost, "/clients", `{"ip": "10.0.0.4", "port": "20001", "path": "/var/lib/app", "freq": "never"}`, http.StatusBadRequest },
+		{ http.MethodGet, "/clients/" + api.clientId, "", http.StatusOK },
+		{ http.MethodGet, "/clients/unknown", "", http.StatusNotFound },
+		{ http.MethodGet, "/clients/" + api.clientId + "/backups/latest", "", http.StatusOK },
+		{ http.MethodGet, "/clients/" + api.clientId + "/backups/" + timestamp, "", http.StatusOK },
+		{ http.MethodGet, "/clients/" + api.clientId + "/backups/20000101000000", "", http.StatusNotFound },
+		{ http.MethodGet, "/clients/" + api.emptyClientId + "/backups/latest", "", http.StatusNotFound },
+		{ http.MethodGet, "/clients/unknown/backups/latest", "", http.StatusNotFound },
+		{ http.MethodPut, "/clients", "", http.StatusMethodNotAllowed },
+		{ http.MethodPost, "/clients/" + api.clientId, "", http.StatusMethodNotAllowed },
+		{ http.MethodDelete, "/clients/" + api.clientId + "/backups/latest", "", http.StatusMethodNotAllowed },
+		{ http.MethodGet, "/clients/" + api.clientId + "/backups", "", http.StatusNotFound },
+		{ http.MethodGet, "/clients/" + api.clientId + "/logs/latest", "", http.StatusNotFound },
+		{ http.MethodGet, "/backups", "", http.StatusNotFound },
+		{ http.MethodDelete, "/clients/unknown", "", http.StatusNotFound },
+		{ http.MethodDelete, "/clients/" + api.emptyClientId, "", http.StatusOK },
+	}
+
+	for _, test := range tests {
+		recorder := api.serve(test.method, test.path, BEARER_PREFIX + testToken, test.body)
+		if recorder.Code != test.code {
+			t.Errorf("%s %s: expected status %d, got %d (%s)", test.method, test.path, test.code, recorder.Code, recorder.Body.String())
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	tests := []struct {
+		authorization 	string
+		code 			int
+	}{
+		{ "", http.StatusUnauthorized },
+		{ BEARER_PREFIX, http.StatusUnauthorized },
+		{ BEARER_PREFIX + "wrong", http.StatusUnauthorized },
+		{ "Basic " + testToken, http.StatusUnauthorized },
+		{ BEARER_PREFIX + testToken, http.StatusOK },
+	}
+
+	for _, test := range tests {
+		recorder := api.serve(http.MethodGet, "/clients", test.authorization, "")
+		if recorder.Code != test.code {
+			t.Errorf("authorization '%s': expected status %d, got %d", test.authorization, test.code, recorder.Code)
+		}
+	}
+
+	// Requests are rejected before routing, so unknown resources don't leak either.
+	if recorder := api.serve(http.MethodGet, "/unknown", "", ""); recorder.Code != http.StatusUnauthorized {
+		t.Errorf("unauthenticated unknown resource: expected status %d, got %d", http.StatusUnauthorized, recorder.Code)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	tests := []struct {
+		err 		error
+		code 		int
+	}{
+		{ common.NewBackupError(common.CODE_BAD_REQUEST, "Malformed request."), http.StatusBadRequest },
+		{ common.NewBackupError(common.CODE_UNAUTHORIZED, "Authentication required."), http.StatusUnauthorized },
+		{ common.NewBackupError(common.CODE_NOT_FOUND, "Not found."), http.StatusNotFound },
+		{ common.NewBackupError(common.CODE_METHOD_NOT_ALLOWED, "Not allowed."), http.StatusMethodNotAllowed },
+		{ common.NewBackupError(common.CODE_CONFLICT, "Conflict."), http.StatusConflict },
+		{ common.NewBackupError(common.CODE_BAD_GATEWAY, "Unreachable."), http.StatusBadGateway },
+		{ os.ErrNotExist, http.StatusInternalServerError },
+	}
+
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		api.api.sendError(recorder, test.err)
+
+		if recorder.Code != test.code {
+			t.Errorf("error '%s': expected status %d, got %d", test.err, test.code, recorder.Code)
+		}
+
+		if contentType := recorder.Header().Get("Content-Type"); contentType != "application/json" {
+			t.Errorf("error '%s': expected JSON response, got '%s'", test.err, contentType)
+		}
+
+		var response common.BackupResponse
+		if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+			t.Fatalf("error '%s': decoding response: %s", test.err, err)
+		}
+
+		if response.Status != common.STATUS_ERROR || response.Code != test.code || response.Message != test.err.Error() {
+			t.Errorf("error '%s': unexpected response %+v", test.err, response)
+		}
+	}
+}
+
+func TestBackupDownload(t *testing.T) {
+	api, cleanup := newTestApi(t)
+	defer cleanup()
+
+	server := httptest.NewServer(api.api)
+	defer server.Close()
+
+	request, err := http.NewRequest(http.MethodGet, server.URL + "/clients/" + api.clientId + "/backups/latest", nil)
+	if err != nil {
+		t.Fatalf("creating request: %s", err)
+	}
+	request.Header.Set("Authorization", BEARER_PREFIX + testToken)
+
+	// Transparent decompression would hide the stored file, so it's requested as is.
+	response, err := (&http.Client{ Transport: &http.Transport{ DisableCompression: true } }).Do(request)
+	if err != nil {
+		t.Fatalf("downloading backup: %s", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, response.StatusCode)
+	}
+
+	if contentType := response.Header.Get("Content-Type"); contentType != "application/gzip" {
+		t.Errorf("expected gzip content, got '%s'", contentType)
+	}
+
+	if disposition := response.Header.Get("Content-Disposition"); !strings.Contains(disposition, api.backupName) {
+		t.Errorf("expected backup %s as attachment, got '%s'", api.backupName, disposition)
+	}
+
+	gzipReader, err := gzip.NewReader(response.Body)
+	if err != nil {
+		t.Fatalf("reading gzip stream: %s", err)
+	}
+
+	content, err := ioutil.ReadAll(gzipReader)
+	if err != nil {
+		t.Fatalf("decompressing backup: %s", err)
+	}
+
+	if string(content) != testBackupContent {
+		t.Fatalf("expected backup content '%s', got '%s'", testBackupContent, content)
+	}
+
+	if response.ContentLength <= 0 {
+		t.Errorf("expected backup size to be sent, got %d", response.ContentLength)
+	}
+}
@@ -0,0 +1,384 @@
+package client
+
+import (
+	"io"
+	"fmt"
+	"net"
+	"time"
+	"bufio"
+	"crypto/tls"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+
+	"github.com/LaCumbancha/backup-server/backup-manager/utils"
+	"github.com/LaCumbancha/backup-server/backup-manager/common"
+)
+
+const REGISTER = "REGISTER"
+const UNREGISTER = "UNREGISTER"
+const QUERY = "QUERY"
+const LIST = "LIST"
+const UPDATE = "UPDATE"
+const PAUSE = "PAUSE"
+const RESUME = "RESUME"
+const TRIGGER = "TRIGGER"
+const RESTORE = "RESTORE"
+const RECOVER = "RECOVER"
+const STATUS = "STATUS"
+
+const DEFAULT_TIMEOUT = 30 * time.Second
+const DEFAULT_OPERATION_TIMEOUT = 2 * time.Hour
+const DEFAULT_RETRY_DELAY = time.Second
+const NONCE_SIZE = 16
+
+// Verbs that can be safely sent again if the connection fails after the request was written.
+var readOnlyVerbs = map[string]bool{ QUERY: true, LIST: true, RESTORE: true, STATUS: true }
+
+// Verbs answered once the manager finishes transferring a backup, so their response waits for the operation timeout.
+var operationVerbs = map[string]bool{ TRIGGER: true, RECOVER: true }
+
+type BackupClientConfig struct {
+	Address 		string
+	Timeout 		time.Duration
+	OperationTimeout	time.Duration
+	Retries 		int
+	RetryDelay 		time.Duration
+	Token 			string
+	Sign 			bool
+	TLS 			*tls.Config
+}
+
+type BackupClient struct {
+	address 		string
+	timeout 		time.Duration
+	operationTimeout	time.Duration
+	retries 		int
+	retryDelay 		time.Duration
+	token 			string
+	sign 			bool
+	tlsConfig 		*tls.Config
+}
+
+// Registration identifier, as the manager derives its ID from these fields.
+type Target struct {
+	Ip 				string 						`json:"ip,omitempty"`
+	Port 			string 						`json:"port,omitempty"`
+	Path 			string 						`json:"path,omitempty"`
+}
+
+// Blackouts are left unchanged when nil, while an empty list removes them.
+type UpdateOptions struct {
+	Freq 			string
+	Path 			string
+	Policy 			string
+	Blackouts 		*[]string
+}
+
+type IdResult struct {
+	Id 				string 						`json:"id"`
+}
+
+type UpdateResult struct {
+	Id 				string 						`json:"id"`
+	Path 			string 						`json:"path"`
+	Freq 			string 						`json:"freq"`
+	Next 			time.Time 					`json:"next"`
+	Blackouts 		[]string 					`json:"blackouts,omitempty"`
+}
+
+type PauseResult struct {
+	Id 				string 						`json:"id"`
+	Paused 			bool 						`json:"paused"`
+	ResumeAt 		*time.Time 					`json:"resume_at,omitempty"`
+}
+
+type TriggerResult struct {
+	Status 			string 						`json:"status"`
+	Size 			int64 						`json:"size"`
+	Error 			string 						`json:"error,omitempty"`
+	CorrelationId 	string 						`json:"correlation_id,omitempty"`
+}
+
+type RestoreResult struct {
+	Backup 			string 						`json:"backup"`
+	Size 			int64 						`json:"size"`
+}
+
+type RecoverResult struct {
+	Backup 			string 						`json:"backup"`
+	Target 			string 						`json:"target"`
+	Error 			string 						`json:"error,omitempty"`
+}
+
+type ResponseError struct {
+	Code 			int
+	Message 		string
+	Data 			json.RawMessage
+}
+
+func (responseError *ResponseError) Error() string {
+	return fmt.Sprintf("%s (code %d)", responseError.Message, responseError.Code)
+}
+
+type request struct {
+	Verb 			string 						`json:"verb"`
+	Args 			requestArgs 				`json:"args"`
+	Options 		requestOptions 				`json:"options"`
+	Auth 			*common.BackupAuth 			`json:"auth,omitempty"`
+}
+
+type requestArgs struct {
+	Target
+	Freq 			string 						`json:"freq,omitempty"`
+	Blackouts 		[]string 					`json:"blackouts,omitempty"`
+}
+
+type requestOptions struct {
+	Backup 			string 						`json:"backup,omitempty"`
+	Target 			string 						`json:"target,omitempty"`
+	Freq 			string 						`json:"freq,omitempty"`
+	Path 			string 						`json:"path,omitempty"`
+	Policy 			string 						`json:"policy,omitempty"`
+	Resume 			string 						`json:"resume,omitempty"`
+	Force 			bool 						`json:"force,omitempty"`
+	Blackouts 		*[]string 					`json:"blackouts,omitempty"`
+}
+
+type response struct {
+	Version 		int 						`json:"version"`
+	Status 			string 						`json:"status"`
+	Code 			int 						`json:"code"`
+	Message 		string 						`json:"message"`
+	Data 			json.RawMessage 			`json:"data"`
+}
+
+func NewBackupClient(config BackupClientConfig) *BackupClient {
+	timeout := config.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_TIMEOUT
+	}
+
+	operationTimeout := config.OperationTimeout
+	if operationTimeout <= 0 {
+		operationTimeout = DEFAULT_OPERATION_TIMEOUT
+	}
+
+	retryDelay := config.RetryDelay
+	if retryDelay <= 0 {
+		retryDelay = DEFAULT_RETRY_DELAY
+	}
+
+	backupClient := &BackupClient {
+		address:		config.Address,
+		timeout:		timeout,
+		operationTimeout:	operationTimeout,
+		retries:		config.Retries,
+		retryDelay:		retryDelay,
+		token:			config.Token,
+		sign:			config.Sign,
+		tlsConfig:		config.TLS,
+	}
+
+	return backupClient
+}
+
+// Register a backup client, optionally with its own blackout windows.
+func (bkpClient *BackupClient) Register(target Target, freq string, blackouts []string) (*IdResult, error) {
+	result := &IdResult{}
+	return result, bkpClient.send(request{ Verb: REGISTER, Args: requestArgs{ Target: target, Freq: freq, Blackouts: blackouts } }, result, nil)
+}
+
+func (bkpClient *BackupClient) Unregister(target Target) (*IdResult, error) {
+	result := &IdResult{}
+	return result, bkpClient.send(request{ Verb: UNREGISTER, Args: requestArgs{ Target: target } }, result, nil)
+}
+
+func (bkpClient *BackupClient) Query(target Target) (*common.BackupQueryInfo, error) {
+	result := &common.BackupQueryInfo{}
+	return result, bkpClient.send(request{ Verb: QUERY, Args: requestArgs{ Target: target } }, result, nil)
+}
+
+// List registrations, optionally filtering by IP and path prefix.
+func (bkpClient *BackupClient) List(ip string, pathPrefix string) ([]common.BackupClientInfo, error) {
+	result := []common.BackupClientInfo{}
+	return result, bkpClient.send(request{ Verb: LIST, Args: requestArgs{ Target: Target{ Ip: ip, Path: pathPrefix } } }, &result, nil)
+}
+
+// Backups being transferred by the scheduler, and the ones waiting for a worker.
+func (bkpClient *BackupClient) Status() (*common.QueueStatus, error) {
+	result := &common.QueueStatus{}
+	return result, bkpClient.send(request{ Verb: STATUS }, result, nil)
+}
+
+func (bkpClient *BackupClient) Update(target Target, options UpdateOptions) (*UpdateResult, error) {
+	result := &UpdateResult{}
+	updateOptions := requestOptions{ Freq: options.Freq, Path: options.Path, Policy: options.Policy, Blackouts: options.Blackouts }
+	return result, bkpClient.send(request{ Verb: UPDATE, Args: requestArgs{ Target: target }, Options: updateOptions }, result, nil)
+}
+
+// Pause a registration; resume can be empty, a duration or an RFC3339 date.
+func (bkpClient *BackupClient) Pause(target Target, resume string) (*PauseResult, error) {
+	result := &PauseResult{}
+	return result, bkpClient.send(request{ Verb: PAUSE, Args: requestArgs{ Target: target }, Options: requestOptions{ Resume: resume } }, result, nil)
+}
+
+func (bkpClient *BackupClient) Resume(target Target) (*PauseResult, error) {
+	result := &PauseResult{}
+	return result, bkpClient.send(request{ Verb: RESUME, Args: requestArgs{ Target: target } }, result, nil)
+}
+
+func (bkpClient *BackupClient) Trigger(target Target, force bool) (*TriggerResult, error) {
+	result := &TriggerResult{}
+	return result, bkpClient.send(request{ Verb: TRIGGER, Args: requestArgs{ Target: target }, Options: requestOptions{ Force: force } }, result, nil)
+}
+
+// Download a stored backup (the latest one if no timestamp is given) into the writer.
+func (bkpClient *BackupClient) Restore(target Target, backup string, writer io.Writer) (*RestoreResult, error) {
+	result := &RestoreResult{}
+
+	download := func(reader io.Reader) error {
+		receivedBytes, err := io.CopyN(writer, reader, result.Size)
+		if err != nil {
+			return errors.Wrapf(err, "error receiving backup file (%d of %d bytes received)", receivedBytes, result.Size)
+		}
+		return nil
+	}
+
+	return result, bkpClient.send(request{ Verb: RESTORE, Args: requestArgs{ Target: target }, Options: requestOptions{ Backup: backup } }, result, download)
+}
+
+// Push a stored backup to the registered node, extracting it in the original or in an alternate path.
+func (bkpClient *BackupClient) Recover(target Target, backup string, targetPath string) (*RecoverResult, error) {
+	result := &RecoverResult{}
+	return result, bkpClient.send(request{ Verb: RECOVER, Args: requestArgs{ Target: target }, Options: requestOptions{ Backup: backup, Target: targetPath } }, result, nil)
+}
+
+func (bkpClient *BackupClient) send(backupRequest request, result interface{}, stream func(io.Reader) error) error {
+	var err error
+
+	for attempt := 0; attempt <= bkpClient.retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(bkpClient.retryDelay)
+		}
+
+		var retryable bool
+		retryable, err = bkpClient.sendOnce(backupRequest, result, stream)
+
+		if err == nil || !retryable {
+			return err
+		}
+	}
+
+	return err
+}
+
+// Send a request in a new connection, informing if it can be retried when failing.
+func (bkpClient *BackupClient) sendOnce(backupRequest request, result interface{}, stream func(io.Reader) error) (bool, error) {
+	retryable := readOnlyVerbs[backupRequest.Verb]
+
+	conn, err := bkpClient.dial()
+	if err != nil {
+		return true, errors.Wrapf(err, "couldn't connect with backup manager at %s", bkpClient.address)
+	}
+	defer conn.Close()
+
+	// Reads and writes fail once the connection is idle for the timeout, so downloads are allowed while they keep moving.
+	idleConn := utils.NewIdleConn(conn, bkpClient.timeout)
+
+	requestJson, err := bkpClient.encodeRequest(backupRequest)
+	if err != nil {
+		return false, errors.Wrapf(err, "error generating %s request", backupRequest.Verb)
+	}
+
+	if _, err = idleConn.Write(append(requestJson, '\n')); err != nil {
+		return retryable, errors.Wrapf(err, "error sending %s request", backupRequest.Verb)
+	}
+
+	reader := bufio.NewReader(idleConn)
+	if operationVerbs[backupRequest.Verb] {
+		conn.SetReadDeadline(time.Now().Add(bkpClient.operationTimeout))
+		reader = bufio.NewReader(conn)
+	}
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return retryable, errors.Wrapf(err, "error receiving %s response", backupRequest.Verb)
+	}
+
+	var backupResponse response
+	if err = json.Unmarshal(line, &backupResponse); err != nil {
+		return retryable, errors.Wrapf(err, "error parsing %s response", backupRequest.Verb)
+	}
+
+	if backupResponse.Version != common.RESPONSE_VERSION {
+		return false, errors.Errorf("unsupported response version %d", backupResponse.Version)
+	}
+
+	if backupResponse.Status != common.STATUS_OK {
+		return false, &ResponseError {
+			Code:		backupResponse.Code,
+			Message:	backupResponse.Message,
+			Data:		backupResponse.Data,
+		}
+	}
+
+	if len(backupResponse.Data) > 0 {
+		if err = json.Unmarshal(backupResponse.Data, result); err != nil {
+			return false, errors.Wrapf(err, "error parsing %s response data", backupRequest.Verb)
+		}
+	}
+
+	// Partial downloads can't be retried, as the writer may already have data.
+	if stream != nil {
+		return false, stream(reader)
+	}
+
+	return false, nil
+}
+
+func (bkpClient *BackupClient) dial() (net.Conn, error) {
+	dialer := &net.Dialer{ Timeout: bkpClient.timeout }
+	if bkpClient.tlsConfig == nil {
+		return dialer.Dial("tcp", bkpClient.address)
+	}
+
+	return tls.DialWithDialer(dialer, "tcp", bkpClient.address, bkpClient.tlsConfig)
+}
+
+// Encode a request line, adding the credentials. Signed requests get a new timestamp and nonce on every attempt.
+func (bkpClient *BackupClient) encodeRequest(backupRequest request) ([]byte, error) {
+	if bkpClient.token == "" {
+		return json.Marshal(backupRequest)
+	}
+
+	if !bkpClient.sign {
+		backupRequest.Auth = &common.BackupAuth{ Token: bkpClient.token }
+		return json.Marshal(backupRequest)
+	}
+
+	requestJson, err := json.Marshal(backupRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	canonicalRequest, err := common.CanonicalRequest(requestJson)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, NONCE_SIZE)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	auth := &common.BackupAuth {
+		Timestamp:	time.Now().Unix(),
+		Nonce:		hex.EncodeToString(nonce),
+	}
+	auth.Signature = common.SignRequest(bkpClient.token, auth.Timestamp, auth.Nonce, canonicalRequest)
+
+	backupRequest.Auth = auth
+	return json.Marshal(backupRequest)
+}
@@ -0,0 +1,130 @@
+package client
+
+import (
+	"net"
+	"time"
+	"bytes"
+	"bufio"
+	"testing"
+	"encoding/json"
+
+	"github.com/LaCumbancha/backup-server/backup-manager/common"
+)
+
+const testTimeout = 5 * time.Second
+const testChunk = "data"
+const testChunks = 4
+
+// Backup manager reading a single request, then answering it as the test needs.
+func startTestManager(t *testing.T, handleRequest func(conn net.Conn)) (string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		if _, err := bufio.NewReader(conn).ReadBytes('\n'); err != nil {
+			return
+		}
+
+		handleRequest(conn)
+		<-done
+	}()
+
+	return listener.Addr().String(), func() { close(done); listener.Close() }
+}
+
+func sendTestResponse(conn net.Conn, data interface{}) {
+	responseJson, _ := json.Marshal(common.NewSuccessResponse(200, "ok", data))
+	conn.Write(append(responseJson, '\n'))
+}
+
+// Send the download in chunks, pausing before each of them.
+func sendTestDownload(conn net.Conn, pause time.Duration, chunks int) {
+	sendTestResponse(conn, RestoreResult{ Backup: "latest", Size: int64(len(testChunk) * testChunks) })
+	for chunk := 0; chunk < chunks; chunk++ {
+		time.Sleep(pause)
+		conn.Write([]byte(testChunk))
+	}
+}
+
+func TestSendTimeouts(t *testing.T) {
+	tests := []struct {
+		name 			string
+		handleRequest 	func(conn net.Conn)
+		send 			func(bkpClient *BackupClient) error
+		fails 			bool
+	}{
+		{ "trigger slower than the idle timeout", func(conn net.Conn) {
+			time.Sleep(300 * time.Millisecond)
+			sendTestResponse(conn, TriggerResult{ Status: "ok" })
+		}, func(bkpClient *BackupClient) error {
+			_, err := bkpClient.Trigger(Target{ Ip: "127.0.0.1", Port: "9000", Path: "/var/lib/app" }, false)
+			return err
+		}, false },
+		{ "trigger slower than the operation timeout", func(conn net.Conn) {}, func(bkpClient *BackupClient) error {
+			_, err := bkpClient.Trigger(Target{ Ip: "127.0.0.1", Port: "9000", Path: "/var/lib/app" }, false)
+			return err
+		}, true },
+		{ "query slower than the idle timeout", func(conn net.Conn) {
+			time.Sleep(300 * time.Millisecond)
+			sendTestResponse(conn, common.BackupQueryInfo{})
+		}, func(bkpClient *BackupClient) error {
+			_, err := bkpClient.Query(Target{ Ip: "127.0.0.1", Port: "9000", Path: "/var/lib/app" })
+			return err
+		}, true },
+		{ "download longer than the idle timeout", func(conn net.Conn) {
+			sendTestDownload(conn, 60 * time.Millisecond, testChunks)
+		}, func(bkpClient *BackupClient) error {
+			var download bytes.Buffer
+			_, err := bkpClient.Restore(Target{ Ip: "127.0.0.1", Port: "9000", Path: "/var/lib/app" }, "", &download)
+			if err == nil && download.Len() != len(testChunk) * testChunks {
+				t.Errorf("expected %d bytes downloaded, got %d", len(testChunk) * testChunks, download.Len())
+			}
+			return err
+		}, false },
+		{ "download stalled", func(conn net.Conn) {
+			sendTestDownload(conn, 60 * time.Millisecond, testChunks / 2)
+		}, func(bkpClient *BackupClient) error {
+			var download bytes.Buffer
+			_, err := bkpClient.Restore(Target{ Ip: "127.0.0.1", Port: "9000", Path: "/var/lib/app" }, "", &download)
+			return err
+		}, true },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address, stopManager := startTestManager(t, test.handleRequest)
+			defer stopManager()
+
+			bkpClient := NewBackupClient(BackupClientConfig {
+				Address:			address,
+				Timeout:			150 * time.Millisecond,
+				OperationTimeout:	time.Second,
+			})
+
+			result := make(chan error, 1)
+			go func() { result <- test.send(bkpClient) }()
+
+			var err error
+			select {
+			case err = <-result:
+			case <-time.After(testTimeout):
+				t.Fatalf("request didn't finish")
+			}
+
+			if test.fails && err == nil {
+				t.Fatalf("expected the request to time out")
+			} else if !test.fails && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+		})
+	}
+}
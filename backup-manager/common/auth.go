@@ -0,0 +1,181 @@
+package common
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+)
+
+const DEFAULT_AUTH_MAX_SKEW = 5 * time.Minute
+
+const AUTH_FIELD = "auth"
+
+// Credentials sent in every request. Either a plain token, or an HMAC-SHA256 signature (keyed with the token) over
+// the timestamp, the nonce and the canonical request. Plain tokens can be replayed by anyone seeing a request, so they
+// are only meant for trusted networks or TLS connections; signed requests are checked against replays.
+type BackupAuth struct {
+	Token 			string 						`json:"token,omitempty"`
+	Timestamp 		int64 						`json:"timestamp,omitempty"`
+	Nonce 			string 						`json:"nonce,omitempty"`
+	Signature 		string 						`json:"signature,omitempty"`
+}
+
+type AuthenticatorConfig struct {
+	Tokens 			[]string
+	MaxSkew 		time.Duration
+}
+
+type Authenticator struct {
+	tokens 			[]string
+	maxSkew 		time.Duration
+	nonces 			map[string]time.Time
+	mutex 			sync.Mutex
+}
+
+func NewAuthenticator(config AuthenticatorConfig) *Authenticator {
+	maxSkew := config.MaxSkew
+	if maxSkew <= 0 {
+		maxSkew = DEFAULT_AUTH_MAX_SKEW
+	}
+
+	tokens := []string{}
+	for _, token := range config.Tokens {
+		if token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+
+	authenticator := &Authenticator {
+		tokens:		tokens,
+		maxSkew:	maxSkew,
+		nonces:		make(map[string]time.Time),
+	}
+
+	return authenticator
+}
+
+// Authentication is only enforced when some token was configured.
+func (authenticator *Authenticator) Enabled() bool {
+	return len(authenticator.tokens) > 0
+}
+
+// Check a plain token against the configured ones.
+func (authenticator *Authenticator) CheckToken(token string) error {
+	if !authenticator.Enabled() {
+		return nil
+	}
+
+	if token == "" {
+		return NewBackupError(CODE_UNAUTHORIZED, "Authentication required.")
+	}
+
+	for _, validToken := range authenticator.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(validToken)) == 1 {
+			return nil
+		}
+	}
+
+	return NewBackupError(CODE_UNAUTHORIZED, "Invalid credentials.")
+}
+
+// Check the credentials of a request line, given as received. Only signed requests get their timestamp checked
+// against the allowed skew and their nonce against replays.
+func (authenticator *Authenticator) Authenticate(auth *BackupAuth, requestLine []byte) error {
+	if !authenticator.Enabled() {
+		return nil
+	}
+
+	if auth == nil || (auth.Token == "" && auth.Signature == "") {
+		return NewBackupError(CODE_UNAUTHORIZED, "Authentication required.")
+	}
+
+	if auth.Signature == "" {
+		return authenticator.CheckToken(auth.Token)
+	}
+
+	if auth.Timestamp == 0 || auth.Nonce == "" {
+		return NewBackupError(CODE_UNAUTHORIZED, "Signed requests must include a timestamp and a nonce.")
+	}
+
+	requestTime := time.Unix(auth.Timestamp, 0)
+	if skew := time.Since(requestTime); skew > authenticator.maxSkew || skew < -authenticator.maxSkew {
+		return NewBackupError(CODE_UNAUTHORIZED, "Request timestamp outside the allowed window.")
+	}
+
+	canonicalRequest, err := CanonicalRequest(requestLine)
+	if err != nil {
+		return NewBackupError(CODE_BAD_REQUEST, "Malformed request.")
+	}
+
+	signature, err := hex.DecodeString(auth.Signature)
+	if err != nil {
+		return NewBackupError(CODE_UNAUTHORIZED, "Invalid credentials.")
+	}
+
+	for _, validToken := range authenticator.tokens {
+		expectedSignature := computeSignature(validToken, auth.Timestamp, auth.Nonce, canonicalRequest)
+		if hmac.Equal(signature, expectedSignature) {
+			return authenticator.registerNonce(auth.Nonce, requestTime)
+		}
+	}
+
+	return NewBackupError(CODE_UNAUTHORIZED, "Invalid credentials.")
+}
+
+// Reject nonces already seen inside the allowed window, forgetting the expired ones.
+func (authenticator *Authenticator) registerNonce(nonce string, requestTime time.Time) error {
+	authenticator.mutex.Lock()
+	defer authenticator.mutex.Unlock()
+
+	now := time.Now()
+	for seenNonce, expiration := range authenticator.nonces {
+		if now.After(expiration) {
+			delete(authenticator.nonces, seenNonce)
+		}
+	}
+
+	if _, ok := authenticator.nonces[nonce]; ok {
+		return NewBackupError(CODE_UNAUTHORIZED, "Request already received.")
+	}
+
+	authenticator.nonces[nonce] = requestTime.Add(authenticator.maxSkew)
+	return nil
+}
+
+// Sign a request, given its canonical form.
+func SignRequest(token string, timestamp int64, nonce string, canonicalRequest []byte) string {
+	return hex.EncodeToString(computeSignature(token, timestamp, nonce, canonicalRequest))
+}
+
+func computeSignature(token string, timestamp int64, nonce string, canonicalRequest []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(fmt.Sprintf("%d\n%s\n", timestamp, nonce)))
+	mac.Write(canonicalRequest)
+	return mac.Sum(nil)
+}
+
+// Canonical form of a request, signed after the timestamp and nonce lines: the JSON object without its credentials
+// field, with its top level keys sorted and no whitespace, nested values included. Keys of nested objects keep the
+// order they were sent in.
+func CanonicalRequest(requestLine []byte) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(requestLine, &fields); err != nil {
+		return nil, err
+	}
+	delete(fields, AUTH_FIELD)
+
+	var canonicalRequest bytes.Buffer
+	encoder := json.NewEncoder(&canonicalRequest)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(fields); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimRight(canonicalRequest.Bytes(), "\n"), nil
+}
@@ -0,0 +1,163 @@
+package common
+
+import (
+	"time"
+	"testing"
+)
+
+const testToken = "secret-token"
+
+var testRequestLine = []byte(`{"Verb": "QUERY", "Args": {"Ip": "10.0.0.1", "Port": "20001", "Path": "/var/lib/app"}}`)
+
+func newTestAuthenticator() *Authenticator {
+	return NewAuthenticator(AuthenticatorConfig{ Tokens: []string{ "other-token", testToken }, MaxSkew: time.Minute })
+}
+
+func signTestRequest(t *testing.T, token string, timestamp int64, nonce string) *BackupAuth {
+	canonicalRequest, err := CanonicalRequest(testRequestLine)
+	if err != nil {
+		t.Fatalf("canonical request: %s", err)
+	}
+
+	return &BackupAuth {
+		Timestamp:	timestamp,
+		Nonce:		nonce,
+		Signature:	SignRequest(token, timestamp, nonce, canonicalRequest),
+	}
+}
+
+func expectAuthError(t *testing.T, err error, code int) {
+	t.Helper()
+	if err == nil {
+		t.Fatalf("expected error with code %d, got none", code)
+	} else if ErrorCode(err) != code {
+		t.Fatalf("expected error with code %d, got %d (%s)", code, ErrorCode(err), err)
+	}
+}
+
+func TestAuthenticateValidSignature(t *testing.T) {
+	authenticator := newTestAuthenticator()
+
+	auth := signTestRequest(t, testToken, time.Now().Unix(), "nonce-1")
+	if err := authenticator.Authenticate(auth, testRequestLine); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestAuthenticateSignatureIgnoresCredentialsAndFormatting(t *testing.T) {
+	authenticator := newTestAuthenticator()
+
+	// The credentials field and whitespace are left out of the signed form.
+	auth := signTestRequest(t, testToken, time.Now().Unix(), "nonce-1")
+	requestLine := []byte(`{"auth": {"nonce": "x"},   "Args": {"Ip":"10.0.0.1","Port":"20001","Path":"/var/lib/app"}, "Verb":"QUERY"}`)
+	if err := authenticator.Authenticate(auth, requestLine); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestAuthenticateWrongKey(t *testing.T) {
+	authenticator := newTestAuthenticator()
+
+	auth := signTestRequest(t, "wrong-token", time.Now().Unix(), "nonce-1")
+	expectAuthError(t, authenticator.Authenticate(auth, testRequestLine), CODE_UNAUTHORIZED)
+}
+
+func TestAuthenticateTamperedRequest(t *testing.T) {
+	authenticator := newTestAuthenticator()
+
+	auth := signTestRequest(t, testToken, time.Now().Unix(), "nonce-1")
+	tamperedLine := []byte(`{"Verb": "UNREGISTER", "Args": {"Ip": "10.0.0.1", "Port": "20001", "Path": "/var/lib/app"}}`)
+	expectAuthError(t, authenticator.Authenticate(auth, tamperedLine), CODE_UNAUTHORIZED)
+}
+
+func TestAuthenticateSkew(t *testing.T) {
+	tests := []struct {
+		name 			string
+		offset 			time.Duration
+		valid 			bool
+	}{
+		{ "inside window in the past", -30 * time.Second, true },
+		{ "inside window in the future", 30 * time.Second, true },
+		{ "beyond max skew in the past", -2 * time.Minute, false },
+		{ "beyond max skew in the future", 2 * time.Minute, false },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			authenticator := newTestAuthenticator()
+
+			auth := signTestRequest(t, testToken, time.Now().Add(test.offset).Unix(), "nonce-1")
+			err := authenticator.Authenticate(auth, testRequestLine)
+			if test.valid && err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			} else if !test.valid {
+				expectAuthError(t, err, CODE_UNAUTHORIZED)
+			}
+		})
+	}
+}
+
+func TestAuthenticateReplayedNonce(t *testing.T) {
+	authenticator := newTestAuthenticator()
+
+	auth := signTestRequest(t, testToken, time.Now().Unix(), "nonce-1")
+	if err := authenticator.Authenticate(auth, testRequestLine); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expectAuthError(t, authenticator.Authenticate(auth, testRequestLine), CODE_UNAUTHORIZED)
+
+	// A new nonce is accepted.
+	auth = signTestRequest(t, testToken, time.Now().Unix(), "nonce-2")
+	if err := authenticator.Authenticate(auth, testRequestLine); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+}
+
+func TestAuthenticateMissingTimestampOrNonce(t *testing.T) {
+	authenticator := newTestAuthenticator()
+
+	expectAuthError(t, authenticator.Authenticate(signTestRequest(t, testToken, 0, "nonce-1"), testRequestLine), CODE_UNAUTHORIZED)
+	expectAuthError(t, authenticator.Authenticate(signTestRequest(t, testToken, time.Now().Unix(), ""), testRequestLine), CODE_UNAUTHORIZED)
+}
+
+func TestAuthenticateMissingToken(t *testing.T) {
+	authenticator := newTestAuthenticator()
+
+	expectAuthError(t, authenticator.Authenticate(nil, testRequestLine), CODE_UNAUTHORIZED)
+	expectAuthError(t, authenticator.Authenticate(&BackupAuth{}, testRequestLine), CODE_UNAUTHORIZED)
+}
+
+func TestAuthenticatePlainToken(t *testing.T) {
+	authenticator := newTestAuthenticator()
+
+	if err := authenticator.Authenticate(&BackupAuth{ Token: testToken }, testRequestLine); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expectAuthError(t, authenticator.Authenticate(&BackupAuth{ Token: "wrong-token" }, testRequestLine), CODE_UNAUTHORIZED)
+}
+
+func TestAuthenticateDisabled(t *testing.T) {
+	authenticator := NewAuthenticator(AuthenticatorConfig{})
+
+	if err := authenticator.Authenticate(nil, testRequestLine); err != nil {
+		t.Fatalf("unexpected error with authentication disabled: %s", err)
+	}
+}
+
+func TestCanonicalRequest(t *testing.T) {
+	canonicalRequest, err := CanonicalRequest([]byte(`{"Verb": "QUERY", "auth": {"token": "x"}, "Args": {"Path": "/a&b", "Ip": "10.0.0.1"}}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := `{"Args":{"Path":"/a&b","Ip":"10.0.0.1"},"Verb":"QUERY"}`
+	if string(canonicalRequest) != expected {
+		t.Fatalf("canonical request = %s, expected %s", canonicalRequest, expected)
+	}
+
+	if _, err := CanonicalRequest([]byte("not json")); err == nil {
+		t.Fatalf("expected error for malformed request")
+	}
+}
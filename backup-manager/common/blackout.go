@@ -0,0 +1,151 @@
+package common
+
+import (
+	"time"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const BLACKOUT_SEPARATOR = ";"
+
+// Windows overlapping each other are chained, up to this amount, when looking for the end of a blackout.
+const BLACKOUT_MAX_CHAIN = 64
+
+// Period of the week in which no backup may start. Format: "[<days>] <HH:MM>-<HH:MM> [<zone>]", where days are
+// given as in cron (e.g. "MON-FRI", "SAT,SUN"), defaulting to every day. Windows ending before they start finish
+// the next day.
+type BlackoutWindow struct {
+	weekdays 		map[int]bool
+	start 			time.Duration
+	end 			time.Duration
+	location 		*time.Location
+}
+
+func ParseBlackoutWindow(expression string, defaultLocation *time.Location) (BlackoutWindow, error) {
+	fields := strings.Fields(expression)
+	window := BlackoutWindow{ location: defaultLocation }
+
+	if len(fields) > 0 && !strings.Contains(fields[0], ":") {
+		weekdays, err := parseCronField(fields[0], 0, 7, cronWeekdays)
+		if err != nil {
+			return window, errors.Wrapf(err, "invalid days in blackout window '%s'", expression)
+		}
+
+		if weekdays[7] {
+			weekdays[0] = true
+		}
+
+		window.weekdays = weekdays
+		fields = fields[1:]
+	}
+
+	if len(fields) < 1 || len(fields) > 2 {
+		return window, errors.Errorf("blackout windows must look like 'MON-FRI 09:00-18:00 UTC', got '%s'", expression)
+	}
+
+	bounds := strings.SplitN(fields[0], "-", 2)
+	if len(bounds) != 2 {
+		return window, errors.Errorf("invalid time range '%s' in blackout window", fields[0])
+	}
+
+	var err error
+	if window.start, err = parseTimeOfDay(bounds[0]); err != nil {
+		return window, err
+	}
+	if window.end, err = parseTimeOfDay(bounds[1]); err != nil {
+		return window, err
+	}
+	if window.start == window.end {
+		return window, errors.Errorf("empty time range '%s' in blackout window", fields[0])
+	}
+
+	if len(fields) == 2 {
+		if window.location, err = time.LoadLocation(fields[1]); err != nil {
+			return window, errors.Errorf("unknown time zone '%s' in blackout window", fields[1])
+		}
+	}
+
+	return window, nil
+}
+
+func ParseBlackoutWindows(expressions []string, defaultLocation *time.Location) ([]BlackoutWindow, error) {
+	windows := []BlackoutWindow{}
+	for _, expression := range expressions {
+		window, err := ParseBlackoutWindow(expression, defaultLocation)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, window)
+	}
+
+	return windows, nil
+}
+
+// Split a list of blackout windows, as written in the configuration.
+func SplitBlackoutWindows(list string) []string {
+	expressions := []string{}
+	for _, expression := range strings.Split(list, BLACKOUT_SEPARATOR) {
+		if expression = strings.TrimSpace(expression); expression != "" {
+			expressions = append(expressions, expression)
+		}
+	}
+
+	return expressions
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	parsedTime, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, errors.Errorf("invalid time '%s' in blackout window", value)
+	}
+
+	return time.Duration(parsedTime.Hour()) * time.Hour + time.Duration(parsedTime.Minute()) * time.Minute, nil
+}
+
+// End of the window occurrence containing the given moment, if any. Occurrences started the previous day are
+// considered too, as they may finish after midnight.
+func (window BlackoutWindow) End(moment time.Time) (time.Time, bool) {
+	localMoment := moment.In(window.location)
+
+	for dayOffset := -1; dayOffset <= 0; dayOffset++ {
+		year, month, day := localMoment.Year(), localMoment.Month(), localMoment.Day() + dayOffset
+		start := time.Date(year, month, day, 0, int(window.start / time.Minute), 0, 0, window.location)
+		if window.weekdays != nil && !window.weekdays[int(start.Weekday())] {
+			continue
+		}
+
+		end := time.Date(year, month, day, 0, int(window.end / time.Minute), 0, 0, window.location)
+		if window.end < window.start {
+			end = end.AddDate(0, 0, 1)
+		}
+
+		if !moment.Before(start) && moment.Before(end) {
+			return end, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// First moment after the given one outside every window. Returns false if the moment wasn't inside any of them.
+func BlackoutEnd(windows []BlackoutWindow, moment time.Time) (time.Time, bool) {
+	deferred := false
+
+	for chain := 0; chain < BLACKOUT_MAX_CHAIN; chain++ {
+		inside := false
+		for _, window := range windows {
+			if end, ok := window.End(moment); ok {
+				moment = end
+				inside = true
+				deferred = true
+			}
+		}
+
+		if !inside {
+			break
+		}
+	}
+
+	return moment, deferred
+}
@@ -0,0 +1,163 @@
+package common
+
+import (
+	"time"
+	"testing"
+)
+
+func TestParseBlackoutWindowInvalid(t *testing.T) {
+	tests := []struct {
+		name 			string
+		expression 		string
+	}{
+		{ "empty", "" },
+		{ "days without range", "MON-FRI" },
+		{ "unknown day", "FOO 09:00-18:00" },
+		{ "day out of range", "8 09:00-18:00" },
+		{ "missing end", "09:00" },
+		{ "empty range", "09:00-09:00" },
+		{ "invalid start", "25:00-06:00" },
+		{ "invalid end", "09:00-18:60" },
+		{ "unknown zone", "09:00-18:00 Mars/Olympus" },
+		{ "extra fields", "MON 09:00-18:00 UTC later" },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ParseBlackoutWindow(test.expression, time.UTC); err == nil {
+				t.Fatalf("expected error parsing '%s'", test.expression)
+			}
+		})
+	}
+}
+
+func TestParseBlackoutWindows(t *testing.T) {
+	expressions := SplitBlackoutWindows(" MON-FRI 09:00-18:00 ; ;22:00-06:00 UTC; ")
+	if len(expressions) != 2 || expressions[0] != "MON-FRI 09:00-18:00" || expressions[1] != "22:00-06:00 UTC" {
+		t.Fatalf("unexpected split windows %q", expressions)
+	}
+
+	if windows, err := ParseBlackoutWindows(expressions, time.UTC); err != nil || len(windows) != 2 {
+		t.Fatalf("unexpected result parsing %q: %v, %v", expressions, windows, err)
+	}
+
+	if _, err := ParseBlackoutWindows(append(expressions, "09:00"), time.UTC); err == nil {
+		t.Fatalf("expected error when a window is invalid")
+	}
+}
+
+func TestBlackoutWindowEnd(t *testing.T) {
+	// October 16th 2026 is a Friday.
+	utc := func(day int, hour int, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name 			string
+		expression 		string
+		moment 			time.Time
+		inside 			bool
+		end 			time.Time
+	}{
+		{ "inside", "09:00-18:00", utc(16, 12, 0), true, utc(16, 18, 0) },
+		{ "exactly at start", "09:00-18:00", utc(16, 9, 0), true, utc(16, 18, 0) },
+		{ "just before end", "09:00-18:00", utc(16, 17, 59), true, utc(16, 18, 0) },
+		{ "exactly at end", "09:00-18:00", utc(16, 18, 0), false, time.Time{} },
+		{ "before start", "09:00-18:00", utc(16, 8, 59), false, time.Time{} },
+		{ "crossing midnight before midnight", "22:00-06:00", utc(16, 23, 0), true, utc(17, 6, 0) },
+		{ "crossing midnight after midnight", "22:00-06:00", utc(17, 1, 0), true, utc(17, 6, 0) },
+		{ "crossing midnight exactly at end", "22:00-06:00", utc(17, 6, 0), false, time.Time{} },
+		{ "crossing midnight between occurrences", "22:00-06:00", utc(17, 12, 0), false, time.Time{} },
+		{ "matching day", "MON-FRI 09:00-18:00", utc(16, 10, 0), true, utc(16, 18, 0) },
+		{ "other day", "MON-FRI 09:00-18:00", utc(17, 10, 0), false, time.Time{} },
+		{ "started on a matching day", "FRI 22:00-02:00", utc(17, 1, 0), true, utc(17, 2, 0) },
+		{ "started on another day", "FRI 22:00-02:00", utc(16, 1, 0), false, time.Time{} },
+		{ "sunday as 7", "7 00:00-12:00", utc(18, 6, 0), true, utc(18, 12, 0) },
+		{ "in zone", "09:00-18:00 America/Argentina/Buenos_Aires", utc(16, 20, 0), true, utc(16, 21, 0) },
+		{ "in zone outside", "09:00-18:00 America/Argentina/Buenos_Aires", utc(16, 10, 0), false, time.Time{} },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			window, err := ParseBlackoutWindow(test.expression, time.UTC)
+			if err != nil {
+				t.Fatalf("unexpected error parsing '%s': %s", test.expression, err)
+			}
+
+			end, inside := window.End(test.moment)
+			if inside != test.inside || !end.Equal(test.end) {
+				t.Fatalf("End(%s) = %s, %t, expected %s, %t", test.moment, end, inside, test.end, test.inside)
+			}
+		})
+	}
+}
+
+func TestBlackoutWindowEndAcrossDST(t *testing.T) {
+	newYork := loadTestLocation(t, "America/New_York")
+	local := func(month time.Month, day int, hour int, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, newYork)
+	}
+
+	// Clocks go from 02:00 EST to 03:00 EDT on March 8th, and from 02:00 EDT back to 01:00 EST on November 1st.
+	tests := []struct {
+		name 			string
+		expression 		string
+		moment 			time.Time
+		inside 			bool
+		end 			time.Time
+	}{
+		{ "night shortened by DST start", "22:00-06:00", local(3, 8, 5, 30), true, local(3, 8, 6, 0) },
+		{ "after night shortened by DST start", "22:00-06:00", local(3, 8, 6, 0), false, time.Time{} },
+		{ "night lengthened by DST end", "00:00-04:00", local(11, 1, 1, 30).Add(time.Hour), true, local(11, 1, 4, 0) },
+		{ "days in default zone", "SUN 00:00-04:00", local(11, 1, 3, 59), true, local(11, 1, 4, 0) },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			window, err := ParseBlackoutWindow(test.expression, newYork)
+			if err != nil {
+				t.Fatalf("unexpected error parsing '%s': %s", test.expression, err)
+			}
+
+			end, inside := window.End(test.moment)
+			if inside != test.inside || !end.Equal(test.end) {
+				t.Fatalf("End(%s) = %s, %t, expected %s, %t", test.moment, end, inside, test.end, test.inside)
+			}
+		})
+	}
+}
+
+func TestBlackoutEnd(t *testing.T) {
+	utc := func(hour int, minute int) time.Time {
+		return time.Date(2026, 10, 16, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name 			string
+		expressions 	[]string
+		moment 			time.Time
+		deferred 		bool
+		end 			time.Time
+	}{
+		{ "no windows", []string{}, utc(10, 0), false, utc(10, 0) },
+		{ "outside every window", []string{ "09:00-12:00", "14:00-16:00" }, utc(13, 0), false, utc(13, 0) },
+		{ "single window", []string{ "09:00-12:00", "14:00-16:00" }, utc(15, 0), true, utc(16, 0) },
+		{ "overlapping windows", []string{ "09:00-12:00", "11:00-14:00" }, utc(10, 0), true, utc(14, 0) },
+		{ "adjacent windows", []string{ "14:00-15:00", "12:00-14:00" }, utc(13, 0), true, utc(15, 0) },
+		{ "chain crossing midnight", []string{ "22:00-02:00", "01:00-03:00" }, utc(23, 0), true, time.Date(2026, 10, 17, 3, 0, 0, 0, time.UTC) },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			windows, err := ParseBlackoutWindows(test.expressions, time.UTC)
+			if err != nil {
+				t.Fatalf("unexpected error parsing %q: %s", test.expressions, err)
+			}
+
+			end, deferred := BlackoutEnd(windows, test.moment)
+			if deferred != test.deferred || !end.Equal(test.end) {
+				t.Fatalf("BlackoutEnd(%s) = %s, %t, expected %s, %t", test.moment, end, deferred, test.end, test.deferred)
+			}
+		})
+	}
+}
@@ -1,3 +1,12 @@
 package common
 
+const MANAGER_VERSION = "1.1.0"
+
 const BACKUP_INFORMATION = "Information.data"
+
+const BACKUP_FILE_PREFIX = "Backup-"
+const BACKUP_FILE_EXTENSION = ".tar.gz"
+const BACKUP_TIMESTAMP_FORMAT = "20060102150405"
+
+const UPDATE_POLICY_KEEP = "keep"
+const UPDATE_POLICY_RESTART = "restart"
@@ -0,0 +1,40 @@
+package common
+
+import (
+	"fmt"
+)
+
+const CODE_OK = 200
+const CODE_CREATED = 201
+const CODE_BAD_REQUEST = 400
+const CODE_UNAUTHORIZED = 401
+const CODE_NOT_FOUND = 404
+const CODE_METHOD_NOT_ALLOWED = 405
+const CODE_CONFLICT = 409
+const CODE_INTERNAL_ERROR = 500
+const CODE_BAD_GATEWAY = 502
+
+type BackupError struct {
+	Code 			int
+	Message 		string
+}
+
+func NewBackupError(code int, format string, args ...interface{}) *BackupError {
+	return &BackupError {
+		Code:		code,
+		Message:	fmt.Sprintf(format, args...),
+	}
+}
+
+func (backupError *BackupError) Error() string {
+	return backupError.Message
+}
+
+// Retrieve the response code for any error, defaulting to an internal error.
+func ErrorCode(err error) int {
+	if backupError, ok := err.(*BackupError); ok {
+		return backupError.Code
+	}
+
+	return CODE_INTERNAL_ERROR
+}
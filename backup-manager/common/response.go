@@ -0,0 +1,34 @@
+package common
+
+const RESPONSE_VERSION = 1
+
+const STATUS_OK = "ok"
+const STATUS_ERROR = "error"
+
+type BackupResponse struct {
+	Version 		int 						`json:"version"`
+	Status 			string 						`json:"status"`
+	Code 			int 						`json:"code"`
+	Message 		string 						`json:"message"`
+	Data 			interface{} 				`json:"data,omitempty"`
+}
+
+func NewSuccessResponse(code int, message string, data interface{}) BackupResponse {
+	return BackupResponse {
+		Version:	RESPONSE_VERSION,
+		Status:		STATUS_OK,
+		Code:		code,
+		Message:	message,
+		Data:		data,
+	}
+}
+
+func NewErrorResponse(err error, data interface{}) BackupResponse {
+	return BackupResponse {
+		Version:	RESPONSE_VERSION,
+		Status:		STATUS_ERROR,
+		Code:		ErrorCode(err),
+		Message:	err.Error(),
+		Data:		data,
+	}
+}
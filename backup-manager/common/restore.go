@@ -0,0 +1,17 @@
+package common
+
+// Restore statuses. The backup client nodes answer with the ones about the restore itself, while the scheduler sets
+// the ones about reaching them.
+const RESTORE_OK = "OK"
+const RESTORE_INVALID_REQUEST = "INVALID_REQUEST"
+const RESTORE_TRANSFER_ERROR = "TRANSFER_ERROR"
+const RESTORE_INVALID_ARCHIVE = "INVALID_ARCHIVE"
+const RESTORE_UNSAFE_ARCHIVE = "UNSAFE_ARCHIVE"
+const RESTORE_WRITE_ERROR = "WRITE_ERROR"
+const RESTORE_FORBIDDEN_PATH = "FORBIDDEN_PATH"
+const RESTORE_CONNECTION_ERROR = "CONNECTION_ERROR"
+const RESTORE_VERSION_MISMATCH = "VERSION_MISMATCH"
+const RESTORE_HANDSHAKE_ERROR = "HANDSHAKE_ERROR"
+const RESTORE_UNSUPPORTED = "UNSUPPORTED"
+const RESTORE_UNAUTHORIZED = "UNAUTHORIZED"
+const RESTORE_TIMEOUT = "TIMEOUT"
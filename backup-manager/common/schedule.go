@@ -0,0 +1,325 @@
+package common
+
+import (
+	"time"
+	"strings"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+const SCHEDULE_ANCHORED_PREFIX = "every "
+const SCHEDULE_CRON_TZ_PREFIX = "CRON_TZ="
+
+// Furthest a cron expression is searched for its next run, so impossible dates (e.g. February 30th) don't loop.
+const CRON_MAX_SEARCH = 5 * 366 * 24 * time.Hour
+
+var cronMacros = map[string]string{
+	"@yearly":		"0 0 1 1 *",
+	"@annually":	"0 0 1 1 *",
+	"@monthly":		"0 0 1 * *",
+	"@weekly":		"0 0 * * 0",
+	"@daily":		"0 0 * * *",
+	"@midnight":	"0 0 * * *",
+	"@hourly":		"0 * * * *",
+}
+
+var cronMonths = map[string]int{ "JAN": 1, "FEB": 2, "MAR": 3, "APR": 4, "MAY": 5, "JUN": 6, "JUL": 7, "AUG": 8, "SEP": 9, "OCT": 10, "NOV": 11, "DEC": 12 }
+var cronWeekdays = map[string]int{ "SUN": 0, "MON": 1, "TUE": 2, "WED": 3, "THU": 4, "FRI": 5, "SAT": 6 }
+
+// Backup frequency, computing when the next backup must run. Supported formats:
+//   - Go durations (e.g. "30m"), counted from the previous run.
+//   - Anchored intervals (e.g. "every 6h starting 00:30 UTC"), repeated every day from the given time.
+//   - Cron expressions (e.g. "0 2 * * *" or "@daily"), evaluated in UTC unless prefixed with "CRON_TZ=<zone> ".
+type Schedule interface {
+	Next(from time.Time) time.Time
+}
+
+type intervalSchedule struct {
+	every 			time.Duration
+}
+
+type anchoredSchedule struct {
+	every 			time.Duration
+	hour 			int
+	minute 			int
+	location 		*time.Location
+}
+
+type cronSchedule struct {
+	minutes 		map[int]bool
+	hours 			map[int]bool
+	days 			map[int]bool
+	months 			map[int]bool
+	weekdays 		map[int]bool
+	anyDay 			bool
+	anyWeekday 		bool
+	location 		*time.Location
+}
+
+func ParseSchedule(expression string) (Schedule, error) {
+	expression = strings.TrimSpace(expression)
+	if expression == "" {
+		return nil, errors.New("empty schedule")
+	}
+
+	if duration, err := time.ParseDuration(expression); err == nil {
+		if duration <= 0 {
+			return nil, errors.Errorf("frequency must be positive")
+		}
+		return intervalSchedule{ every: duration }, nil
+	}
+
+	if strings.HasPrefix(expression, SCHEDULE_ANCHORED_PREFIX) {
+		return parseAnchoredSchedule(expression)
+	}
+
+	return parseCronSchedule(expression)
+}
+
+// Check if a frequency is a plain Go duration, returning it.
+func IntervalFrequency(expression string) (time.Duration, bool) {
+	schedule, err := ParseSchedule(expression)
+	if err != nil {
+		return 0, false
+	}
+
+	interval, ok := schedule.(intervalSchedule)
+	return interval.every, ok
+}
+
+func (schedule intervalSchedule) Next(from time.Time) time.Time {
+	return from.Add(schedule.every)
+}
+
+// Format: "every <duration> starting <HH:MM> [<zone>]". The zone defaults to UTC.
+func parseAnchoredSchedule(expression string) (Schedule, error) {
+	fields := strings.Fields(expression)
+	if len(fields) < 4 || len(fields) > 5 || fields[2] != "starting" {
+		return nil, errors.Errorf("anchored schedules must look like 'every 6h starting 00:30 UTC'")
+	}
+
+	every, err := time.ParseDuration(fields[1])
+	if err != nil || every < time.Minute || every > 24 * time.Hour {
+		return nil, errors.Errorf("anchored interval '%s' must be between 1m and 24h", fields[1])
+	}
+
+	anchor, err := time.Parse("15:04", fields[3])
+	if err != nil {
+		return nil, errors.Errorf("invalid starting time '%s'", fields[3])
+	}
+
+	location := time.UTC
+	if len(fields) == 5 {
+		if location, err = time.LoadLocation(fields[4]); err != nil {
+			return nil, errors.Errorf("unknown time zone '%s'", fields[4])
+		}
+	}
+
+	return anchoredSchedule{ every: every, hour: anchor.Hour(), minute: anchor.Minute(), location: location }, nil
+}
+
+// Runs restart from the anchor every day, so the previous day runs may still be pending after midnight.
+func (schedule anchoredSchedule) Next(from time.Time) time.Time {
+	localFrom := from.In(schedule.location)
+
+	for dayOffset := -1; dayOffset <= 1; dayOffset++ {
+		anchor := time.Date(localFrom.Year(), localFrom.Month(), localFrom.Day() + dayOffset, schedule.hour, schedule.minute, 0, 0, schedule.location)
+		nextAnchor := anchor.AddDate(0, 0, 1)
+
+		if from.Before(anchor) {
+			return anchor
+		}
+
+		next := anchor.Add((from.Sub(anchor) / schedule.every + 1) * schedule.every)
+		if next.Before(nextAnchor) {
+			return next
+		}
+	}
+
+	return from.Add(schedule.every)
+}
+
+// Format: "[CRON_TZ=<zone>] <minute> <hour> <day of month> <month> <day of week>", or one of the '@' macros.
+func parseCronSchedule(expression string) (Schedule, error) {
+	location := time.UTC
+	if strings.HasPrefix(expression, SCHEDULE_CRON_TZ_PREFIX) {
+		fields := strings.SplitN(expression, " ", 2)
+		zone := strings.TrimPrefix(fields[0], SCHEDULE_CRON_TZ_PREFIX)
+
+		var err error
+		if location, err = time.LoadLocation(zone); err != nil {
+			return nil, errors.Errorf("unknown time zone '%s'", zone)
+		}
+
+		if len(fields) < 2 {
+			return nil, errors.Errorf("missing cron expression after time zone")
+		}
+		expression = strings.TrimSpace(fields[1])
+	}
+
+	if macro, ok := cronMacros[expression]; ok {
+		expression = macro
+	}
+
+	fields := strings.Fields(expression)
+	if len(fields) != 5 {
+		return nil, errors.Errorf("cron expressions must have 5 fields (minute, hour, day of month, month, day of week)")
+	}
+
+	schedule := cronSchedule{ location: location, anyDay: strings.HasPrefix(fields[2], "*"), anyWeekday: strings.HasPrefix(fields[4], "*") }
+
+	var err error
+	if schedule.minutes, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, errors.Wrap(err, "minute")
+	}
+	if schedule.hours, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, errors.Wrap(err, "hour")
+	}
+	if schedule.days, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, errors.Wrap(err, "day of month")
+	}
+	if schedule.months, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return nil, errors.Wrap(err, "month")
+	}
+	if schedule.weekdays, err = parseCronField(fields[4], 0, 7, cronWeekdays); err != nil {
+		return nil, errors.Wrap(err, "day of week")
+	}
+
+	// Sunday can be written both as 0 and 7.
+	if schedule.weekdays[7] {
+		schedule.weekdays[0] = true
+	}
+
+	if now := time.Now(); !schedule.Next(now).Before(now.Add(CRON_MAX_SEARCH)) {
+		return nil, errors.Errorf("cron expression never matches a valid date")
+	}
+
+	return schedule, nil
+}
+
+// Parse a comma separated list of values, ranges ("1-5") and steps ("*/15", "0-30/10").
+func parseCronField(field string, min int, max int, names map[string]int) (map[int]bool, error) {
+	values := make(map[int]bool)
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if index := strings.Index(part, "/"); index >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[index+1:]); err != nil || step <= 0 {
+				return nil, errors.Errorf("invalid step in '%s'", part)
+			}
+			part = part[:index]
+		}
+
+		start, end := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			var err error
+			if start, err = parseCronValue(bounds[0], names); err != nil {
+				return nil, err
+			}
+
+			end = start
+			if len(bounds) == 2 {
+				if end, err = parseCronValue(bounds[1], names); err != nil {
+					return nil, err
+				}
+			} else if step > 1 {
+				end = max
+			}
+		}
+
+		if start < min || end > max || start > end {
+			return nil, errors.Errorf("'%s' out of range %d-%d", part, min, max)
+		}
+
+		for value := start; value <= end; value += step {
+			values[value] = true
+		}
+	}
+
+	return values, nil
+}
+
+func parseCronValue(value string, names map[string]int) (int, error) {
+	if number, ok := names[strings.ToUpper(value)]; ok {
+		return number, nil
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, errors.Errorf("invalid value '%s'", value)
+	}
+
+	return number, nil
+}
+
+func (schedule cronSchedule) Next(from time.Time) time.Time {
+	next := from.In(schedule.location).Truncate(time.Minute).Add(time.Minute)
+	limit := next.Add(CRON_MAX_SEARCH)
+
+	for next.Before(limit) {
+		if !schedule.months[int(next.Month())] {
+			next = laterTime(next, time.Date(next.Year(), next.Month() + 1, 1, 0, 0, 0, 0, schedule.location))
+			continue
+		}
+
+		if !schedule.matchesDay(next) {
+			next = laterTime(next, time.Date(next.Year(), next.Month(), next.Day() + 1, 0, 0, 0, 0, schedule.location))
+			continue
+		}
+
+		if !schedule.hours[next.Hour()] {
+			next = laterTime(next, time.Date(next.Year(), next.Month(), next.Day(), next.Hour() + 1, 0, 0, 0, schedule.location))
+			continue
+		}
+
+		if !schedule.minutes[next.Minute()] {
+			next = next.Add(time.Minute)
+			continue
+		}
+
+		// Local times repeated when DST ends only run the first time, as in cron.
+		if earlier := next.Add(-time.Hour); earlier.Day() == next.Day() && earlier.Hour() == next.Hour() {
+			next = next.Add(time.Minute)
+			continue
+		}
+
+		return next
+	}
+
+	// Never matching expressions (e.g. "0 0 30 2 *") are pushed far away instead of running continuously.
+	return limit
+}
+
+// Local times skipped when DST starts are moved backwards by time.Date, so the search moves a minute instead of looping.
+func laterTime(current time.Time, candidate time.Time) time.Time {
+	if candidate.After(current) {
+		return candidate
+	}
+	return current.Add(time.Minute)
+}
+
+// As in cron, when both the day of month and the day of week are restricted, matching either of them is enough.
+func (schedule cronSchedule) matchesDay(date time.Time) bool {
+	dayMatches := schedule.days[date.Day()]
+	weekdayMatches := schedule.weekdays[int(date.Weekday())]
+
+	switch {
+	case schedule.anyDay && schedule.anyWeekday:
+		return true
+	case schedule.anyDay:
+		return weekdayMatches
+	case schedule.anyWeekday:
+		return dayMatches
+	default:
+		return dayMatches || weekdayMatches
+	}
+}
+
+// Describe a schedule validation error for the clients.
+func InvalidScheduleError(expression string, err error) error {
+	return NewBackupError(CODE_BAD_REQUEST, "Invalid frequency format '%s': %s.", expression, err)
+}
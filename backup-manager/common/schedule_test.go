@@ -0,0 +1,169 @@
+package common
+
+import (
+	"time"
+	"testing"
+)
+
+func loadTestLocation(t *testing.T, name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("time zone %s not available: %s", name, err)
+	}
+
+	return location
+}
+
+func TestParseScheduleInvalid(t *testing.T) {
+	tests := []struct {
+		name 			string
+		expression 		string
+	}{
+		{ "empty", "  " },
+		{ "negative duration", "-5m" },
+		{ "zero duration", "0s" },
+		{ "anchored interval too short", "every 30s starting 00:00" },
+		{ "anchored interval too long", "every 25h starting 00:00" },
+		{ "anchored without starting", "every 6h from 00:00" },
+		{ "anchored with extra fields", "every 6h starting 00:00 UTC now" },
+		{ "anchored invalid time", "every 6h starting 25:00" },
+		{ "anchored unknown zone", "every 6h starting 00:00 Mars/Olympus" },
+		{ "cron unknown zone", "CRON_TZ=Mars/Olympus 0 2 * * *" },
+		{ "cron zone without expression", "CRON_TZ=UTC" },
+		{ "cron missing field", "0 2 * *" },
+		{ "cron extra field", "0 2 * * * *" },
+		{ "minute out of range", "60 * * * *" },
+		{ "hour out of range", "0 24 * * *" },
+		{ "day of month out of range", "0 0 0 * *" },
+		{ "month out of range", "0 0 * 13 *" },
+		{ "day of week out of range", "0 0 * * 8" },
+		{ "unknown month name", "0 0 * FOO *" },
+		{ "zero step", "*/0 * * * *" },
+		{ "reversed range", "5-1 * * * *" },
+		{ "never matching date", "0 0 30 2 *" },
+		{ "unknown macro", "@never" },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := ParseSchedule(test.expression); err == nil {
+				t.Fatalf("expected error parsing '%s'", test.expression)
+			}
+		})
+	}
+}
+
+func TestIntervalFrequency(t *testing.T) {
+	tests := []struct {
+		expression 		string
+		interval 		time.Duration
+		ok 				bool
+	}{
+		{ "30m", 30 * time.Minute, true },
+		{ " 1h30m ", 90 * time.Minute, true },
+		{ "every 6h starting 00:30", 0, false },
+		{ "@daily", 0, false },
+		{ "-1h", 0, false },
+	}
+
+	for _, test := range tests {
+		interval, ok := IntervalFrequency(test.expression)
+		if ok != test.ok || interval != test.interval {
+			t.Errorf("IntervalFrequency(%q) = %s, %t, expected %s, %t", test.expression, interval, ok, test.interval, test.ok)
+		}
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	utc := func(month time.Month, day int, hour int, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name 			string
+		expression 		string
+		from 			time.Time
+		expected 		time.Time
+	}{
+		{ "interval", "90m", utc(10, 17, 23, 0), utc(10, 18, 0, 30) },
+		{ "anchored before first run", "every 6h starting 00:30", utc(10, 17, 0, 0), utc(10, 17, 0, 30) },
+		{ "anchored just before a run", "every 6h starting 00:30", utc(10, 17, 6, 29).Add(59 * time.Second), utc(10, 17, 6, 30) },
+		{ "anchored exactly at a run", "every 6h starting 00:30", utc(10, 17, 6, 30), utc(10, 17, 12, 30) },
+		{ "anchored restarting next day", "every 7h starting 00:00", utc(10, 17, 22, 0), utc(10, 18, 0, 0) },
+		{ "anchored run after midnight", "every 5h starting 22:00", utc(10, 17, 23, 30), utc(10, 18, 3, 0) },
+		{ "anchored back to anchor", "every 5h starting 22:00", utc(10, 18, 19, 0), utc(10, 18, 22, 0) },
+		{ "anchored in zone", "every 12h starting 09:00 America/Argentina/Buenos_Aires", utc(10, 17, 10, 0), utc(10, 17, 12, 0) },
+		{ "cron just before a run", "0 2 * * *", utc(10, 17, 1, 59).Add(59 * time.Second), utc(10, 17, 2, 0) },
+		{ "cron exactly at a run", "0 2 * * *", utc(10, 17, 2, 0), utc(10, 18, 2, 0) },
+		{ "cron within the run minute", "0 2 * * *", utc(10, 17, 2, 0).Add(30 * time.Second), utc(10, 18, 2, 0) },
+		{ "cron steps", "*/15 * * * *", utc(10, 17, 10, 46), utc(10, 17, 11, 0) },
+		{ "cron ranges and lists", "0 9-11,15 * * *", utc(10, 17, 11, 30), utc(10, 17, 15, 0) },
+		{ "cron end of year", "@yearly", utc(10, 17, 10, 0), time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC) },
+		{ "cron month names", "0 0 1 JAN,JUL *", utc(6, 15, 0, 0), utc(7, 1, 0, 0) },
+		{ "cron sunday as 7", "0 12 * * 7", utc(10, 17, 12, 0), utc(10, 18, 12, 0) },
+		{ "cron day of month or weekday", "0 0 13 * FRI", utc(10, 17, 0, 0), utc(10, 23, 0, 0) },
+		{ "cron leap day", "0 0 29 2 *", utc(10, 17, 0, 0), time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC) },
+		{ "cron in zone", "CRON_TZ=America/Argentina/Buenos_Aires 0 2 * * *", utc(10, 17, 4, 0), utc(10, 17, 5, 0) },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := ParseSchedule(test.expression)
+			if err != nil {
+				t.Fatalf("unexpected error parsing '%s': %s", test.expression, err)
+			}
+
+			if next := schedule.Next(test.from); !next.Equal(test.expected) {
+				t.Fatalf("Next(%s) = %s, expected %s", test.from, next, test.expected)
+			}
+		})
+	}
+}
+
+func TestScheduleNextAcrossDST(t *testing.T) {
+	newYork := loadTestLocation(t, "America/New_York")
+	local := func(month time.Month, day int, hour int, minute int) time.Time {
+		return time.Date(2026, month, day, hour, minute, 0, 0, newYork)
+	}
+
+	// Clocks go from 02:00 EST to 03:00 EDT on March 8th, and from 02:00 EDT back to 01:00 EST on November 1st.
+	fallBackRepeated := local(11, 1, 1, 30).Add(time.Hour)
+
+	tests := []struct {
+		name 			string
+		expression 		string
+		from 			time.Time
+		expected 		time.Time
+	}{
+		{ "cron skipped by DST start", "CRON_TZ=America/New_York 30 2 * * *", local(3, 8, 0, 0), local(3, 9, 2, 30) },
+		{ "cron right after DST start", "CRON_TZ=America/New_York 0 3 * * *", local(3, 8, 0, 0), local(3, 8, 3, 0) },
+		{ "cron hourly across DST start", "CRON_TZ=America/New_York 15 * * * *", local(3, 8, 1, 30), local(3, 8, 3, 15) },
+		{ "cron before DST end", "CRON_TZ=America/New_York 30 1 * * *", local(11, 1, 0, 0), local(11, 1, 1, 30) },
+		{ "cron repeated by DST end", "CRON_TZ=America/New_York 30 1 * * *", local(11, 1, 1, 30), local(11, 2, 1, 30) },
+		{ "cron inside repeated hour", "CRON_TZ=America/New_York 30 1 * * *", fallBackRepeated, local(11, 2, 1, 30) },
+		{ "anchored across DST start", "every 6h starting 00:30 America/New_York", local(3, 8, 1, 0), local(3, 8, 7, 30) },
+		{ "anchored after DST start", "every 6h starting 00:30 America/New_York", local(3, 8, 19, 0), local(3, 8, 19, 30) },
+		{ "anchored across DST end", "every 6h starting 00:30 America/New_York", local(11, 1, 1, 0), local(11, 1, 5, 30) },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := ParseSchedule(test.expression)
+			if err != nil {
+				t.Fatalf("unexpected error parsing '%s': %s", test.expression, err)
+			}
+
+			done := make(chan time.Time, 1)
+			go func() { done <- schedule.Next(test.from) }()
+
+			select {
+			case next := <-done:
+				if !next.Equal(test.expected) {
+					t.Fatalf("Next(%s) = %s, expected %s", test.from, next, test.expected)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("Next(%s) didn't finish", test.from)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package common
+
+import (
+	"time"
+)
+
+// Backup transfers running in the scheduler, and the ones waiting for a worker.
+type QueueStatus struct {
+	MaxTransfers 		int 					`json:"max_transfers"`
+	MaxTransfersPerHost int 					`json:"max_transfers_per_host"`
+	Running 			[]QueuedBackup 			`json:"running"`
+	Queued 				[]QueuedBackup 			`json:"queued"`
+}
+
+type QueuedBackup struct {
+	Id 					string 					`json:"id"`
+	Ip 					string 					`json:"ip"`
+	Port 				string 					`json:"port"`
+	Path 				string 					`json:"path"`
+	Manual 				bool 					`json:"manual"`
+	QueuedAt 			time.Time 				`json:"queued_at"`
+	StartedAt 			*time.Time 				`json:"started_at,omitempty"`
+}
+
+// Reachability of a backup client node, as seen by the scheduler heartbeats and transfers. Kept only in memory.
+type AgentAvailability struct {
+	Reachable 			bool 					`json:"reachable"`
+	LastSeen 			*time.Time 				`json:"last_seen,omitempty"`
+	LatencyMs 			float64 				`json:"latency_ms,omitempty"`
+	Failures 			int 					`json:"failures,omitempty"`
+	CheckedAt 			time.Time 				`json:"checked_at"`
+}
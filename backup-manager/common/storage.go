@@ -7,7 +7,10 @@ import (
 	"time"
 	"sync"
 	"sort"
+	"strings"
+	"math/rand"
 	"io/ioutil"
+	"path/filepath"
 	"crypto/md5"
 	"archive/tar"
 	"crypto/sha256"
@@ -35,16 +38,81 @@ const MAX_BACKUPS = 10
 
 type BackupStorageConfig struct {
 	Path 			string
+	Blackouts 		[]BlackoutWindow
+	BlackoutZone 	*time.Location
+	Jitter 			time.Duration
 }
 
 type BackupStorage struct {
-	path		string
-	mutex 		sync.Mutex	
+	path			string
+	blackouts 		[]BlackoutWindow
+	blackoutZone 	*time.Location
+	jitter 			time.Duration
+	backups 		map[string]BackupRegister
+	listeners 		[]func(string)
+	listenersMutex 	sync.Mutex
+	availability 	map[string]AgentAvailability
+	availabilityMutex sync.Mutex
+	mutex 			sync.Mutex	
 }
 
 type BackupRequest struct {
 	Verb		string
 	Args		BackupRegister
+	Options		BackupOptions
+	Auth		*BackupAuth
+}
+
+type BackupOptions struct {
+	Backup		string
+	Target		string
+	Freq		string
+	Path		string
+	Policy		string
+	Resume		string
+	Force		bool
+	Blackouts 	*[]string
+}
+
+type BackupClientInfo struct {
+	Id 				string 						`json:"id"`
+	Ip 				string 						`json:"ip"`
+	Port 			string 						`json:"port"`
+	Path 			string 						`json:"path"`
+	Freq 			string 						`json:"freq"`
+	Next 			time.Time 					`json:"next"`
+	Deferred 		bool 						`json:"deferred,omitempty"`
+	Blackouts 		[]string 					`json:"blackouts,omitempty"`
+	LastBackup 		*time.Time 					`json:"last_backup"`
+	LastBackupSize 	int64 						`json:"last_backup_size"`
+	Paused 			bool 						`json:"paused"`
+	ResumeAt 		*time.Time 					`json:"resume_at,omitempty"`
+	Agent 			*AgentInfo 					`json:"agent,omitempty"`
+	Availability 	*AgentAvailability 			`json:"availability,omitempty"`
+}
+
+// Backup client node information, as reported in the handshake where it last changed.
+type AgentInfo struct {
+	Identity 		string 						`json:"identity,omitempty" yaml:"identity,omitempty"`
+	Version 		string 						`json:"version" yaml:"version"`
+	ProtocolVersion byte 						`json:"protocol_version" yaml:"protocol_version"`
+	Capabilities 	utils.Capabilities 			`json:"capabilities" yaml:"capabilities"`
+	Legacy 			bool 						`json:"legacy" yaml:"legacy,omitempty"`
+	CheckedAt 		time.Time 					`json:"checked_at" yaml:"checked_at"`
+}
+
+type BackupQueryInfo struct {
+	Id 				string 						`json:"id"`
+	Client 			*BackupClientInfo 			`json:"client"`
+	Backups 		[]BackupFileInfo 			`json:"backups"`
+	Log 			[]string 					`json:"log"`
+}
+
+type BackupFileInfo struct {
+	Name 			string 						`json:"name"`
+	Timestamp 		string 						`json:"timestamp"`
+	Date 			time.Time 					`json:"date"`
+	Size 			int64 						`json:"size"`
 }
 
 type BackupRegister struct {
@@ -53,6 +121,10 @@ type BackupRegister struct {
 	Path 		string 						`yaml:"path",omitempty`
 	Freq 		string 						`yaml:"freq",omitempty`
 	Next		time.Time 					`yaml:"next",omitempty`
+	Paused		bool 						`yaml:"paused,omitempty"`
+	ResumeAt	time.Time 					`yaml:"resume_at,omitempty"`
+	Blackouts 	[]string 					`yaml:"blackouts,omitempty"`
+	Agent 		*AgentInfo 					`yaml:"agent,omitempty"`
 }
 
 func NewBackupStorage(config BackupStorageConfig) *BackupStorage {
@@ -63,8 +135,17 @@ func NewBackupStorage(config BackupStorageConfig) *BackupStorage {
 		path += "/"
 	}
 
+	blackoutZone := config.BlackoutZone
+	if blackoutZone == nil {
+		blackoutZone = time.UTC
+	}
+
 	backupStorage := &BackupStorage {
-		path: 		path,
+		path: 			path,
+		blackouts:		config.Blackouts,
+		blackoutZone:	blackoutZone,
+		jitter:			config.Jitter,
+		availability:	make(map[string]AgentAvailability),
 	}
 
 	return backupStorage
@@ -73,29 +154,54 @@ func NewBackupStorage(config BackupStorageConfig) *BackupStorage {
 func (bkpStorage *BackupStorage) BuildBackupStructure() {
 	err := os.MkdirAll(bkpStorage.path, os.ModePerm)
 	if err != nil {
-		log.Fatalf("Error creating Backups directory.", err)
+		log.Fatalf("Error creating Backups directory. Err: '%s'", err)
 	}
 
 	file, err := os.OpenFile(bkpStorage.path + BACKUP_INFORMATION, os.O_RDONLY|os.O_CREATE, os.ModePerm)
 	if err != nil {
-		log.Fatalf("Error creating BackupInformation file.", err)
+		log.Fatalf("Error creating BackupInformation file. Err: '%s'", err)
 	}
 
 	file.Close()
 }
 
+// Backups information is kept in memory after the first read, so the file is only touched when it changes. Edits
+// made by hand to the file are not noticed until the manager restarts. Returns a copy the caller can modify.
 func (bkpStorage *BackupStorage) readBackupInformation() map[string]BackupRegister {
+	cache := bkpStorage.backupsCache()
+	backups := make(map[string]BackupRegister, len(cache))
+	for backupId, backupInfo := range cache {
+		backups[backupId] = backupInfo
+	}
+
+	return backups
+}
+
+// Cached backups information, loading it if needed. Must be called with the storage locked and not be modified.
+func (bkpStorage *BackupStorage) backupsCache() map[string]BackupRegister {
+	if bkpStorage.backups == nil {
+		bkpStorage.backups = bkpStorage.loadBackupInformation()
+	}
+
+	return bkpStorage.backups
+}
+
+func (bkpStorage *BackupStorage) loadBackupInformation() map[string]BackupRegister {
 	// Read file content
 	content, err := ioutil.ReadFile(bkpStorage.path + BACKUP_INFORMATION)
     if err != nil {
-        log.Fatalf("Error reading backups information file.", err)
+        log.Fatalf("Error reading backups information file. Err: '%s'", err)
     }
 
     // Unmarshall YAML file
     var backups map[string]BackupRegister
     err = yaml.Unmarshal(content, &backups)
     if err != nil {
-		log.Fatalf("Error creating YAML for backups information file.", err)
+		log.Fatalf("Error creating YAML for backups information file. Err: '%s'", err)
+	}
+
+	if backups == nil {
+		backups = make(map[string]BackupRegister)
 	}
 
 	return backups
@@ -105,13 +211,35 @@ func (bkpStorage *BackupStorage) writeBackupInformation(backups map[string]Backu
 	// Generate YAML file.
 	yamlOutput, err := yaml.Marshal(&backups)
 	if err != nil {
-		log.Fatalf("Error updating YAML for backups information file.", err)
+		log.Fatalf("Error updating YAML for backups information file. Err: '%s'", err)
 	}
 
 	// Write YAML file.
 	err = ioutil.WriteFile(bkpStorage.path + BACKUP_INFORMATION, yamlOutput, 0644)
 	if err != nil {
-		log.Fatalf("Error updating backups information file.", err)
+		log.Fatalf("Error updating backups information file. Err: '%s'", err)
+	}
+
+	bkpStorage.backups = backups
+}
+
+// Register a function called with the ID of every backup client added, updated or removed. Listeners are called
+// while the storage is locked, so they must not use it.
+func (bkpStorage *BackupStorage) OnChange(listener func(backupId string)) {
+	bkpStorage.listenersMutex.Lock()
+	bkpStorage.listeners = append(bkpStorage.listeners, listener)
+	bkpStorage.listenersMutex.Unlock()
+}
+
+func (bkpStorage *BackupStorage) notifyChange(backupIds ...string) {
+	bkpStorage.listenersMutex.Lock()
+	listeners := bkpStorage.listeners
+	bkpStorage.listenersMutex.Unlock()
+
+	for _, listener := range listeners {
+		for _, backupId := range backupIds {
+			listener(backupId)
+		}
 	}
 }
 
@@ -122,71 +250,358 @@ func (bkpStorage *BackupStorage) GetBackupClients() map[string]BackupRegister {
 	return backups
 }
 
-func (bkpStorage *BackupStorage) UpdateBackupClients(updatedBackups map[string]BackupRegister) {
+func (bkpStorage *BackupStorage) CountBackupClients() int {
+	bkpStorage.mutex.Lock()
+	defer bkpStorage.mutex.Unlock()
+
+	return len(bkpStorage.backupsCache())
+}
+
+// Look a backup client up without copying the whole backups information.
+func (bkpStorage *BackupStorage) lookupBackupClient(backupId string) (BackupRegister, bool) {
+	bkpStorage.mutex.Lock()
+	defer bkpStorage.mutex.Unlock()
+
+	backupInfo, ok := bkpStorage.backupsCache()[backupId]
+	return backupInfo, ok
+}
+
+func (bkpStorage *BackupStorage) GetBackupClient(backupRegister BackupRegister) (string, BackupRegister, error) {
+	backupRegisterId := AsSha256(backupRegister)
+
+	backupInfo, ok := bkpStorage.lookupBackupClient(backupRegisterId)
+	if !ok {
+		return backupRegisterId, backupRegister, NewBackupError(CODE_NOT_FOUND, "Backup client %s is not registered.", backupRegisterId)
+	}
+
+	return backupRegisterId, backupInfo, nil
+}
+
+func (bkpStorage *BackupStorage) FindBackupClient(backupId string) (BackupRegister, error) {
+	backupInfo, ok := bkpStorage.lookupBackupClient(backupId)
+	if !ok {
+		return backupInfo, NewBackupError(CODE_NOT_FOUND, "Backup client %s is not registered.", backupId)
+	}
+
+	return backupInfo, nil
+}
+
+func (bkpStorage *BackupStorage) UpdateBackupSchedules(nextBackups map[string]time.Time) {
 	bkpStorage.mutex.Lock()
 	backups := bkpStorage.readBackupInformation()
 
-	// Updating backup values
-	for updatedBackupId, updatedBackupInfo := range updatedBackups {
+	// Updating only the schedule, so concurrent changes from clients are kept.
+	updatedIds := []string{}
+	for backupId, nextBackup := range nextBackups {
 
-		if _, ok := backups[updatedBackupId]; !ok {
-			log.Infof("Trying to update backup client with ID %s, but it was unregistered.", updatedBackupId)
+		if backupInfo, ok := backups[backupId]; !ok {
+			log.Infof("Trying to update backup client with ID %s, but it was unregistered.", backupId)
 		} else {
-			backups[updatedBackupId] = updatedBackupInfo
-			log.Debugf("Updating BackupInfo for client with ID %s.", updatedBackupId)
+			backupInfo.Next = nextBackup
+			backups[backupId] = backupInfo
+			updatedIds = append(updatedIds, backupId)
+			log.Debugf("Updating next backup for client with ID %s.", backupId)
 		}
 
 	}
 
+	if len(updatedIds) > 0 {
+		bkpStorage.writeBackupInformation(backups)
+		bkpStorage.notifyChange(updatedIds...)
+	}
+	bkpStorage.mutex.Unlock()
+}
+
+// Record the backup client node information, logging it in the historic when the node changes.
+func (bkpStorage *BackupStorage) UpdateBackupAgent(backupId string, agentInfo AgentInfo) {
+	bkpStorage.mutex.Lock()
+	backupInfo, ok := bkpStorage.backupsCache()[backupId]
+	if !ok {
+		bkpStorage.mutex.Unlock()
+		log.Infof("Trying to update agent of backup client with ID %s, but it was unregistered.", backupId)
+		return
+	}
+
+	// Handshakes happen on every backup, so the information is only written when the node changed.
+	previousAgent := backupInfo.Agent
+	if sameAgent(previousAgent, agentInfo) {
+		bkpStorage.mutex.Unlock()
+		return
+	}
+
+	backups := bkpStorage.readBackupInformation()
+	backupInfo.Agent = &agentInfo
+	backups[backupId] = backupInfo
+
 	bkpStorage.writeBackupInformation(backups)
 	bkpStorage.mutex.Unlock()
+
+	if previousAgent == nil || previousAgent.Version != agentInfo.Version || previousAgent.ProtocolVersion != agentInfo.ProtocolVersion {
+		bkpStorage.updateBackupRegisterHistoric(backupId, fmt.Sprintf("Backup agent version %s detected (protocol %d; compression %s; incremental %t; restore %t)", agentInfo.Version, agentInfo.ProtocolVersion, strings.Join(agentInfo.Capabilities.Compression, ","), agentInfo.Capabilities.Incremental, agentInfo.Capabilities.Restore))
+	}
+}
+
+func sameAgent(previous *AgentInfo, current AgentInfo) bool {
+	return previous != nil &&
+		previous.Identity == current.Identity &&
+		previous.Version == current.Version &&
+		previous.ProtocolVersion == current.ProtocolVersion &&
+		previous.Legacy == current.Legacy &&
+		strings.Join(previous.Capabilities.Compression, ",") == strings.Join(current.Capabilities.Compression, ",") &&
+		previous.Capabilities.Incremental == current.Capabilities.Incremental &&
+		previous.Capabilities.Restore == current.Capabilities.Restore
 }
 
-func (bkpStorage *BackupStorage) AddBackupClient(backupRegister BackupRegister) string {
+// Add a backup client. Registering it again with the same frequency and blackout windows is accepted, returning
+// false as it wasn't created. Only the client settings are taken from the request, as the pause state and the agent
+// information are managed by the manager.
+func (bkpStorage *BackupStorage) AddBackupClient(request BackupRegister) (string, bool, error) {
+	backupRegister := BackupRegister {
+		Ip:			request.Ip,
+		Port:		request.Port,
+		Path:		request.Path,
+		Freq:		request.Freq,
+		Blackouts:	request.Blackouts,
+	}
 	backupRegisterId := AsSha256(backupRegister)
 
 	// Update next backup information
-	freqDuration, err := time.ParseDuration(backupRegister.Freq)
+	schedule, err := ParseSchedule(backupRegister.Freq)
 	if err != nil {
-        log.Infof("Invalid frequency format given: %s (client: %s).", backupRegister.Freq, backupRegisterId, err)
-        return "Coudln't register new backup client. Invalid frequency format.\n"
-    }
+		log.Infof("Invalid frequency format given: %s (client: %s). Err: '%s'", backupRegister.Freq, backupRegisterId, err)
+		return "", false, InvalidScheduleError(backupRegister.Freq, err)
+	}
 
-	backupRegister.Next = time.Now().Add(freqDuration)
+	if _, err := ParseBlackoutWindows(backupRegister.Blackouts, bkpStorage.blackoutZone); err != nil {
+		log.Infof("Invalid blackout windows given: %s (client: %s). Err: '%s'", strings.Join(backupRegister.Blackouts, "; "), backupRegisterId, err)
+		return "", false, NewBackupError(CODE_BAD_REQUEST, "Invalid blackout windows: %s.", err)
+	}
+
+	backupRegister.Next = bkpStorage.ApplyJitter(schedule.Next(time.Now()))
 
 	bkpStorage.mutex.Lock()
 	backups := bkpStorage.readBackupInformation()
 
-	if backups == nil {
-		backups = make(map[string]BackupRegister)
-	}
+	if currentRegister, ok := backups[backupRegisterId]; ok {
+		bkpStorage.mutex.Unlock()
+		if currentRegister.Freq == backupRegister.Freq && strings.Join(currentRegister.Blackouts, BLACKOUT_SEPARATOR) == strings.Join(backupRegister.Blackouts, BLACKOUT_SEPARATOR) {
+			log.Infof("Backup client with ID %s was already registered with the same settings.", backupRegisterId)
+			return backupRegisterId, false, nil
+		}
 
-	if _, ok := backups[backupRegisterId]; ok {
-		log.Infof("Trying to add a backup client with ID %s that was already registered.", backupRegisterId)
-		return "Couldn't add new backup client because it already was registered.\n"
+		log.Infof("Trying to add a backup client with ID %s that was already registered with different settings.", backupRegisterId)
+		return backupRegisterId, false, NewBackupError(CODE_CONFLICT, "Backup client %s was already registered with different settings.", backupRegisterId)
 	}
 		
 	backups[backupRegisterId] = backupRegister
 
 	bkpStorage.writeBackupInformation(backups)
+	bkpStorage.notifyChange(backupRegisterId)
 	bkpStorage.mutex.Unlock()
 
 	bkpStorage.initializeBackupRegister(backupRegisterId)
 
-	log.Infof("New backup client added for ID %s with: IP %s; Port %s; Path \"%s\"; Frequency %s. Registered with ID: %s.", backupRegisterId, backupRegister.Ip, backupRegister.Port, backupRegister.Path, backupRegister.Freq, backupRegisterId)
-	return fmt.Sprintf("New backup client successfully added with ID %s.", backupRegisterId)
+	log.Infof("New backup client added for ID %s with: IP %s; Port %s; Path \"%s\"; Frequency %s.", backupRegisterId, backupRegister.Ip, backupRegister.Port, backupRegister.Path, backupRegister.Freq)
+	return backupRegisterId, true, nil
+}
+
+// Update the frequency, path or blackout windows of a backup client. Blackout windows are replaced when given, an
+// empty list removing them.
+func (bkpStorage *BackupStorage) UpdateBackupClient(backupRegister BackupRegister, newFreq string, newPath string, newBlackouts *[]string, policy string) (string, BackupRegister, error) {
+	backupRegisterId := AsSha256(backupRegister)
+
+	if newFreq == "" && newPath == "" && newBlackouts == nil {
+		return backupRegisterId, backupRegister, NewBackupError(CODE_BAD_REQUEST, "Nothing to update for backup client %s.", backupRegisterId)
+	}
+
+	if policy == "" {
+		policy = UPDATE_POLICY_KEEP
+	} else if policy != UPDATE_POLICY_KEEP && policy != UPDATE_POLICY_RESTART {
+		return backupRegisterId, backupRegister, NewBackupError(CODE_BAD_REQUEST, "Invalid update policy '%s'.", policy)
+	}
+
+	if newFreq != "" {
+		if _, err := ParseSchedule(newFreq); err != nil {
+			log.Infof("Invalid frequency format given: %s (client: %s). Err: '%s'", newFreq, backupRegisterId, err)
+			return backupRegisterId, backupRegister, InvalidScheduleError(newFreq, err)
+		}
+	}
+
+	if newBlackouts != nil {
+		if _, err := ParseBlackoutWindows(*newBlackouts, bkpStorage.blackoutZone); err != nil {
+			log.Infof("Invalid blackout windows given: %s (client: %s). Err: '%s'", strings.Join(*newBlackouts, "; "), backupRegisterId, err)
+			return backupRegisterId, backupRegister, NewBackupError(CODE_BAD_REQUEST, "Invalid blackout windows: %s.", err)
+		}
+	}
+
+	bkpStorage.mutex.Lock()
+	defer bkpStorage.mutex.Unlock()
+	backups := bkpStorage.readBackupInformation()
+
+	currentRegister, ok := backups[backupRegisterId]
+	if !ok {
+		log.Infof("Trying to update a backup client with ID %s that was not registered.", backupRegisterId)
+		return backupRegisterId, backupRegister, NewBackupError(CODE_NOT_FOUND, "Backup client %s is not registered.", backupRegisterId)
+	}
+
+	updatedRegister := currentRegister
+	changes := []string{}
+
+	if newPath != "" && newPath != currentRegister.Path {
+		updatedRegister.Path = newPath
+		changes = append(changes, fmt.Sprintf("path \"%s\" -> \"%s\"", currentRegister.Path, newPath))
+	}
+
+	if newFreq != "" && newFreq != currentRegister.Freq {
+		updatedRegister.Freq = newFreq
+		changes = append(changes, fmt.Sprintf("frequency %s -> %s", currentRegister.Freq, newFreq))
+	}
+
+	if newBlackouts != nil && strings.Join(*newBlackouts, BLACKOUT_SEPARATOR) != strings.Join(currentRegister.Blackouts, BLACKOUT_SEPARATOR) {
+		updatedRegister.Blackouts = *newBlackouts
+		changes = append(changes, fmt.Sprintf("blackouts [%s] -> [%s]", strings.Join(currentRegister.Blackouts, "; "), strings.Join(*newBlackouts, "; ")))
+	}
+
+	if len(changes) == 0 {
+		return backupRegisterId, currentRegister, NewBackupError(CODE_BAD_REQUEST, "Nothing to update for backup client %s.", backupRegisterId)
+	}
+
+	// Recalculating next backup with the selected policy. Keeping the slot only makes sense between plain intervals,
+	// as anchored and cron schedules don't depend on the previous run.
+	schedule, _ := ParseSchedule(updatedRegister.Freq)							// Error ignored because it was already checked.
+	freqDuration, newIsInterval := IntervalFrequency(updatedRegister.Freq)
+	currentFreqDuration, currentIsInterval := IntervalFrequency(currentRegister.Freq)
+	if policy == UPDATE_POLICY_KEEP && newIsInterval && currentIsInterval {
+		updatedRegister.Next = currentRegister.Next.Add(-currentFreqDuration).Add(freqDuration)
+	} else {
+		updatedRegister.Next = bkpStorage.ApplyJitter(schedule.Next(time.Now()))
+	}
+
+	updatedRegisterId := AsSha256(updatedRegister)
+	if updatedRegisterId != backupRegisterId {
+		if _, ok := backups[updatedRegisterId]; ok {
+			log.Infof("Trying to update backup client %s into %s, that was already registered.", backupRegisterId, updatedRegisterId)
+			return backupRegisterId, currentRegister, NewBackupError(CODE_CONFLICT, "Backup client %s was already registered.", updatedRegisterId)
+		}
+
+		// The backup directory follows the client ID.
+		err := os.Rename(bkpStorage.path + backupRegisterId, bkpStorage.path + updatedRegisterId)
+		if err != nil && !os.IsNotExist(err) {
+			log.Errorf("Error moving backup directory from %s to %s. Err: '%s'", backupRegisterId, updatedRegisterId, err)
+			return backupRegisterId, currentRegister, NewBackupError(CODE_INTERNAL_ERROR, "Error moving backups for client %s.", backupRegisterId)
+		}
+
+		delete(backups, backupRegisterId)
+		changes = append(changes, fmt.Sprintf("ID %s -> %s", backupRegisterId, updatedRegisterId))
+	}
+
+	backups[updatedRegisterId] = updatedRegister
+	bkpStorage.writeBackupInformation(backups)
+	bkpStorage.notifyChange(backupRegisterId, updatedRegisterId)
+
+	if err := os.MkdirAll(bkpStorage.path + updatedRegisterId, os.ModePerm); err != nil {
+		log.Errorf("Error creating Backup directory for ID %s. Err: '%s'", updatedRegisterId, err)
+	}
+	bkpStorage.updateBackupRegisterHistoric(updatedRegisterId, fmt.Sprintf("Backup client updated (%s; policy %s)", strings.Join(changes, "; "), policy))
+
+	log.Infof("Updated backup client with ID %s (%s). Next backup setted at %s.", updatedRegisterId, strings.Join(changes, "; "), updatedRegister.Next.String())
+	return updatedRegisterId, updatedRegister, nil
+}
+
+func (bkpStorage *BackupStorage) PauseBackupClient(backupRegister BackupRegister, resumeAt time.Time) (string, error) {
+	backupRegisterId := AsSha256(backupRegister)
+
+	bkpStorage.mutex.Lock()
+	defer bkpStorage.mutex.Unlock()
+	backups := bkpStorage.readBackupInformation()
+
+	backupInfo, ok := backups[backupRegisterId]
+	if !ok {
+		log.Infof("Trying to pause a backup client with ID %s that was not registered.", backupRegisterId)
+		return backupRegisterId, NewBackupError(CODE_NOT_FOUND, "Backup client %s is not registered.", backupRegisterId)
+	}
+
+	if backupInfo.Paused {
+		log.Infof("Trying to pause a backup client with ID %s that was already paused.", backupRegisterId)
+		return backupRegisterId, NewBackupError(CODE_CONFLICT, "Backup client %s was already paused.", backupRegisterId)
+	}
+
+	backupInfo.Paused = true
+	backupInfo.ResumeAt = resumeAt
+	backups[backupRegisterId] = backupInfo
+	bkpStorage.writeBackupInformation(backups)
+	bkpStorage.notifyChange(backupRegisterId)
+
+	if resumeAt.IsZero() {
+		bkpStorage.updateBackupRegisterHistoric(backupRegisterId, "Backup client paused")
+	} else {
+		bkpStorage.updateBackupRegisterHistoric(backupRegisterId, fmt.Sprintf("Backup client paused until %s", resumeAt.Format(time.RFC3339)))
+	}
+
+	log.Infof("Paused backup client with ID %s.", backupRegisterId)
+	return backupRegisterId, nil
+}
+
+func (bkpStorage *BackupStorage) ResumeBackupClient(backupRegister BackupRegister) (string, error) {
+	backupRegisterId := AsSha256(backupRegister)
+
+	return backupRegisterId, bkpStorage.resumeBackupClient(backupRegisterId, "Backup client resumed")
+}
+
+// Resume a paused client whose auto-resume time was reached.
+func (bkpStorage *BackupStorage) AutoResumeBackupClient(backupId string) bool {
+	return bkpStorage.resumeBackupClient(backupId, "Backup client automatically resumed") == nil
+}
+
+func (bkpStorage *BackupStorage) resumeBackupClient(backupId string, message string) error {
+	bkpStorage.mutex.Lock()
+	defer bkpStorage.mutex.Unlock()
+	backups := bkpStorage.readBackupInformation()
+
+	backupInfo, ok := backups[backupId]
+	if !ok {
+		log.Infof("Trying to resume a backup client with ID %s that was not registered.", backupId)
+		return NewBackupError(CODE_NOT_FOUND, "Backup client %s is not registered.", backupId)
+	}
+
+	if !backupInfo.Paused {
+		log.Infof("Trying to resume a backup client with ID %s that was not paused.", backupId)
+		return NewBackupError(CODE_CONFLICT, "Backup client %s is not paused.", backupId)
+	}
+
+	backupInfo.Paused = false
+	backupInfo.ResumeAt = time.Time{}
+
+	// Backups missed while paused aren't run on resume, waiting for the next one in the schedule instead.
+	if now := time.Now(); backupInfo.Next.Before(now) {
+		nextBackup, err := bkpStorage.NextBackup(backupInfo.Freq, now)
+		if err != nil {
+			log.Warnf("Couldn't recompute next backup for resumed client with ID %s. Err: '%s'", backupId, err)
+		} else {
+			backupInfo.Next = nextBackup
+			message = fmt.Sprintf("%s. Next backup setted at %s", message, nextBackup.Format(time.RFC3339))
+		}
+	}
+
+	backups[backupId] = backupInfo
+	bkpStorage.writeBackupInformation(backups)
+	bkpStorage.notifyChange(backupId)
+
+	bkpStorage.updateBackupRegisterHistoric(backupId, message)
+	log.Infof("Resumed backup client with ID %s.", backupId)
+	return nil
 }
 
 func (bkpStorage *BackupStorage) initializeBackupRegister(backupId string) bool {
 	err := os.Mkdir(bkpStorage.path + backupId, os.ModePerm)
 	if err != nil {
-		log.Errorf("Error creating Backup directory for ID %s.", backupId, err)
+		log.Errorf("Error creating Backup directory for ID %s. Err: '%s'", backupId, err)
 		return false
 	}
 
 	backupLog, err := os.OpenFile(bkpStorage.path + backupId + "/Log", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
-		log.Errorf("Error opening Backup Log file for ID %s.", backupId, err)
+		log.Errorf("Error opening Backup Log file for ID %s. Err: '%s'", backupId, err)
 	}
 	defer backupLog.Close()
 
@@ -197,41 +612,43 @@ func (bkpStorage *BackupStorage) initializeBackupRegister(backupId string) bool
 func (bkpStorage *BackupStorage) updateBackupRegisterHistoric(backupId, message string) {
 	file, err := os.OpenFile(bkpStorage.path + backupId + "/Historic", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
-		log.Errorf("Error opening Backup Historic file for ID %s.", backupId, err)
+		log.Errorf("Error opening Backup Historic file for ID %s. Err: '%s'", backupId, err)
 	}
 	defer file.Close()
 
 	_, err = file.WriteString(message + fmt.Sprintf(" at %s.\n", time.Now().String()))
     if err != nil {
-        log.Errorf("Error writing Backup Historic file for ID %s.", backupId, err)
+        log.Errorf("Error writing Backup Historic file for ID %s. Err: '%s'", backupId, err)
     }
 }
 
-func (bkpStorage *BackupStorage) RemoveBackupClient(backupUnregister BackupRegister) string {
+func (bkpStorage *BackupStorage) RemoveBackupClient(backupUnregister BackupRegister) (string, error) {
 	backupUnregisterId := AsSha256(backupUnregister)
 
 	bkpStorage.mutex.Lock()
 	backups := bkpStorage.readBackupInformation()
 
 	if _, ok := backups[backupUnregisterId]; !ok {
+		bkpStorage.mutex.Unlock()
 		log.Infof("Trying to remove a backup client with ID %s that was not registered.", backupUnregisterId)
-		return "Couldn't remove the backup client because it was not registered.\n"
+		return backupUnregisterId, NewBackupError(CODE_NOT_FOUND, "Backup client %s is not registered.", backupUnregisterId)
 	}
 
 	delete(backups, backupUnregisterId)
 
 	bkpStorage.writeBackupInformation(backups)
+	bkpStorage.notifyChange(backupUnregisterId)
 	bkpStorage.mutex.Unlock()
 
 	bkpStorage.updateBackupRegisterHistoric(backupUnregisterId, "Backup client unregistered")
-	log.Infof("Removed backup client with ID: %s (IP %s; Port %s; Path \"%s\"; Frequency %s).", backupUnregisterId, backupUnregister.Ip, backupUnregister.Port, backupUnregister.Path, backupUnregister.Freq)
-	return "Backup client successfully removed.\n"
+	log.Infof("Removed backup client with ID: %s (IP %s; Port %s; Path \"%s\").", backupUnregisterId, backupUnregister.Ip, backupUnregister.Port, backupUnregister.Path)
+	return backupUnregisterId, nil
 }
 
 func (bkpStorage *BackupStorage) GenerateEtag(backupId string) string {
 	files, err := ioutil.ReadDir(bkpStorage.path + backupId)
 	if err != nil {
-		log.Errorf("Error reading backup directory for client %s", backupId, err)
+		log.Errorf("Error reading backup directory for client %s. Err: '%s'", backupId, err)
 		bkpStorage.checkForDirectory(backupId)
 		return ""
 	}
@@ -244,14 +661,14 @@ func (bkpStorage *BackupStorage) GenerateEtag(backupId string) string {
 
 		lastBackupFile, err := os.Open(bkpStorage.path + backupId + "/" + lastBackupName)
 		if err != nil {
-    	    log.Errorf("Error opening backup file %s.", lastBackupName, err)
+    	    log.Errorf("Error opening backup file %s. Err: '%s'", lastBackupName, err)
     	    return ""
     	}
     	defer lastBackupFile.Close()
 
     	gzipFile, err := gzip.NewReader(lastBackupFile)
     	if err != nil {
-    	    log.Errorf("Error reading gzip file %s.", lastBackupName, err)
+    	    log.Errorf("Error reading gzip file %s. Err: '%s'", lastBackupName, err)
     	    return ""
     	}
 
@@ -264,13 +681,13 @@ func (bkpStorage *BackupStorage) GenerateEtag(backupId string) string {
     		if err == io.EOF {
     			break
     		} else if err != nil {
-    			log.Errorf("Error retreaving inner tar files in %s.", lastBackupName, err)
+    			log.Errorf("Error retreaving inner tar files in %s. Err: '%s'", lastBackupName, err)
     		} else if fileHeader == nil {
     			continue
     		}
 
     		if _, err = io.Copy(hasher, tarReader); err != nil {
-    		    log.Errorf("Error building hash for compressed backup file.", err)
+    		    log.Errorf("Error building hash for compressed backup file. Err: '%s'", err)
     		    return ""
     		}
 
@@ -299,15 +716,15 @@ func AsSha256(backupRegister BackupRegister) string {
 }
 
 func (bkpStorage *BackupStorage) AddNewBackup(backupId string) *os.File {
-	oldBackups, err := ioutil.ReadDir(bkpStorage.path + backupId)
+	oldBackups, err := bkpStorage.listBackupFiles(backupId)
 	if err != nil {
-		log.Errorf("Error reading backup directory for client %s", backupId, err)
+		log.Errorf("Error reading backup directory for client %s. Err: '%s'", backupId, err)
 		if !bkpStorage.checkForDirectory(backupId) {
 			return nil
 		}
 	}
 
-	newFile, err := os.Create(bkpStorage.path + backupId + "/Backup-" + fmt.Sprintf(time.Now().Format("20060102150405")) + ".tar.gz")
+	newFile, err := os.Create(bkpStorage.backupFilePath(backupId, BACKUP_FILE_PREFIX + time.Now().Format(BACKUP_TIMESTAMP_FORMAT) + BACKUP_FILE_EXTENSION))
 	if err != nil {
 		log.Errorf("Error creating new backup received from client %s.", backupId)
 		return nil
@@ -315,11 +732,16 @@ func (bkpStorage *BackupStorage) AddNewBackup(backupId string) *os.File {
 
 	bkpStorage.updateBackupRegisterHistoric(backupId, "New backup saved")
 
-	if len(oldBackups) > MAX_BACKUPS {
-		sort.Slice(oldBackups, func(idx1, idx2 int) bool { return oldBackups[idx1].Name() < oldBackups[idx2].Name() })
+	// Backup files are sorted from the oldest one, counting the new backup.
+	for len(oldBackups) + 1 > MAX_BACKUPS {
 		oldestFile := oldBackups[0].Name()
+		oldBackups = oldBackups[1:]
+
+		if err := os.Remove(bkpStorage.backupFilePath(backupId, oldestFile)); err != nil {
+			log.Errorf("Error removing oldest backup file %s for client %s. Err: '%s'", oldestFile, backupId, err)
+			continue
+		}
 
-		os.Remove(oldestFile)
 		log.Infof("Max backups capacity reached. Removing oldest file: %s.", oldestFile)
 		bkpStorage.updateBackupRegisterHistoric(backupId, fmt.Sprintf("Old backup removed (%s) due to max capacity reached", oldestFile))
 	}
@@ -330,7 +752,7 @@ func (bkpStorage *BackupStorage) AddNewBackup(backupId string) *os.File {
 func (bkpStorage *BackupStorage) UpdateBackupLog(backupId string, fileSize int64) {
 	file, err := os.OpenFile(bkpStorage.path + backupId + "/Log", os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
 	if err != nil {
-		log.Warnf("Error opening Backup Log file for ID %s.", backupId, err)
+		log.Warnf("Error opening Backup Log file for ID %s. Err: '%s'", backupId, err)
 	}
 	defer file.Close()
 
@@ -342,7 +764,7 @@ func (bkpStorage *BackupStorage) UpdateBackupLog(backupId string, fileSize int64
 	}
 
     if err != nil {
-        log.Errorf("Error writing Backup Log file for ID %s.", backupId, err)
+        log.Errorf("Error writing Backup Log file for ID %s. Err: '%s'", backupId, err)
     }
 }
 
@@ -354,19 +776,278 @@ func (bkpStorage *BackupStorage) calculateFileSize(size float64, level int) (flo
 	}
 }
 
-func (bkpStorage *BackupStorage) RetrieveBackupLog(backupRegister BackupRegister) (*os.File, int64){
+func (bkpStorage *BackupStorage) QueryBackupClient(backupRegister BackupRegister) (BackupQueryInfo, error) {
 	backupId := AsSha256(backupRegister)
+	queryInfo := BackupQueryInfo {
+		Id:			backupId,
+		Backups:	[]BackupFileInfo{},
+		Log:		[]string{},
+	}
+
+	content, err := ioutil.ReadFile(bkpStorage.path + backupId + "/Log")
+	if os.IsNotExist(err) {
+		log.Infof("Backup Log file for ID %s doesn't exist.", backupId)
+		return queryInfo, NewBackupError(CODE_NOT_FOUND, "No backups information for client %s.", backupId)
+	} else if err != nil {
+		log.Errorf("Error reading Backup Log file for ID %s. Err: '%s'", backupId, err)
+		return queryInfo, NewBackupError(CODE_INTERNAL_ERROR, "Error retrieving backups information for client %s.", backupId)
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		if line != "" {
+			queryInfo.Log = append(queryInfo.Log, line)
+		}
+	}
+
+	backupFiles, err := bkpStorage.listBackupFiles(backupId)
+	if err != nil {
+		log.Errorf("Error reading backup directory for client %s. Err: '%s'", backupId, err)
+		return queryInfo, NewBackupError(CODE_INTERNAL_ERROR, "Error retrieving backups information for client %s.", backupId)
+	}
+
+	for _, backupFile := range backupFiles {
+		queryInfo.Backups = append(queryInfo.Backups, newBackupFileInfo(backupFile))
+	}
+
+	if backupInfo, ok := bkpStorage.lookupBackupClient(backupId); ok {
+		clientInfo := bkpStorage.newBackupClientInfo(backupId, backupInfo)
+		queryInfo.Client = &clientInfo
+	}
+
+	return queryInfo, nil
+}
+
+// Path of a file inside the backups directory of a client.
+func (bkpStorage *BackupStorage) backupFilePath(backupId string, fileName string) string {
+	return filepath.Join(bkpStorage.path, backupId, fileName)
+}
+
+func (bkpStorage *BackupStorage) listBackupFiles(backupId string) ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(bkpStorage.path + backupId)
+	if err != nil {
+		return nil, err
+	}
+
+	backupFiles := utils.Filter(files, func(fileInfo os.FileInfo) bool {
+		return strings.HasPrefix(fileInfo.Name(), BACKUP_FILE_PREFIX) && strings.HasSuffix(fileInfo.Name(), BACKUP_FILE_EXTENSION)
+	})
+
+	sort.Slice(backupFiles, func(idx1, idx2 int) bool { return backupFiles[idx1].Name() < backupFiles[idx2].Name() })
+	return backupFiles, nil
+}
+
+func newBackupFileInfo(fileInfo os.FileInfo) BackupFileInfo {
+	timestamp := strings.TrimSuffix(strings.TrimPrefix(fileInfo.Name(), BACKUP_FILE_PREFIX), BACKUP_FILE_EXTENSION)
+
+	date, err := time.ParseInLocation(BACKUP_TIMESTAMP_FORMAT, timestamp, time.Local)
+	if err != nil {
+		date = fileInfo.ModTime()
+	}
+
+	return BackupFileInfo {
+		Name:		fileInfo.Name(),
+		Timestamp:	timestamp,
+		Date:		date,
+		Size:		fileInfo.Size(),
+	}
+}
+
+func (bkpStorage *BackupStorage) RetrieveBackup(backupRegister BackupRegister, timestamp string) (*os.File, int64, error) {
+	backupId := AsSha256(backupRegister)
+
+	backupFiles, err := bkpStorage.listBackupFiles(backupId)
+	if os.IsNotExist(err) {
+		log.Infof("Backup directory for client %s doesn't exist.", backupId)
+		return nil, -1, NewBackupError(CODE_NOT_FOUND, "No backups stored for client %s.", backupId)
+	} else if err != nil {
+		log.Errorf("Error reading backup directory for client %s. Err: '%s'", backupId, err)
+		return nil, -1, NewBackupError(CODE_INTERNAL_ERROR, "Error retrieving backups for client %s.", backupId)
+	}
+
+	if len(backupFiles) == 0 {
+		log.Infof("No backup file stored for client %s.", backupId)
+		return nil, -1, NewBackupError(CODE_NOT_FOUND, "No backups stored for client %s.", backupId)
+	}
+
+	// Defaulting to the latest backup if no timestamp was requested.
+	backupName := backupFiles[len(backupFiles) - 1].Name()
+	if timestamp != "" {
+		backupName = BACKUP_FILE_PREFIX + timestamp + BACKUP_FILE_EXTENSION
+
+		found := false
+		for _, backupFile := range backupFiles {
+			if backupFile.Name() == backupName {
+				found = true
+				break
+			}
+		}
 
-	file, err := os.OpenFile(bkpStorage.path + backupId + "/Log", os.O_RDONLY, 0644)
+		if !found {
+			log.Infof("Backup %s requested for client %s doesn't exist.", backupName, backupId)
+			return nil, -1, NewBackupError(CODE_NOT_FOUND, "Backup %s not found for client %s.", timestamp, backupId)
+		}
+	}
+
+	file, err := os.Open(bkpStorage.backupFilePath(backupId, backupName))
 	if err != nil {
-		log.Errorf("Error opening Backup Log file for ID %s.", backupId, err)
+		log.Errorf("Error opening backup file %s for client %s. Err: '%s'", backupName, backupId, err)
+		return nil, -1, NewBackupError(CODE_INTERNAL_ERROR, "Error opening backup %s for client %s.", backupName, backupId)
 	}
 
 	fileInfo, err := file.Stat()
 	if err != nil {
-		log.Errorf("Error getting backup log stats for ID %s.", backupId, err)
-		return file, -1
+		log.Errorf("Error getting backup file %s stats for client %s. Err: '%s'", backupName, backupId, err)
+		file.Close()
+		return nil, -1, NewBackupError(CODE_INTERNAL_ERROR, "Error opening backup %s for client %s.", backupName, backupId)
+	}
+
+	log.Infof("Retrieving backup %s for client %s.", backupName, backupId)
+	return file, fileInfo.Size(), nil
+}
+
+func (bkpStorage *BackupStorage) RegisterTrigger(backupId string, force bool) {
+	if force {
+		bkpStorage.updateBackupRegisterHistoric(backupId, "Backup manually triggered ignoring etag")
+	} else {
+		bkpStorage.updateBackupRegisterHistoric(backupId, "Backup manually triggered")
+	}
+}
+
+// Next backup for a frequency from the given moment, with the configured jitter.
+func (bkpStorage *BackupStorage) NextBackup(freq string, from time.Time) (time.Time, error) {
+	schedule, err := ParseSchedule(freq)
+	if err != nil {
+		return from, err
+	}
+
+	return bkpStorage.ApplyJitter(schedule.Next(from)), nil
+}
+
+// Delay a backup by a random amount up to the configured jitter, so clients sharing a schedule don't start together.
+func (bkpStorage *BackupStorage) ApplyJitter(moment time.Time) time.Time {
+	if bkpStorage.jitter <= 0 {
+		return moment
 	}
 
-	return file, fileInfo.Size()
+	return moment.Add(time.Duration(rand.Int63n(int64(bkpStorage.jitter))))
+}
+
+// Record the reachability of the backup client node at the given address, shared by all its backup clients.
+func (bkpStorage *BackupStorage) UpdateAgentAvailability(ip string, port string, availability AgentAvailability) {
+	bkpStorage.availabilityMutex.Lock()
+	bkpStorage.availability[ip + ":" + port] = availability
+	bkpStorage.availabilityMutex.Unlock()
+}
+
+func (bkpStorage *BackupStorage) GetAgentAvailability(ip string, port string) (AgentAvailability, bool) {
+	bkpStorage.availabilityMutex.Lock()
+	defer bkpStorage.availabilityMutex.Unlock()
+
+	availability, ok := bkpStorage.availability[ip + ":" + port]
+	return availability, ok
+}
+
+func (bkpStorage *BackupStorage) RegisterRetry(backupId string, attempt int, maxAttempts int, retryAt time.Time, reason string) {
+	bkpStorage.updateBackupRegisterHistoric(backupId, fmt.Sprintf("Backup failed (%s). Retry %d of %d scheduled for %s", reason, attempt, maxAttempts, retryAt.Format(time.RFC3339)))
+}
+
+func (bkpStorage *BackupStorage) RegisterRetryOutcome(backupId string, attempts int, succeeded bool) {
+	if succeeded {
+		bkpStorage.updateBackupRegisterHistoric(backupId, fmt.Sprintf("Backup succeeded after %d retries", attempts))
+	} else {
+		bkpStorage.updateBackupRegisterHistoric(backupId, fmt.Sprintf("Backup retries exhausted after %d attempts. Waiting for the next scheduled backup", attempts))
+	}
+}
+
+func (bkpStorage *BackupStorage) RegisterDeferral(backupId string, deferredUntil time.Time) {
+	bkpStorage.updateBackupRegisterHistoric(backupId, fmt.Sprintf("Backup deferred until %s by a blackout window", deferredUntil.Format(time.RFC3339)))
+}
+
+// Postpone a backup starting at the given moment past the global and backup client blackout windows. Returns false
+// if the backup can start at that moment.
+func (bkpStorage *BackupStorage) DeferBackup(backupInfo BackupRegister, moment time.Time) (time.Time, bool) {
+	windows := bkpStorage.blackouts
+
+	if len(backupInfo.Blackouts) > 0 {
+		clientWindows, err := ParseBlackoutWindows(backupInfo.Blackouts, bkpStorage.blackoutZone)
+		if err != nil {
+			log.Warnf("Ignoring invalid blackout windows stored for client with path %s. Err: '%s'", backupInfo.Path, err)
+		} else {
+			windows = append(append([]BlackoutWindow{}, windows...), clientWindows...)
+		}
+	}
+
+	return BlackoutEnd(windows, moment)
+}
+
+func (bkpStorage *BackupStorage) RegisterRestore(backupRegister BackupRegister, backupName string, targetPath string) {
+	backupId := AsSha256(backupRegister)
+	bkpStorage.updateBackupRegisterHistoric(backupId, fmt.Sprintf("Backup %s restored into %s", backupName, targetPath))
+}
+
+func (bkpStorage *BackupStorage) newBackupClientInfo(backupId string, backupInfo BackupRegister) BackupClientInfo {
+	clientInfo := BackupClientInfo {
+		Id:				backupId,
+		Ip:				backupInfo.Ip,
+		Port:			backupInfo.Port,
+		Path:			backupInfo.Path,
+		Freq:			backupInfo.Freq,
+		Next:			backupInfo.Next,
+		Blackouts:		backupInfo.Blackouts,
+		Paused:			backupInfo.Paused,
+		Agent:			backupInfo.Agent,
+	}
+
+	clientInfo.Next, clientInfo.Deferred = bkpStorage.DeferBackup(backupInfo, backupInfo.Next)
+
+	if !backupInfo.ResumeAt.IsZero() {
+		resumeAt := backupInfo.ResumeAt
+		clientInfo.ResumeAt = &resumeAt
+	}
+
+	if availability, ok := bkpStorage.GetAgentAvailability(backupInfo.Ip, backupInfo.Port); ok {
+		clientInfo.Availability = &availability
+	}
+
+	backupFiles, err := bkpStorage.listBackupFiles(backupId)
+	if err != nil {
+		log.Warnf("Error reading backup directory for client %s. Err: '%s'", backupId, err)
+	} else if len(backupFiles) > 0 {
+		lastBackup := newBackupFileInfo(backupFiles[len(backupFiles) - 1])
+		clientInfo.LastBackup = &lastBackup.Date
+		clientInfo.LastBackupSize = lastBackup.Size
+	}
+
+	return clientInfo
+}
+
+func (bkpStorage *BackupStorage) ListBackupClients(ipFilter string, pathPrefix string) []BackupClientInfo {
+	backups := bkpStorage.GetBackupClients()
+	clients := []BackupClientInfo{}
+
+	for backupId, backupInfo := range backups {
+		if ipFilter != "" && backupInfo.Ip != ipFilter {
+			continue
+		}
+
+		if pathPrefix != "" && !strings.HasPrefix(backupInfo.Path, pathPrefix) {
+			continue
+		}
+
+		clientInfo := bkpStorage.newBackupClientInfo(backupId, backupInfo)
+		clients = append(clients, clientInfo)
+	}
+
+	sort.Slice(clients, func(idx1, idx2 int) bool {
+		if clients[idx1].Ip != clients[idx2].Ip {
+			return clients[idx1].Ip < clients[idx2].Ip
+		}
+		if clients[idx1].Port != clients[idx2].Port {
+			return clients[idx1].Port < clients[idx2].Port
+		}
+		return clients[idx1].Path < clients[idx2].Path
+	})
+
+	log.Infof("Listing %d backup clients (from %d registered).", len(clients), len(backups))
+	return clients
 }
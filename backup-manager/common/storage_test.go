@@ -0,0 +1,58 @@
+package common
+
+import (
+	"os"
+	"time"
+	"testing"
+	"io/ioutil"
+)
+
+func newTestStorage(t *testing.T) (*BackupStorage, func()) {
+	dir, err := ioutil.TempDir("", "backup-storage-test")
+	if err != nil {
+		t.Fatalf("creating temporary directory: %s", err)
+	}
+
+	storage := NewBackupStorage(BackupStorageConfig{ Path: dir })
+	storage.BuildBackupStructure()
+
+	return storage, func() { os.RemoveAll(dir) }
+}
+
+func TestAddBackupClientIgnoresManagedFields(t *testing.T) {
+	storage, cleanup := newTestStorage(t)
+	defer cleanup()
+
+	// The pause state and the agent information can only be set by the manager.
+	request := BackupRegister {
+		Ip:			"10.0.0.1",
+		Port:		"20001",
+		Path:		"/var/lib/app",
+		Freq:		"1h",
+		Blackouts:	[]string{ "MON-FRI 09:00-18:00" },
+		Next:		time.Now().Add(-time.Hour),
+		Paused:		true,
+		ResumeAt:	time.Now().Add(24 * time.Hour),
+		Agent:		&AgentInfo{ Version: "forged" },
+	}
+
+	backupId, created, err := storage.AddBackupClient(request)
+	if err != nil || !created {
+		t.Fatalf("unexpected result adding backup client: %t, %v", created, err)
+	}
+
+	stored, ok := storage.GetBackupClients()[backupId]
+	if !ok {
+		t.Fatalf("backup client %s not stored", backupId)
+	}
+
+	if stored.Paused || !stored.ResumeAt.IsZero() || stored.Agent != nil {
+		t.Fatalf("managed fields taken from the request: %+v", stored)
+	}
+	if stored.Ip != request.Ip || stored.Port != request.Port || stored.Path != request.Path || stored.Freq != request.Freq || len(stored.Blackouts) != 1 {
+		t.Fatalf("client settings not stored: %+v", stored)
+	}
+	if !stored.Next.After(time.Now()) {
+		t.Fatalf("next backup %s not computed from the frequency", stored.Next)
+	}
+}
@@ -2,11 +2,17 @@ package main
 
 import (
 	"fmt"
+	"time"
+	"strconv"
+	"strings"
+	"math/rand"
+	"crypto/tls"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/LaCumbancha/backup-server/backup-manager/api"
 	"github.com/LaCumbancha/backup-server/backup-manager/utils"
 	"github.com/LaCumbancha/backup-server/backup-manager/common"
 	"github.com/LaCumbancha/backup-server/backup-manager/manager"
@@ -24,6 +30,32 @@ func InitConfig() (*viper.Viper, *viper.Viper, error) {
 	configEnv.BindEnv("storage")
 	configEnv.BindEnv("manager", "port")
 	configEnv.BindEnv("scheduler", "port")
+	configEnv.BindEnv("http", "port")
+	configEnv.BindEnv("metrics", "port")
+	configEnv.BindEnv("auth", "tokens")
+	configEnv.BindEnv("auth", "max_skew")
+	configEnv.BindEnv("tls", "cert_file")
+	configEnv.BindEnv("tls", "key_file")
+	configEnv.BindEnv("tls", "client_ca_file")
+	configEnv.BindEnv("agent", "tls")
+	configEnv.BindEnv("agent", "tls_ca_file")
+	configEnv.BindEnv("agent", "shared_key")
+	configEnv.BindEnv("blackout", "windows")
+	configEnv.BindEnv("blackout", "timezone")
+	configEnv.BindEnv("backup", "jitter")
+	configEnv.BindEnv("startup", "ramp")
+	configEnv.BindEnv("max", "burst")
+	configEnv.BindEnv("max", "transfers")
+	configEnv.BindEnv("max", "transfers_per_host")
+	configEnv.BindEnv("retry", "backoff")
+	configEnv.BindEnv("max", "retry_backoff")
+	configEnv.BindEnv("max", "retries")
+	configEnv.BindEnv("heartbeat", "interval")
+	configEnv.BindEnv("restore", "idle_timeout")
+	configEnv.BindEnv("restore", "timeout")
+	configEnv.BindEnv("log", "level")
+	configEnv.BindEnv("log", "format")
+	configEnv.BindEnv("log", "output")
 	configEnv.BindEnv("config", "file")
 
 	// Read config file if it's present
@@ -45,13 +77,24 @@ func InitConfig() (*viper.Viper, *viper.Viper, error) {
 }
 
 func main() {
-	log.SetLevel(log.DebugLevel)
+	rand.Seed(time.Now().UnixNano())
 	configEnv, configFile, err := InitConfig()
 
 	if err != nil {
 		log.Fatalf("%s", err)
 	}
 
+	// Logging defaults to the info level, in text format, to the standard error.
+	loggingConfig := utils.LoggingConfig {
+		Level:		utils.GetConfigValue(configEnv, configFile, "log_level"),
+		Format:		utils.GetConfigValue(configEnv, configFile, "log_format"),
+		Output:		utils.GetConfigValue(configEnv, configFile, "log_output"),
+	}
+
+	if err = utils.ConfigureLogging(loggingConfig); err != nil {
+		log.Fatalf("Invalid logging configuration. Err: '%s'", err)
+	}
+
 	storagePath := utils.GetConfigValue(configEnv, configFile, "storage")
 	
 	if storagePath == "" {
@@ -70,8 +113,98 @@ func main() {
 		log.Fatalf("Port variable missing")
 	}
 
+	// HTTP API is optional.
+	httpPort := utils.GetConfigValue(configEnv, configFile, "http_port")
+
+	// Metrics endpoint is optional.
+	metricsPort := utils.GetConfigValue(configEnv, configFile, "metrics_port")
+
+	// Authentication is optional, enabled by configuring a comma-separated list of tokens.
+	authTokens := utils.GetConfigValue(configEnv, configFile, "auth_tokens")
+	authMaxSkew := common.DEFAULT_AUTH_MAX_SKEW
+	if maxSkew := utils.GetConfigValue(configEnv, configFile, "auth_max_skew"); maxSkew != "" {
+		if authMaxSkew, err = time.ParseDuration(maxSkew); err != nil {
+			log.Fatalf("Invalid auth max skew '%s'.", maxSkew)
+		}
+	}
+
+	authenticatorConfig := common.AuthenticatorConfig {
+		Tokens: 		strings.Split(authTokens, ","),
+		MaxSkew: 		authMaxSkew,
+	}
+
+	authenticator := common.NewAuthenticator(authenticatorConfig)
+	if !authenticator.Enabled() {
+		log.Warnf("No authentication tokens configured. Every request will be accepted.")
+	}
+
+	// TLS is optional. The manager certificate is used by its listeners, and presented to agents requiring mutual TLS.
+	managerTLSFiles := utils.TLSFiles {
+		CertFile:		utils.GetConfigValue(configEnv, configFile, "tls_cert_file"),
+		KeyFile:		utils.GetConfigValue(configEnv, configFile, "tls_key_file"),
+		CAFile:			utils.GetConfigValue(configEnv, configFile, "tls_client_ca_file"),
+	}
+
+	managerTLS, err := utils.NewServerTLSConfig(managerTLSFiles)
+	if err != nil {
+		log.Fatalf("Error loading manager TLS configuration. Err: '%s'", err)
+	}
+
+	var agentTLS *tls.Config
+	if agentTLSEnabled, _ := strconv.ParseBool(utils.GetConfigValue(configEnv, configFile, "agent_tls")); agentTLSEnabled {
+		agentTLSFiles := utils.TLSFiles {
+			CertFile:		managerTLSFiles.CertFile,
+			KeyFile:		managerTLSFiles.KeyFile,
+			CAFile:			utils.GetConfigValue(configEnv, configFile, "agent_tls_ca_file"),
+		}
+
+		if agentTLS, err = utils.NewClientTLSConfig(agentTLSFiles); err != nil {
+			log.Fatalf("Error loading agent TLS configuration. Err: '%s'", err)
+		}
+	}
+
+	// Blackout windows are optional, separated by ';'. Windows without time zone use the configured one (UTC default).
+	blackoutZone := time.UTC
+	if timezone := utils.GetConfigValue(configEnv, configFile, "blackout_timezone"); timezone != "" {
+		if blackoutZone, err = time.LoadLocation(timezone); err != nil {
+			log.Fatalf("Invalid blackout time zone '%s'.", timezone)
+		}
+	}
+
+	blackouts, err := common.ParseBlackoutWindows(common.SplitBlackoutWindows(utils.GetConfigValue(configEnv, configFile, "blackout_windows")), blackoutZone)
+	if err != nil {
+		log.Fatalf("Invalid blackout windows. Err: '%s'", err)
+	}
+
+	// Load spreading. Jitter delays every backup by a random amount up to it, the startup ramp spreads overdue
+	// backups when starting, and the burst limits the backups started in each scheduler window. Zero disables them.
+	backupJitter := parseDurationConfig(configEnv, configFile, "backup_jitter", 0)
+	startupRamp := parseDurationConfig(configEnv, configFile, "startup_ramp", scheduler.DEFAULT_STARTUP_RAMP)
+
+	maxBurst := parseIntConfig(configEnv, configFile, "max_burst", scheduler.DEFAULT_MAX_BURST)
+
+	// Concurrent transfers with backup clients, in total and for each host. Zero removes the host limit.
+	maxTransfers := parseIntConfig(configEnv, configFile, "max_transfers", scheduler.DEFAULT_MAX_TRANSFERS)
+	maxTransfersPerHost := parseIntConfig(configEnv, configFile, "max_transfers_per_host", scheduler.DEFAULT_MAX_TRANSFERS_PER_HOST)
+
+	// Failed backups are retried with a backoff doubling from the first one up to the maximum. Zero retries disables them.
+	retryBackoff := parseDurationConfig(configEnv, configFile, "retry_backoff", scheduler.DEFAULT_RETRY_BACKOFF)
+	maxRetryBackoff := parseDurationConfig(configEnv, configFile, "max_retry_backoff", scheduler.DEFAULT_MAX_RETRY_BACKOFF)
+	maxRetries := parseIntConfig(configEnv, configFile, "max_retries", scheduler.DEFAULT_MAX_RETRIES)
+
+	// Period between heartbeats to the backup client nodes. Zero disables them.
+	heartbeatInterval := parseDurationConfig(configEnv, configFile, "heartbeat_interval", scheduler.DEFAULT_HEARTBEAT_INTERVAL)
+
+	// Restores fail once the transfer stops moving for the idle timeout, or the backup client takes longer than the
+	// restore timeout to extract the backup.
+	restoreIdleTimeout := parseDurationConfig(configEnv, configFile, "restore_idle_timeout", scheduler.DEFAULT_RESTORE_IDLE_TIMEOUT)
+	restoreTimeout := parseDurationConfig(configEnv, configFile, "restore_timeout", scheduler.DEFAULT_RESTORE_TIMEOUT)
+
 	backupStorageConfig := common.BackupStorageConfig {
 		Path: 			storagePath,
+		Blackouts:		blackouts,
+		BlackoutZone:	blackoutZone,
+		Jitter:			backupJitter,
 	}
 
 	backupStorage := common.NewBackupStorage(backupStorageConfig)
@@ -79,16 +212,75 @@ func main() {
 
 	backupSchedulerConfig := scheduler.BackupSchedulerConfig {
 		Storage:		backupStorage,
+		TLS:			agentTLS,
+		SharedKey:		utils.GetConfigValue(configEnv, configFile, "agent_shared_key"),
+		StartupRamp:	startupRamp,
+		MaxBurst:		maxBurst,
+		MaxTransfers:	maxTransfers,
+		MaxPerHost:		maxTransfersPerHost,
+		RetryBackoff:	retryBackoff,
+		MaxRetryBackoff: maxRetryBackoff,
+		MaxRetries:		maxRetries,
+		HeartbeatInterval: heartbeatInterval,
+		RestoreIdleTimeout: restoreIdleTimeout,
+		RestoreTimeout:	restoreTimeout,
 	}
 
 	backupScheduler := scheduler.NewBackupScheduler(backupSchedulerConfig)
 	go backupScheduler.Run()
 
+	if httpPort != "" {
+		backupApiConfig := api.BackupApiConfig {
+			Port: 			httpPort,
+			Storage: 		backupStorage,
+			Authenticator: 	authenticator,
+			TLS: 			managerTLS,
+		}
+
+		backupApi := api.NewBackupApi(backupApiConfig)
+		go backupApi.Run()
+	}
+
+	if metricsPort != "" {
+		go utils.ServeMetrics(metricsPort)
+	}
+
 	managerConfig := manager.BackupManagerConfig {
 		Port: 			managerPort,
 		Storage: 		backupStorage,
+		Scheduler:		backupScheduler,
+		Authenticator: 	authenticator,
+		TLS: 			managerTLS,
 	}
 
 	backupManager := manager.NewBackupManager(managerConfig)
 	backupManager.Run()
 }
+
+func parseDurationConfig(configEnv *viper.Viper, configFile *viper.Viper, key string, defaultValue time.Duration) time.Duration {
+	value := utils.GetConfigValue(configEnv, configFile, key)
+	if value == "" {
+		return defaultValue
+	}
+
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("Invalid %s '%s'.", key, value)
+	}
+
+	return duration
+}
+
+func parseIntConfig(configEnv *viper.Viper, configFile *viper.Viper, key string, defaultValue int) int {
+	value := utils.GetConfigValue(configEnv, configFile, key)
+	if value == "" {
+		return defaultValue
+	}
+
+	number, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("Invalid %s '%s'.", key, value)
+	}
+
+	return number
+}
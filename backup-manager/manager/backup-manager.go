@@ -6,31 +6,49 @@ import (
 	"fmt"
 	"net"
 	"math"
+	"sort"
 	"bufio"
-	"strconv"
+	"crypto/tls"
+	"time"
+	"strings"
+	"path/filepath"
 	"encoding/json"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/LaCumbancha/backup-server/backup-manager/utils"
 	"github.com/LaCumbancha/backup-server/backup-manager/common"
+	"github.com/LaCumbancha/backup-server/backup-manager/scheduler"
 )
 
-const BUFFER_BACKUP_LOG = 1024
-const BUFFER_BACKUP_LOG_SIZE = 10
+const BUFFER_FILE = 1024
 
 const ADD_BACKUP = "REGISTER"
 const QUERY_BACKUP = "QUERY"
 const REMOVE_BACKUP = "UNREGISTER"
+const RESTORE_BACKUP = "RESTORE"
+const RECOVER_BACKUP = "RECOVER"
+const LIST_BACKUPS = "LIST"
+const UPDATE_BACKUP = "UPDATE"
+const PAUSE_BACKUP = "PAUSE"
+const RESUME_BACKUP = "RESUME"
+const TRIGGER_BACKUP = "TRIGGER"
+const STATUS_BACKUPS = "STATUS"
 
 type BackupManagerConfig struct {
 	Port 			string
 	Storage 		*common.BackupStorage
+	Scheduler 		*scheduler.BackupScheduler
+	Authenticator 	*common.Authenticator
+	TLS 			*tls.Config
 }
 
 type BackupManager struct {
 	port 			string
 	storage 		*common.BackupStorage
+	scheduler 		*scheduler.BackupScheduler
+	authenticator 	*common.Authenticator
+	tlsConfig 		*tls.Config
 	conns   		chan net.Conn
 }
 
@@ -38,6 +56,9 @@ func NewBackupManager(config BackupManagerConfig) *BackupManager {
 	backupManager := &BackupManager {
 		port: 		config.Port,
 		storage:	config.Storage,
+		scheduler:	config.Scheduler,
+		authenticator:	config.Authenticator,
+		tlsConfig:		config.TLS,
 	}
 
 	return backupManager
@@ -74,6 +95,14 @@ func (bkpManager *BackupManager) handleConnections(client net.Conn) {
 	buffer := bufio.NewReader(client)
 	ip, port := utils.ParseAddress(client.RemoteAddr().String())
 
+	peerName, err := utils.PeerName(client)
+	if err != nil {
+		log.Errorf("TLS handshake failed with connection ('%s', %s). Err: '%s'", ip, port, err)
+		return
+	} else if peerName != "" {
+		log.Infof("Connection ('%s', %s) identified as '%s'.", ip, port, peerName)
+	}
+
 	for {
 		line, err := buffer.ReadBytes('\n')
 
@@ -81,53 +110,68 @@ func (bkpManager *BackupManager) handleConnections(client net.Conn) {
 			log.Infof("Connection ('%s', %s) closed.", ip, port)
 			break
 		} else if err != nil {
-			log.Errorf("Couldn't read line", err)
+			log.Errorf("Couldn't read line from connection ('%s', %s). Err: '%s'", ip, port, err)
+			break
 		}
 
-		strLine := string(line)
-		log.Infof("Message received from connection ('%s', %s). Msg: %s", ip, port, strLine)
+		// Credentials are never logged, so malformed messages are only described by their length.
+		if canonicalLine, err := common.CanonicalRequest(line); err == nil {
+			log.Infof("Message received from connection ('%s', %s). Msg: %s", ip, port, string(canonicalLine))
+		} else {
+			log.Infof("Malformed message received from connection ('%s', %s). Length: %d bytes.", ip, port, len(line))
+		}
 
 		var backupRequest common.BackupRequest
-		json.Unmarshal([]byte(strLine), &backupRequest)
+		if err := json.Unmarshal(line, &backupRequest); err != nil {
+			log.Errorf("Error parsing message from connection ('%s', %s). Err: '%s'", ip, port, err)
+			bkpManager.sendResponse(client, common.NewErrorResponse(common.NewBackupError(common.CODE_BAD_REQUEST, "Malformed request."), nil))
+			continue
+		}
 
-		if bkpManager.validateBackupRequest(backupRequest) {
-			bkpManager.processBackupRequest(client, backupRequest)
+		if err := bkpManager.authenticator.Authenticate(backupRequest.Auth, line); err != nil {
+			log.Warnf("Authentication failed for %s request from connection ('%s', %s). Err: '%s'", backupRequest.Verb, ip, port, err)
+			bkpManager.sendResponse(client, common.NewErrorResponse(err, nil))
+			continue
+		}
+
+		if err := bkpManager.validateBackupRequest(backupRequest); err != nil {
+			bkpManager.sendResponse(client, common.NewErrorResponse(err, nil))
 		} else {
-			outputMessage := fmt.Sprintf("Some mandatory fields are missing. Message received: %s", strLine)
-			utils.SocketWrite(outputMessage, client)
+			bkpManager.processBackupRequest(client, backupRequest)
 		}
 	}
 }
 
-func (bkpManager *BackupManager) validateBackupRequest(backupRequest common.BackupRequest) bool {
+func (bkpManager *BackupManager) validateBackupRequest(backupRequest common.BackupRequest) error {
+	backupArgs := backupRequest.Args
+	mandatoryFields := map[string]string{}
+
 	switch backupRequest.Verb {
 	case ADD_BACKUP:
-		backupRegister := backupRequest.Args
-
-		if backupRegister.Ip == "" || backupRegister.Port == "" || backupRegister.Path == "" || backupRegister.Freq == "" {
-			log.Errorf("Error receiving some REGISTER mandatory fields. IP: '%s'; Port: '%s'; Path: '%s'; Frequency: '%s'.", backupRegister.Ip, backupRegister.Port, backupRegister.Path, backupRegister.Freq)
-			return false
-		}
-	case QUERY_BACKUP:
-		backupQuery := backupRequest.Args
+		mandatoryFields = map[string]string{ "ip": backupArgs.Ip, "port": backupArgs.Port, "path": backupArgs.Path, "freq": backupArgs.Freq }
+	case QUERY_BACKUP, REMOVE_BACKUP, RESTORE_BACKUP, RECOVER_BACKUP, UPDATE_BACKUP, PAUSE_BACKUP, RESUME_BACKUP, TRIGGER_BACKUP:
+		mandatoryFields = map[string]string{ "ip": backupArgs.Ip, "port": backupArgs.Port, "path": backupArgs.Path }
+	case LIST_BACKUPS, STATUS_BACKUPS:
+		// Every LIST filter is optional, while STATUS has no arguments.
+	default:
+		log.Errorf("Verb not recognized: %s.", backupRequest.Verb)
+		return common.NewBackupError(common.CODE_BAD_REQUEST, "Verb '%s' not recognized.", backupRequest.Verb)
+	}
 
-		if backupQuery.Ip == "" || backupQuery.Port == "" || backupQuery.Path == "" {
-			log.Errorf("Error receiving some QUERY mandatory fields. IP: '%s'; Port: '%s'; Path: '%s'", backupQuery.Ip, backupQuery.Port, backupQuery.Path)
-			return false
+	missingFields := []string{}
+	for field, value := range mandatoryFields {
+		if value == "" {
+			missingFields = append(missingFields, field)
 		}
-	case REMOVE_BACKUP:
-		backupUnregister := backupRequest.Args
+	}
 
-		if backupUnregister.Ip == "" || backupUnregister.Port == "" || backupUnregister.Path == "" {
-			log.Errorf("Error receiving some UNREGISTER mandatory fields. IP: '%s'; Port: '%s'; Path: '%s'", backupUnregister.Ip, backupUnregister.Port, backupUnregister.Path)
-			return false
-		}
-	default:
-		log.Errorf("Verb not recognized: %s.", backupRequest.Verb)
-		return false
+	if len(missingFields) > 0 {
+		sort.Strings(missingFields)
+		log.Errorf("Error receiving some %s mandatory fields. IP: '%s'; Port: '%s'; Path: '%s'; Frequency: '%s'.", backupRequest.Verb, backupArgs.Ip, backupArgs.Port, backupArgs.Path, backupArgs.Freq)
+		return common.NewBackupError(common.CODE_BAD_REQUEST, "Missing mandatory fields for %s: %s.", backupRequest.Verb, strings.Join(missingFields, ", "))
 	}
 	
-	return true
+	return nil
 }
 
 func (bkpManager *BackupManager) processBackupRequest(client net.Conn, backupRequest common.BackupRequest) {
@@ -136,82 +180,251 @@ func (bkpManager *BackupManager) processBackupRequest(client net.Conn, backupReq
 		backupRegister := backupRequest.Args
 		log.Infof("New REGISTER backup client request received, with IP '%s', port '%s', path '%s' and frequency '%s'.", backupRegister.Ip, backupRegister.Port, backupRegister.Path, backupRegister.Freq)
 
-		outputMessage := bkpManager.storage.AddBackupClient(backupRegister)
-		utils.SocketWrite(outputMessage, client)
+		backupId, created, err := bkpManager.storage.AddBackupClient(backupRegister)
+		if err != nil {
+			bkpManager.sendResponse(client, common.NewErrorResponse(err, nil))
+			return
+		}
+
+		if !created {
+			message := fmt.Sprintf("Backup client %s was already registered with the same settings.", backupId)
+			bkpManager.sendResponse(client, common.NewSuccessResponse(common.CODE_OK, message, map[string]string{ "id": backupId }))
+			return
+		}
+
+		message := fmt.Sprintf("New backup client successfully added with ID %s.", backupId)
+		bkpManager.sendResponse(client, common.NewSuccessResponse(common.CODE_CREATED, message, map[string]string{ "id": backupId }))
 	case QUERY_BACKUP:
 		backupQuery := backupRequest.Args
 		log.Infof("New QUERY request received, for backup with IP '%s', port '%s' and path '%s'.", backupQuery.Ip, backupQuery.Port, backupQuery.Path)
 
-		backupLog, backupLogSize := bkpManager.storage.RetrieveBackupLog(backupQuery)
-
-		if backupLogSize < 0 {
-			fileSizeMessage := utils.FillString("0", BUFFER_BACKUP_LOG_SIZE)
-			client.Write([]byte(fileSizeMessage))
-
-			ip, port := utils.ParseAddress(client.RemoteAddr().String())
-			log.Infof("Sending empyt log file size to connection ('%s', %s).", ip, port)
-
-			utils.SocketWrite("There was an error retrieving the requested backup log. Try again later.", client)
-		} else {
-			bkpManager.sendBackupLog(client, backupLog, backupLogSize)
+		queryInfo, err := bkpManager.storage.QueryBackupClient(backupQuery)
+		if err != nil {
+			bkpManager.sendResponse(client, common.NewErrorResponse(err, nil))
+			return
 		}
+
+		message := fmt.Sprintf("Found %d backups stored for client %s.", len(queryInfo.Backups), queryInfo.Id)
+		bkpManager.sendResponse(client, common.NewSuccessResponse(common.CODE_OK, message, queryInfo))
 	case REMOVE_BACKUP:
 		backupRegister := backupRequest.Args
 		log.Infof("New UNREGISTER backup client request received, with IP '%s', port '%s' and path '%s'.", backupRegister.Ip, backupRegister.Port, backupRegister.Path)
 
-		outputMessage := bkpManager.storage.RemoveBackupClient(backupRegister)
-		utils.SocketWrite(outputMessage, client)
+		backupId, err := bkpManager.storage.RemoveBackupClient(backupRegister)
+		if err != nil {
+			bkpManager.sendResponse(client, common.NewErrorResponse(err, nil))
+			return
+		}
+
+		message := fmt.Sprintf("Backup client %s successfully removed.", backupId)
+		bkpManager.sendResponse(client, common.NewSuccessResponse(common.CODE_OK, message, map[string]string{ "id": backupId }))
+	case RESTORE_BACKUP:
+		backupRestore := backupRequest.Args
+		log.Infof("New RESTORE request received, for backup with IP '%s', port '%s', path '%s' and timestamp '%s'.", backupRestore.Ip, backupRestore.Port, backupRestore.Path, backupRequest.Options.Backup)
+
+		backupFile, backupFileSize, err := bkpManager.storage.RetrieveBackup(backupRestore, backupRequest.Options.Backup)
+		if err != nil {
+			bkpManager.sendResponse(client, common.NewErrorResponse(err, nil))
+			return
+		}
+
+		// The archive is streamed right after the response, with the size informed in it.
+		backupName := filepath.Base(backupFile.Name())
+		message := fmt.Sprintf("Sending backup %s.", backupName)
+		bkpManager.sendResponse(client, common.NewSuccessResponse(common.CODE_OK, message, map[string]interface{}{ "backup": backupName, "size": backupFileSize }))
+		bkpManager.sendFile(client, backupFile, backupFileSize)
+	case RECOVER_BACKUP:
+		backupRecover := backupRequest.Args
+		targetPath := backupRequest.Options.Target
+		if targetPath == "" {
+			targetPath = backupRecover.Path
+		}
+		log.Infof("New RECOVER request received, for backup with IP '%s', port '%s', path '%s' and timestamp '%s' into path '%s'.", backupRecover.Ip, backupRecover.Port, backupRecover.Path, backupRequest.Options.Backup, targetPath)
+
+		backupFile, backupFileSize, err := bkpManager.storage.RetrieveBackup(backupRecover, backupRequest.Options.Backup)
+		if err != nil {
+			bkpManager.sendResponse(client, common.NewErrorResponse(err, nil))
+			return
+		}
+
+		backupName := filepath.Base(backupFile.Name())
+		responseData := map[string]string{ "backup": backupName, "target": targetPath }
+
+		err = bkpManager.scheduler.RestoreBackup(backupRecover, backupFile, backupFileSize, targetPath)
+		if restoreError, ok := err.(*scheduler.RestoreError); ok {
+			responseData["error"] = restoreError.Code
+			backupError := common.NewBackupError(common.CODE_BAD_GATEWAY, "Couldn't restore backup %s: %s.", backupName, restoreError)
+			bkpManager.sendResponse(client, common.NewErrorResponse(backupError, responseData))
+			return
+		} else if err != nil {
+			bkpManager.sendResponse(client, common.NewErrorResponse(err, responseData))
+			return
+		}
+
+		bkpManager.storage.RegisterRestore(backupRecover, backupName, targetPath)
+		message := fmt.Sprintf("Backup %s successfully restored into '%s'.", backupName, targetPath)
+		bkpManager.sendResponse(client, common.NewSuccessResponse(common.CODE_OK, message, responseData))
+	case LIST_BACKUPS:
+		backupFilter := backupRequest.Args
+		log.Infof("New LIST request received, filtering by IP '%s' and path prefix '%s'.", backupFilter.Ip, backupFilter.Path)
+
+		backupClients := bkpManager.storage.ListBackupClients(backupFilter.Ip, backupFilter.Path)
+		message := fmt.Sprintf("Found %d backup clients.", len(backupClients))
+		bkpManager.sendResponse(client, common.NewSuccessResponse(common.CODE_OK, message, backupClients))
+	case STATUS_BACKUPS:
+		log.Infof("New STATUS request received.")
+
+		queueStatus := bkpManager.scheduler.QueueStatus()
+		message := fmt.Sprintf("%d backups running and %d queued.", len(queueStatus.Running), len(queueStatus.Queued))
+		bkpManager.sendResponse(client, common.NewSuccessResponse(common.CODE_OK, message, queueStatus))
+	case UPDATE_BACKUP:
+		backupUpdate := backupRequest.Args
+		backupOptions := backupRequest.Options
+		log.Infof("New UPDATE request received, for backup with IP '%s', port '%s' and path '%s', with new frequency '%s', new path '%s' and policy '%s'.", backupUpdate.Ip, backupUpdate.Port, backupUpdate.Path, backupOptions.Freq, backupOptions.Path, backupOptions.Policy)
+
+		backupId, backupRegister, err := bkpManager.storage.UpdateBackupClient(backupUpdate, backupOptions.Freq, backupOptions.Path, backupOptions.Blackouts, backupOptions.Policy)
+		if err != nil {
+			bkpManager.sendResponse(client, common.NewErrorResponse(err, nil))
+			return
+		}
+
+		responseData := map[string]interface{}{ "id": backupId, "path": backupRegister.Path, "freq": backupRegister.Freq, "next": backupRegister.Next, "blackouts": backupRegister.Blackouts }
+		message := fmt.Sprintf("Backup client %s successfully updated.", backupId)
+		bkpManager.sendResponse(client, common.NewSuccessResponse(common.CODE_OK, message, responseData))
+	case PAUSE_BACKUP:
+		backupPause := backupRequest.Args
+		log.Infof("New PAUSE request received, for backup with IP '%s', port '%s' and path '%s', resuming at '%s'.", backupPause.Ip, backupPause.Port, backupPause.Path, backupRequest.Options.Resume)
+
+		resumeAt, err := parseResumeTime(backupRequest.Options.Resume)
+		if err != nil {
+			bkpManager.sendResponse(client, common.NewErrorResponse(err, nil))
+			return
+		}
+
+		backupId, err := bkpManager.storage.PauseBackupClient(backupPause, resumeAt)
+		if err != nil {
+			bkpManager.sendResponse(client, common.NewErrorResponse(err, nil))
+			return
+		}
+
+		responseData := map[string]interface{}{ "id": backupId, "paused": true }
+		if !resumeAt.IsZero() {
+			responseData["resume_at"] = resumeAt
+		}
+
+		message := fmt.Sprintf("Backup client %s successfully paused.", backupId)
+		bkpManager.sendResponse(client, common.NewSuccessResponse(common.CODE_OK, message, responseData))
+	case RESUME_BACKUP:
+		backupResume := backupRequest.Args
+		log.Infof("New RESUME request received, for backup with IP '%s', port '%s' and path '%s'.", backupResume.Ip, backupResume.Port, backupResume.Path)
+
+		backupId, err := bkpManager.storage.ResumeBackupClient(backupResume)
+		if err != nil {
+			bkpManager.sendResponse(client, common.NewErrorResponse(err, nil))
+			return
+		}
+
+		message := fmt.Sprintf("Backup client %s successfully resumed.", backupId)
+		bkpManager.sendResponse(client, common.NewSuccessResponse(common.CODE_OK, message, map[string]interface{}{ "id": backupId, "paused": false }))
+	case TRIGGER_BACKUP:
+		backupTrigger := backupRequest.Args
+		log.Infof("New TRIGGER request received, for backup with IP '%s', port '%s' and path '%s' (force: %t).", backupTrigger.Ip, backupTrigger.Port, backupTrigger.Path, backupRequest.Options.Force)
+
+		backupId, backupInfo, err := bkpManager.storage.GetBackupClient(backupTrigger)
+		if err != nil {
+			bkpManager.sendResponse(client, common.NewErrorResponse(err, nil))
+			return
+		}
+
+		bkpManager.storage.RegisterTrigger(backupId, backupRequest.Options.Force)
+		backupResult := bkpManager.scheduler.TriggerBackup(backupId, backupInfo, backupRequest.Options.Force)
+
+		switch backupResult.Status {
+		case scheduler.BACKUP_STORED:
+			message := fmt.Sprintf("New backup stored for client %s.", backupId)
+			bkpManager.sendResponse(client, common.NewSuccessResponse(common.CODE_OK, message, backupResult))
+		case scheduler.BACKUP_UNCHANGED:
+			message := fmt.Sprintf("Backup skipped for client %s because it didn't change since the last one.", backupId)
+			bkpManager.sendResponse(client, common.NewSuccessResponse(common.CODE_OK, message, backupResult))
+		default:
+			backupError := common.NewBackupError(common.CODE_BAD_GATEWAY, "Backup failed for client %s: %s.", backupId, backupResult.Error)
+			bkpManager.sendResponse(client, common.NewErrorResponse(backupError, backupResult))
+		}
 	default:
 		log.Fatalf("Flow forbidden.")
 	}
 }
 
-func (bkpManager *BackupManager) sendBackupLog(client net.Conn, file *os.File, size int64) {
+// Parse auto-resume time, given as a duration from now or as an RFC3339 date.
+func parseResumeTime(resume string) (time.Time, error) {
+	if resume == "" {
+		return time.Time{}, nil
+	}
+
+	if duration, err := time.ParseDuration(resume); err == nil && duration > 0 {
+		return time.Now().Add(duration), nil
+	}
+
+	if resumeAt, err := time.Parse(time.RFC3339, resume); err == nil && resumeAt.After(time.Now()) {
+		return resumeAt, nil
+	}
+
+	return time.Time{}, common.NewBackupError(common.CODE_BAD_REQUEST, "Invalid resume time '%s'. Expected a future RFC3339 date or a positive duration.", resume)
+}
+
+func (bkpManager *BackupManager) sendResponse(client net.Conn, response common.BackupResponse) {
 	ip, port := utils.ParseAddress(client.RemoteAddr().String())
-	fileSize := strconv.FormatInt(size, 10)
-	fileSizeMessage := utils.FillString(fileSize, BUFFER_BACKUP_LOG_SIZE)
-	
-	client.Write([]byte(fileSizeMessage))
-	log.Infof("Sending backup log file size (%d) to connection ('%s', %s).", fileSize, ip, port)
-	
-	sendBuffer := make([]byte, BUFFER_BACKUP_LOG)
-	log.Infof("Start sending backup log file (size %d) to connection ('%s', %s).", fileSize, ip, port)
+
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		log.Errorf("Error generating JSON response for connection ('%s', %s). Err: '%s'", ip, port, err)
+		responseJson, _ = json.Marshal(common.NewErrorResponse(common.NewBackupError(common.CODE_INTERNAL_ERROR, "Error generating response."), nil))
+	}
+
+	log.Infof("Sending response with code %d to connection ('%s', %s).", response.Code, ip, port)
+	utils.SocketWrite(string(responseJson) + "\n", client)
+}
+
+func (bkpManager *BackupManager) sendFile(client net.Conn, file *os.File, size int64) {
+	ip, port := utils.ParseAddress(client.RemoteAddr().String())
+	sendBuffer := make([]byte, BUFFER_FILE)
+	log.Infof("Start sending file %s (size %d) to connection ('%s', %s).", file.Name(), size, ip, port)
 
 	var currentByte int64 = 0
 	for {
-		idx := int(math.Ceil(float64(currentByte) / float64(BUFFER_BACKUP_LOG))) + 1
-		log.Debugf("Start sending chunk #%d.", idx)
+		idx := int(math.Ceil(float64(currentByte) / float64(BUFFER_FILE))) + 1
+		log.Tracef("Start sending chunk #%d.", idx)
 
 		sentBytes, err := file.ReadAt(sendBuffer, currentByte)
 
 		if sentBytes != 0 {
 			_, err = client.Write(sendBuffer[:sentBytes])
 			if err != nil {
-				log.Errorf("Error sending chunk #%d, with %d bytes.", idx, sentBytes, err)
+				log.Errorf("Error sending chunk #%d, with %d bytes. Err: '%s'", idx, sentBytes, err)
 			}
-			log.Debugf("Finish sending chunk #%d, with %d bytes.", idx, sentBytes)
+			log.Tracef("Finish sending chunk #%d, with %d bytes.", idx, sentBytes)
 		}
 
 		if err != nil {
 			if err == io.EOF {
-				log.Debugf("Sending EOF in chunk #%d.", idx)
+				log.Tracef("Sending EOF in chunk #%d.", idx)
 			} else {
-				log.Errorf("Error sending backup log file to connection ('%s', %s).", ip, port, err)
+				log.Errorf("Error sending file to connection ('%s', %s). Err: '%s'", ip, port, err)
 			}
 			break
 		}
 
-		currentByte += BUFFER_BACKUP_LOG
+		currentByte += BUFFER_FILE
 	}
 
 	file.Close()
-	log.Infof("Backup log file sent to connection ('%s', %s).", ip, port)
+	log.Infof("File %s sent to connection ('%s', %s).", file.Name(), ip, port)
 }
 
 func (bkpManager *BackupManager) Run() {
-	listener, err := net.Listen("tcp", ":" + bkpManager.port)
+	listener, err := utils.Listen(bkpManager.port, bkpManager.tlsConfig)
 	if listener == nil || err != nil {
-		log.Fatalf("Error creating TCP BackupManager socket at port %s.", bkpManager.port, err)
+		log.Fatalf("Error creating TCP BackupManager socket at port %s. Err: '%s'", bkpManager.port, err)
 	}
 
 	// Start processing connections
@@ -0,0 +1,154 @@
+package scheduler
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/LaCumbancha/backup-server/backup-manager/utils"
+	"github.com/LaCumbancha/backup-server/backup-manager/common"
+)
+
+const LEGACY_AGENT_VERSION = "legacy"
+
+var schedulerCapabilities = utils.Capabilities {
+	Compression:	[]string{ utils.COMPRESSION_GZIP },
+	Incremental:	false,
+	Restore:		true,
+}
+
+// Agents previous to the handshake only spoke the first protocol version, with gzip backups and restore support.
+var legacyCapabilities = utils.Capabilities {
+	Compression:	[]string{ utils.COMPRESSION_GZIP },
+	Incremental:	false,
+	Restore:		true,
+}
+
+// Open a connection with a backup client node, exchanging versions and capabilities before any request. Agents
+// that don't know the handshake are detected and reconnected to without it.
+func (bkpScheduler *BackupScheduler) connectAgent(backupId string, ip string, port string, correlationId string) (net.Conn, common.AgentInfo, error) {
+	logger := utils.CorrelationLogger(correlationId)
+
+	conn, err := utils.Dial(ip + ":" + port, bkpScheduler.tlsConfig)
+	bkpScheduler.recordAvailability(ip, port, 0, err)
+	if err != nil {
+		return nil, common.AgentInfo{}, err
+	}
+
+	hello := utils.HelloMessage {
+		ProtocolVersion:	utils.PROTOCOL_VERSION,
+		Version:			common.MANAGER_VERSION,
+		Capabilities:		schedulerCapabilities,
+		CorrelationId:		correlationId,
+	}
+
+	if err = utils.WriteMessage(conn, utils.MESSAGE_HELLO, hello); err != nil {
+		conn.Close()
+		return nil, common.AgentInfo{}, err
+	}
+
+	var helloResponse utils.HelloResponseMessage
+	err = utils.ReadMessage(conn, utils.MESSAGE_HELLO_RESPONSE, &helloResponse)
+	if errors.Cause(err) == utils.ErrUnexpectedMessage {
+		conn.Close()
+		logger.Warnf("Backup client %s at ('%s', %s) doesn't support the handshake. Falling back to legacy mode.", backupId, ip, port)
+		return bkpScheduler.connectLegacyAgent(backupId, ip, port)
+	} else if err != nil {
+		conn.Close()
+		return nil, common.AgentInfo{}, err
+	}
+
+	if !helloResponse.Accepted {
+		conn.Close()
+		logger.Errorf("Backup client %s (version %s) refused the handshake. Reason: %s.", backupId, helloResponse.Version, helloResponse.Reason)
+		return nil, common.AgentInfo{}, errors.Errorf("the backup client refused the handshake: %s", helloResponse.Reason)
+	}
+
+	if helloResponse.ProtocolVersion < utils.MIN_PROTOCOL_VERSION || helloResponse.ProtocolVersion > utils.PROTOCOL_VERSION {
+		conn.Close()
+		logger.Errorf("Backup client %s (version %s) answered with unsupported protocol version %d.", backupId, helloResponse.Version, helloResponse.ProtocolVersion)
+		return nil, common.AgentInfo{}, errors.Wrapf(utils.ErrVersionMismatch, "unsupported protocol version %d", helloResponse.ProtocolVersion)
+	}
+
+	if helloResponse.Challenge != "" {
+		if bkpScheduler.sharedKey == "" {
+			conn.Close()
+			logger.Errorf("Backup client %s requires a shared key, but none was configured.", backupId)
+			return nil, common.AgentInfo{}, errors.Wrap(utils.ErrUnauthorized, "the backup client requires a shared key")
+		}
+
+		authMessage := utils.AuthMessage{ Signature: utils.SignChallenge(bkpScheduler.sharedKey, helloResponse.Challenge) }
+		if err = utils.WriteMessage(conn, utils.MESSAGE_AUTH, authMessage); err != nil {
+			conn.Close()
+			return nil, common.AgentInfo{}, err
+		}
+
+		var authResponse utils.AuthResponseMessage
+		if err = utils.ReadMessage(conn, utils.MESSAGE_AUTH_RESPONSE, &authResponse); err != nil {
+			conn.Close()
+			logger.Errorf("Backup client %s refused the shared key. Err: '%s'", backupId, err)
+			return nil, common.AgentInfo{}, err
+		}
+	}
+
+	// Agents presenting a verified certificate are identified by its name.
+	identity, _ := utils.PeerName(conn)
+
+	agentInfo := common.AgentInfo {
+		Identity:			identity,
+		Version:			helloResponse.Version,
+		ProtocolVersion:	helloResponse.ProtocolVersion,
+		Capabilities:		helloResponse.Capabilities,
+		CheckedAt:			time.Now(),
+	}
+
+	logger.Debugf("Handshake with backup client %s finished. Agent version %s; protocol %d; identity '%s'.", backupId, agentInfo.Version, agentInfo.ProtocolVersion, agentInfo.Identity)
+	bkpScheduler.storage.UpdateBackupAgent(backupId, agentInfo)
+	return conn, agentInfo, nil
+}
+
+func (bkpScheduler *BackupScheduler) connectLegacyAgent(backupId string, ip string, port string) (net.Conn, common.AgentInfo, error) {
+	conn, err := utils.Dial(ip + ":" + port, bkpScheduler.tlsConfig)
+	if err != nil {
+		return nil, common.AgentInfo{}, err
+	}
+
+	identity, _ := utils.PeerName(conn)
+
+	agentInfo := common.AgentInfo {
+		Identity:			identity,
+		Version:			LEGACY_AGENT_VERSION,
+		ProtocolVersion:	utils.MIN_PROTOCOL_VERSION,
+		Capabilities:		legacyCapabilities,
+		Legacy:				true,
+		CheckedAt:			time.Now(),
+	}
+
+	bkpScheduler.storage.UpdateBackupAgent(backupId, agentInfo)
+	return conn, agentInfo, nil
+}
+
+// Describe why a connection with a backup client node couldn't be opened.
+func connectionErrorMessage(err error) string {
+	switch cause := errors.Cause(err); {
+	case cause == utils.ErrVersionMismatch:
+		return "the backup client speaks a different protocol version"
+	case cause == utils.ErrUnauthorized:
+		return "the backup client refused the manager credentials"
+	case isDialError(cause):
+		return "couldn't connect with the backup client"
+	default:
+		return "handshake with the backup client failed"
+	}
+}
+
+func isDialError(err error) bool {
+	opError, ok := err.(*net.OpError)
+	return ok && opError.Op == "dial"
+}
+
+func isTimeoutError(err error) bool {
+	netError, ok := errors.Cause(err).(net.Error)
+	return ok && netError.Timeout()
+}
@@ -0,0 +1,86 @@
+package scheduler
+
+import (
+	"time"
+	"container/heap"
+)
+
+type scheduledBackup struct {
+	id 				string
+	due 			time.Time
+	index 			int
+}
+
+// Min-heap of the moments in which each backup client must be checked, indexed by ID so entries can be moved or
+// removed when the client changes.
+type backupHeap struct {
+	entries 		[]*scheduledBackup
+	byId 			map[string]*scheduledBackup
+}
+
+func newBackupHeap() *backupHeap {
+	return &backupHeap {
+		entries:		[]*scheduledBackup{},
+		byId:			make(map[string]*scheduledBackup),
+	}
+}
+
+func (backups *backupHeap) Len() int {
+	return len(backups.entries)
+}
+
+func (backups *backupHeap) Less(idx1, idx2 int) bool {
+	return backups.entries[idx1].due.Before(backups.entries[idx2].due)
+}
+
+func (backups *backupHeap) Swap(idx1, idx2 int) {
+	backups.entries[idx1], backups.entries[idx2] = backups.entries[idx2], backups.entries[idx1]
+	backups.entries[idx1].index = idx1
+	backups.entries[idx2].index = idx2
+}
+
+func (backups *backupHeap) Push(value interface{}) {
+	entry := value.(*scheduledBackup)
+	entry.index = len(backups.entries)
+	backups.entries = append(backups.entries, entry)
+	backups.byId[entry.id] = entry
+}
+
+func (backups *backupHeap) Pop() interface{} {
+	last := len(backups.entries) - 1
+	entry := backups.entries[last]
+	backups.entries[last] = nil
+	backups.entries = backups.entries[:last]
+	delete(backups.byId, entry.id)
+	return entry
+}
+
+// Add a backup client or move it to a new due time.
+func (backups *backupHeap) schedule(backupId string, due time.Time) {
+	if entry, ok := backups.byId[backupId]; ok {
+		entry.due = due
+		heap.Fix(backups, entry.index)
+		return
+	}
+
+	heap.Push(backups, &scheduledBackup{ id: backupId, due: due })
+}
+
+func (backups *backupHeap) remove(backupId string) {
+	if entry, ok := backups.byId[backupId]; ok {
+		heap.Remove(backups, entry.index)
+	}
+}
+
+// Earliest due time. Returns false if there is nothing scheduled.
+func (backups *backupHeap) peek() (time.Time, bool) {
+	if len(backups.entries) == 0 {
+		return time.Time{}, false
+	}
+
+	return backups.entries[0].due, true
+}
+
+func (backups *backupHeap) pop() string {
+	return heap.Pop(backups).(*scheduledBackup).id
+}
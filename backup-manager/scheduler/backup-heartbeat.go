@@ -0,0 +1,145 @@
+package scheduler
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/LaCumbancha/backup-server/backup-manager/utils"
+	"github.com/LaCumbancha/backup-server/backup-manager/common"
+)
+
+const DEFAULT_HEARTBEAT_INTERVAL = 30 * time.Second
+
+// Time given to a backup client node to answer a heartbeat.
+const HEARTBEAT_TIMEOUT = 5 * time.Second
+
+// Heartbeats sent at the same time in each round.
+const HEARTBEAT_MAX_PINGS = 32
+
+type agentAddress struct {
+	ip 				string
+	port 			string
+}
+
+// Ping every backup client node periodically, keeping track of which ones are reachable.
+func (bkpScheduler *BackupScheduler) runHeartbeats() {
+	for {
+		bkpScheduler.checkAgents()
+		time.Sleep(bkpScheduler.heartbeatInterval)
+	}
+}
+
+func (bkpScheduler *BackupScheduler) checkAgents() {
+	agents := make(map[agentAddress]bool)
+	for _, backupInfo := range bkpScheduler.storage.GetBackupClients() {
+		agents[agentAddress{ ip: backupInfo.Ip, port: backupInfo.Port }] = true
+	}
+
+	var pending sync.WaitGroup
+	pings := make(chan struct{}, HEARTBEAT_MAX_PINGS)
+
+	for agent := range agents {
+		// Nodes transferring backups or restores are busy with them, and the transfers already tell about their
+		// availability.
+		if bkpScheduler.queue.isTransferring(agent.ip, agent.port) || bkpScheduler.isRestoring(agent.ip, agent.port) {
+			continue
+		}
+
+		pings <- struct{}{}
+		pending.Add(1)
+
+		go func(agent agentAddress) {
+			defer pending.Done()
+			latency, err := bkpScheduler.pingAgent(agent.ip, agent.port)
+			bkpScheduler.recordAvailability(agent.ip, agent.port, latency, err)
+			<-pings
+		}(agent)
+	}
+
+	pending.Wait()
+	log.Debugf("Heartbeats sent to %d backup client nodes.", len(agents))
+}
+
+// Send a heartbeat to a backup client node, returning its round trip time. Agents previous to heartbeats answer
+// with an error frame, which is enough to know they are alive.
+func (bkpScheduler *BackupScheduler) pingAgent(ip string, port string) (time.Duration, error) {
+	startTime := time.Now()
+
+	conn, err := utils.DialTimeout(net.JoinHostPort(ip, port), bkpScheduler.tlsConfig, HEARTBEAT_TIMEOUT)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(startTime.Add(HEARTBEAT_TIMEOUT))
+
+	if err = utils.WriteMessage(conn, utils.MESSAGE_PING, utils.PingMessage{ SentAt: startTime }); err != nil {
+		return 0, err
+	}
+
+	var pong utils.PongMessage
+	err = utils.ReadMessage(conn, utils.MESSAGE_PONG, &pong)
+	switch errors.Cause(err) {
+	case nil, utils.ErrUnexpectedMessage, utils.ErrVersionMismatch, utils.ErrUnauthorized:
+		return time.Since(startTime), nil
+	default:
+		return 0, err
+	}
+}
+
+// Update the availability of a backup client node after a heartbeat or a connection attempt. A zero latency keeps
+// the previous one. Retries waiting for a node that becomes reachable again are started right away.
+func (bkpScheduler *BackupScheduler) recordAvailability(ip string, port string, latency time.Duration, err error) {
+	previous, known := bkpScheduler.storage.GetAgentAvailability(ip, port)
+
+	now := time.Now()
+	availability := common.AgentAvailability {
+		Reachable:		err == nil,
+		LastSeen:		previous.LastSeen,
+		LatencyMs:		previous.LatencyMs,
+		CheckedAt:		now,
+	}
+
+	if err == nil {
+		availability.LastSeen = &now
+		if latency > 0 {
+			availability.LatencyMs = float64(latency) / float64(time.Millisecond)
+		}
+	} else {
+		availability.Failures = previous.Failures + 1
+	}
+
+	bkpScheduler.storage.UpdateAgentAvailability(ip, port, availability)
+
+	if err != nil && (!known || previous.Reachable) {
+		log.Warnf("Backup client node at ('%s', %s) is unreachable. Err: '%s'", ip, port, err)
+	} else if err == nil && known && !previous.Reachable {
+		log.Infof("Backup client node at ('%s', %s) is reachable again.", ip, port)
+		bkpScheduler.resumeRetries(ip, port)
+	}
+}
+
+// Check if a backup client node is known to be down.
+func (bkpScheduler *BackupScheduler) isUnreachable(ip string, port string) bool {
+	availability, known := bkpScheduler.storage.GetAgentAvailability(ip, port)
+	return known && !availability.Reachable
+}
+
+func (bkpScheduler *BackupScheduler) resumeRetries(ip string, port string) {
+	now := time.Now()
+	updatedBackups := make(map[string]time.Time)
+
+	for backupId, backupInfo := range bkpScheduler.storage.GetBackupClients() {
+		if backupInfo.Ip == ip && backupInfo.Port == port && !backupInfo.Paused && bkpScheduler.isRetrying(backupId) {
+			updatedBackups[backupId] = now
+		}
+	}
+
+	if len(updatedBackups) > 0 {
+		log.Infof("Retrying %d backups of the backup client node at ('%s', %s) right away.", len(updatedBackups), ip, port)
+		bkpScheduler.storage.UpdateBackupSchedules(updatedBackups)
+	}
+}
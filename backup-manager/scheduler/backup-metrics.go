@@ -0,0 +1,31 @@
+package scheduler
+
+import (
+	"github.com/LaCumbancha/backup-server/backup-manager/utils"
+)
+
+var transferDurationBuckets = []float64{ 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 1800, 3600 }
+
+var backupsStarted = utils.NewCounter("backup_manager_backups_started_total", "Backup transfers started, scheduled or manual.")
+var backupsSucceeded = utils.NewCounter("backup_manager_backups_succeeded_total", "Backups received and stored.")
+var backupsFailed = utils.NewCounter("backup_manager_backups_failed_total", "Backup transfers failed.")
+var backupsUnchanged = utils.NewCounter("backup_manager_backups_unchanged_total", "Backups skipped as the etag didn't change.")
+var receivedBytes = utils.NewCounter("backup_manager_received_bytes_total", "Bytes of backup files received.")
+var transferDuration = utils.NewHistogram("backup_manager_transfer_duration_seconds", "Duration of backup transfers, from the request to the stored file.", transferDurationBuckets)
+
+// Metrics read from the scheduler state when collected.
+func (bkpScheduler *BackupScheduler) registerMetrics() {
+	utils.NewGaugeFunc("backup_manager_queued_backups", "Backups waiting for a transfer worker.", func() float64 {
+		queued, _ := bkpScheduler.queue.counts()
+		return float64(queued)
+	})
+
+	utils.NewGaugeFunc("backup_manager_running_backups", "Backup transfers running.", func() float64 {
+		_, running := bkpScheduler.queue.counts()
+		return float64(running)
+	})
+
+	utils.NewGaugeFunc("backup_manager_registered_clients", "Backup clients registered.", func() float64 {
+		return float64(bkpScheduler.storage.CountBackupClients())
+	})
+}
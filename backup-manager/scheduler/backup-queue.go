@@ -0,0 +1,218 @@
+package scheduler
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/LaCumbancha/backup-server/backup-manager/common"
+)
+
+const DEFAULT_MAX_TRANSFERS = 10
+const DEFAULT_MAX_TRANSFERS_PER_HOST = 2
+
+type queuedRequest struct {
+	request 			BackupRequest
+	queuedAt 			time.Time
+	startedAt 			time.Time
+}
+
+// FIFO of backup requests served by a fixed amount of workers. A request waits while its host already has the
+// maximum transfers running, or while its backup is being transferred, letting the following requests go first.
+type backupQueue struct {
+	maxTransfers 		int
+	maxPerHost 			int
+	pending 			[]*queuedRequest
+	running 			map[*queuedRequest]bool
+	runningPerHost 		map[string]int
+	mutex 				sync.Mutex
+	available 			*sync.Cond
+}
+
+func newBackupQueue(maxTransfers int, maxPerHost int) *backupQueue {
+	if maxTransfers <= 0 {
+		maxTransfers = DEFAULT_MAX_TRANSFERS
+	}
+
+	queue := &backupQueue {
+		maxTransfers:		maxTransfers,
+		maxPerHost:			maxPerHost,
+		pending:			[]*queuedRequest{},
+		running:			make(map[*queuedRequest]bool),
+		runningPerHost:		make(map[string]int),
+	}
+	queue.available = sync.NewCond(&queue.mutex)
+
+	return queue
+}
+
+// Start the workers, each one processing requests with the given handler.
+func (queue *backupQueue) start(handler func(BackupRequest)) {
+	for worker := 0; worker < queue.maxTransfers; worker++ {
+		go func() {
+			for {
+				queued := queue.next()
+				handler(queued.request)
+				queue.done(queued)
+			}
+		}()
+	}
+}
+
+// Add a request without blocking. Manual requests go ahead of the scheduled ones, while scheduled requests for a
+// backup already queued or running are skipped. Returns false if skipped.
+func (queue *backupQueue) enqueue(request BackupRequest) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if !request.Manual && queue.contains(request.Id) {
+		return false
+	}
+
+	queued := &queuedRequest{ request: request, queuedAt: time.Now() }
+	if request.Manual {
+		position := 0
+		for position < len(queue.pending) && queue.pending[position].request.Manual {
+			position++
+		}
+
+		queue.pending = append(queue.pending, nil)
+		copy(queue.pending[position+1:], queue.pending[position:])
+		queue.pending[position] = queued
+	} else {
+		queue.pending = append(queue.pending, queued)
+	}
+
+	log.Debugf("Backup for client %s queued. Requests waiting: %d.", request.Id, len(queue.pending))
+	queue.available.Broadcast()
+	return true
+}
+
+// Wait for the first request whose host can take another transfer.
+func (queue *backupQueue) next() *queuedRequest {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for {
+		for idx, queued := range queue.pending {
+			host := queued.request.Ip
+			if queue.maxPerHost > 0 && queue.runningPerHost[host] >= queue.maxPerHost {
+				continue
+			}
+
+			if queue.isRunning(queued.request.Id) {
+				continue
+			}
+
+			queue.pending = append(queue.pending[:idx], queue.pending[idx+1:]...)
+			queued.startedAt = time.Now()
+			queue.running[queued] = true
+			queue.runningPerHost[host]++
+			return queued
+		}
+
+		queue.available.Wait()
+	}
+}
+
+func (queue *backupQueue) done(queued *queuedRequest) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	delete(queue.running, queued)
+
+	host := queued.request.Ip
+	if queue.runningPerHost[host]--; queue.runningPerHost[host] <= 0 {
+		delete(queue.runningPerHost, host)
+	}
+
+	queue.available.Broadcast()
+}
+
+func (queue *backupQueue) status() common.QueueStatus {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	status := common.QueueStatus {
+		MaxTransfers:			queue.maxTransfers,
+		MaxTransfersPerHost:	queue.maxPerHost,
+		Running:				[]common.QueuedBackup{},
+		Queued:					[]common.QueuedBackup{},
+	}
+
+	for queued := range queue.running {
+		status.Running = append(status.Running, queued.info(true))
+	}
+
+	sort.Slice(status.Running, func(idx1, idx2 int) bool {
+		return status.Running[idx1].StartedAt.Before(*status.Running[idx2].StartedAt)
+	})
+
+	for _, queued := range queue.pending {
+		status.Queued = append(status.Queued, queued.info(false))
+	}
+
+	return status
+}
+
+// Amount of requests queued and running.
+func (queue *backupQueue) counts() (int, int) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return len(queue.pending), len(queue.running)
+}
+
+func (queue *backupQueue) isRunning(backupId string) bool {
+	for queued := range queue.running {
+		if queued.request.Id == backupId {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check if a transfer with the backup client node at the given address is running.
+func (queue *backupQueue) isTransferring(ip string, port string) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	for queued := range queue.running {
+		if queued.request.Ip == ip && queued.request.Port == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (queue *backupQueue) contains(backupId string) bool {
+	for _, queued := range queue.pending {
+		if queued.request.Id == backupId {
+			return true
+		}
+	}
+
+	return queue.isRunning(backupId)
+}
+
+func (queued *queuedRequest) info(started bool) common.QueuedBackup {
+	info := common.QueuedBackup {
+		Id:				queued.request.Id,
+		Ip:				queued.request.Ip,
+		Port:			queued.request.Port,
+		Path:			queued.request.Path,
+		Manual:			queued.request.Manual,
+		QueuedAt:		queued.queuedAt,
+	}
+
+	if started {
+		startedAt := queued.startedAt
+		info.StartedAt = &startedAt
+	}
+
+	return info
+}
@@ -0,0 +1,160 @@
+package scheduler
+
+import (
+	"sync"
+	"time"
+	"testing"
+)
+
+const testTimeout = 5 * time.Second
+
+// Handler keeping every request running until finished, reporting when each one starts.
+type testHandler struct {
+	started 		chan BackupRequest
+	releases 		map[string]chan struct{}
+	mutex 			sync.Mutex
+}
+
+func newTestHandler() *testHandler {
+	return &testHandler{ started: make(chan BackupRequest, 100), releases: make(map[string]chan struct{}) }
+}
+
+func (handler *testHandler) releaseFor(backupId string) chan struct{} {
+	handler.mutex.Lock()
+	defer handler.mutex.Unlock()
+
+	if _, ok := handler.releases[backupId]; !ok {
+		handler.releases[backupId] = make(chan struct{})
+	}
+	return handler.releases[backupId]
+}
+
+func (handler *testHandler) handle(request BackupRequest) {
+	release := handler.releaseFor(request.Id)
+	handler.started <- request
+	<-release
+}
+
+// Finish the running request of the given backup.
+func (handler *testHandler) finish(backupId string) {
+	handler.releaseFor(backupId) <- struct{}{}
+}
+
+func (handler *testHandler) waitStarted(t *testing.T) BackupRequest {
+	t.Helper()
+	select {
+	case request := <-handler.started:
+		return request
+	case <-time.After(testTimeout):
+		t.Fatalf("no request started")
+		return BackupRequest{}
+	}
+}
+
+func (handler *testHandler) expectIdle(t *testing.T) {
+	t.Helper()
+	select {
+	case request := <-handler.started:
+		t.Fatalf("unexpected request %s started", request.Id)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func testRequest(id string, ip string, manual bool) BackupRequest {
+	return BackupRequest{ Id: id, Ip: ip, Port: "20001", Path: "/var/lib/" + id, Manual: manual }
+}
+
+func TestBackupQueuePerHostLimit(t *testing.T) {
+	handler := newTestHandler()
+	queue := newBackupQueue(4, 2)
+	queue.start(handler.handle)
+
+	for _, request := range []BackupRequest{
+		testRequest("a1", "10.0.0.1", false),
+		testRequest("a2", "10.0.0.1", false),
+		testRequest("a3", "10.0.0.1", false),
+		testRequest("b1", "10.0.0.2", false),
+	} {
+		if !queue.enqueue(request) {
+			t.Fatalf("request %s not queued", request.Id)
+		}
+	}
+
+	// The third request for the first host waits, letting the other host go ahead.
+	started := map[string]bool{}
+	for idx := 0; idx < 3; idx++ {
+		started[handler.waitStarted(t).Id] = true
+	}
+	handler.expectIdle(t)
+
+	if !started["a1"] || !started["a2"] || !started["b1"] {
+		t.Fatalf("unexpected requests started %v", started)
+	}
+	if queued, running := queue.counts(); queued != 1 || running != 3 {
+		t.Fatalf("counts = %d queued, %d running, expected 1 and 3", queued, running)
+	}
+
+	handler.finish("b1")
+	handler.expectIdle(t)
+
+	handler.finish("a1")
+	if request := handler.waitStarted(t); request.Id != "a3" {
+		t.Fatalf("request %s started, expected a3", request.Id)
+	}
+}
+
+func TestBackupQueueManualRequestsFirst(t *testing.T) {
+	handler := newTestHandler()
+	queue := newBackupQueue(1, 0)
+	queue.start(handler.handle)
+
+	// Keeping the only worker busy while the rest of the requests are queued.
+	queue.enqueue(testRequest("running", "10.0.0.9", false))
+	handler.waitStarted(t)
+
+	queue.enqueue(testRequest("scheduled1", "10.0.0.1", false))
+	queue.enqueue(testRequest("scheduled2", "10.0.0.2", false))
+	queue.enqueue(testRequest("manual1", "10.0.0.3", true))
+	queue.enqueue(testRequest("manual2", "10.0.0.4", true))
+
+	status := queue.status()
+	if len(status.Running) != 1 || len(status.Queued) != 4 || status.Queued[0].Id != "manual1" {
+		t.Fatalf("unexpected queue status %+v", status)
+	}
+
+	previous := "running"
+	for _, expected := range []string{ "manual1", "manual2", "scheduled1", "scheduled2" } {
+		handler.finish(previous)
+		if request := handler.waitStarted(t); request.Id != expected {
+			t.Fatalf("request %s started, expected %s", request.Id, expected)
+		}
+		previous = expected
+	}
+}
+
+func TestBackupQueueDuplicates(t *testing.T) {
+	handler := newTestHandler()
+	queue := newBackupQueue(2, 0)
+	queue.start(handler.handle)
+
+	queue.enqueue(testRequest("backup", "10.0.0.1", false))
+	handler.waitStarted(t)
+
+	// Scheduled requests for a backup already running are skipped, while manual ones wait for it to finish.
+	if queue.enqueue(testRequest("backup", "10.0.0.1", false)) {
+		t.Fatalf("scheduled request queued while its backup was running")
+	}
+	if !queue.enqueue(testRequest("backup", "10.0.0.1", true)) {
+		t.Fatalf("manual request not queued")
+	}
+	handler.expectIdle(t)
+
+	if !queue.isTransferring("10.0.0.1", "20001") || queue.isTransferring("10.0.0.2", "20001") {
+		t.Fatalf("unexpected transferring state")
+	}
+
+	handler.finish("backup")
+	if request := handler.waitStarted(t); request.Id != "backup" || !request.Manual {
+		t.Fatalf("unexpected request %+v started", request)
+	}
+}
@@ -0,0 +1,183 @@
+package scheduler
+
+import (
+	"os"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/LaCumbancha/backup-server/backup-manager/utils"
+	"github.com/LaCumbancha/backup-server/backup-manager/common"
+)
+
+// Time a restore transfer may go without progress, and time given to the backup client to extract the backup once
+// received.
+const DEFAULT_RESTORE_IDLE_TIMEOUT = time.Minute
+const DEFAULT_RESTORE_TIMEOUT = time.Hour
+
+var restoreErrorMessages = map[string]string{
+	common.RESTORE_CONNECTION_ERROR:	"couldn't connect with the backup client",
+	common.RESTORE_TRANSFER_ERROR:		"error transferring the backup file",
+	common.RESTORE_VERSION_MISMATCH:	"the backup client speaks a different protocol version",
+	common.RESTORE_HANDSHAKE_ERROR:		"handshake with the backup client failed",
+	common.RESTORE_UNSUPPORTED:			"the backup client doesn't support restores",
+	common.RESTORE_UNAUTHORIZED:		"the backup client refused the manager credentials",
+	common.RESTORE_TIMEOUT:				"the backup client didn't finish the restore in time",
+	common.RESTORE_INVALID_REQUEST:		"the backup client rejected the restore request",
+	common.RESTORE_INVALID_ARCHIVE:		"the backup file couldn't be read by the backup client",
+	common.RESTORE_UNSAFE_ARCHIVE:		"the backup file contains entries outside the restore path",
+	common.RESTORE_WRITE_ERROR:			"the backup client couldn't write the restored files",
+	common.RESTORE_FORBIDDEN_PATH:		"the backup client forbids the restore path",
+}
+
+type restoreResponse struct {
+	message 		utils.RestoreResponseMessage
+	err 			error
+}
+
+type RestoreError struct {
+	Code 			string
+	Message			string
+}
+
+func (restoreError *RestoreError) Error() string {
+	return fmt.Sprintf("%s (%s)", restoreError.Message, restoreError.Code)
+}
+
+func newRestoreError(code string) *RestoreError {
+	message, ok := restoreErrorMessages[code]
+	if !ok {
+		message = "unknown error in the backup client"
+	}
+
+	return &RestoreError {
+		Code:		code,
+		Message:	message,
+	}
+}
+
+// Push a stored backup to the backup client, extracting it in the target path.
+func (bkpScheduler *BackupScheduler) RestoreBackup(backupRegister common.BackupRegister, backupFile *os.File, fileSize int64, targetPath string) error {
+	defer backupFile.Close()
+
+	correlationId := utils.NewCorrelationId()
+	logger := utils.CorrelationLogger(correlationId)
+
+	agent := agentAddress{ ip: backupRegister.Ip, port: backupRegister.Port }
+	bkpScheduler.startRestore(agent)
+	defer bkpScheduler.finishRestore(agent)
+
+	backupId := common.AsSha256(backupRegister)
+	conn, agentInfo, err := bkpScheduler.connectAgent(backupId, backupRegister.Ip, backupRegister.Port, correlationId)
+	if err != nil {
+		logger.Errorf("Couldn't stablish restore connection with client %s. Err: '%s'", backupRegister.Ip, err)
+		switch {
+		case errors.Cause(err) == utils.ErrVersionMismatch:
+			return newRestoreError(common.RESTORE_VERSION_MISMATCH)
+		case errors.Cause(err) == utils.ErrUnauthorized:
+			return newRestoreError(common.RESTORE_UNAUTHORIZED)
+		case isDialError(errors.Cause(err)):
+			return newRestoreError(common.RESTORE_CONNECTION_ERROR)
+		default:
+			return newRestoreError(common.RESTORE_HANDSHAKE_ERROR)
+		}
+	}
+	defer conn.Close()
+
+	if !agentInfo.Capabilities.Restore {
+		logger.Errorf("Backup client %s (version %s) doesn't support restores. Restore refused.", backupId, agentInfo.Version)
+		return newRestoreError(common.RESTORE_UNSUPPORTED)
+	}
+
+	// Writes fail once the backup client stops receiving, while the status is read with its own deadline, as the
+	// backup client stays silent while extracting.
+	idleConn := utils.NewIdleConn(conn, bkpScheduler.restoreIdleTimeout)
+
+	// Sending restore request
+	restoreRequestMessage := utils.RestoreRequestMessage {
+		Path:		backupRegister.Path,
+		Target:		targetPath,
+		CorrelationId:	correlationId,
+	}
+
+	if err = utils.WriteMessage(idleConn, utils.MESSAGE_RESTORE_REQUEST, restoreRequestMessage); err != nil {
+		logger.Errorf("Error sending restore request to connection ('%s', %s). Err: '%s'", backupRegister.Ip, backupRegister.Port, err)
+		return newRestoreError(common.RESTORE_TRANSFER_ERROR)
+	}
+	logger.Infof("Sending restore of path '%s' into '%s' to connection ('%s', %s).", backupRegister.Path, targetPath, backupRegister.Ip, backupRegister.Port)
+
+	// Agents refusing the restore target answer before receiving the file, so the status is read while sending it.
+	responses := make(chan restoreResponse, 1)
+	go func() {
+		var response restoreResponse
+		response.err = utils.ReadMessage(conn, utils.MESSAGE_RESTORE_RESPONSE, &response.message)
+		if response.err == nil && response.message.Status != common.RESTORE_OK {
+			conn.Close()										// Stops sending the file.
+		}
+		responses <- response
+	}()
+
+	// Sending backup
+	writeErr := utils.WriteFile(idleConn, backupFile, fileSize)
+	if writeErr == nil {
+		logger.Infof("Backup file (size %d) sent to connection ('%s', %s).", fileSize, backupRegister.Ip, backupRegister.Port)
+		conn.SetReadDeadline(time.Now().Add(bkpScheduler.restoreTimeout))
+	} else {
+		conn.SetReadDeadline(time.Now().Add(bkpScheduler.restoreIdleTimeout))
+	}
+
+	// Receiving restore status
+	response := <-responses
+	restoreResponse, err := response.message, response.err
+	if err != nil && writeErr != nil {
+		logger.Errorf("Error sending backup file to connection ('%s', %s). Err: '%s'", backupRegister.Ip, backupRegister.Port, writeErr)
+		if isTimeoutError(writeErr) {
+			return newRestoreError(common.RESTORE_TIMEOUT)
+		}
+		return newRestoreError(common.RESTORE_TRANSFER_ERROR)
+	} else if err != nil {
+		logger.Errorf("Error receiving restore status from connection ('%s', %s). Err: '%s'", backupRegister.Ip, backupRegister.Port, err)
+		switch {
+		case errors.Cause(err) == utils.ErrVersionMismatch:
+			return newRestoreError(common.RESTORE_VERSION_MISMATCH)
+		case errors.Cause(err) == utils.ErrUnauthorized:
+			return newRestoreError(common.RESTORE_UNAUTHORIZED)
+		case isTimeoutError(err):
+			return newRestoreError(common.RESTORE_TIMEOUT)
+		}
+		return newRestoreError(common.RESTORE_TRANSFER_ERROR)
+	}
+
+	status := restoreResponse.Status
+	if status != common.RESTORE_OK {
+		logger.Errorf("Restore failed in connection ('%s', %s) with status %s.", backupRegister.Ip, backupRegister.Port, status)
+		return newRestoreError(status)
+	}
+
+	logger.Infof("Restore finished in connection ('%s', %s).", backupRegister.Ip, backupRegister.Port)
+	return nil
+}
+
+// Restores running against each backup client node, so heartbeats leave them alone.
+func (bkpScheduler *BackupScheduler) startRestore(agent agentAddress) {
+	bkpScheduler.restoresMutex.Lock()
+	bkpScheduler.restores[agent]++
+	bkpScheduler.restoresMutex.Unlock()
+}
+
+func (bkpScheduler *BackupScheduler) finishRestore(agent agentAddress) {
+	bkpScheduler.restoresMutex.Lock()
+	defer bkpScheduler.restoresMutex.Unlock()
+
+	if bkpScheduler.restores[agent]--; bkpScheduler.restores[agent] <= 0 {
+		delete(bkpScheduler.restores, agent)
+	}
+}
+
+func (bkpScheduler *BackupScheduler) isRestoring(ip string, port string) bool {
+	bkpScheduler.restoresMutex.Lock()
+	defer bkpScheduler.restoresMutex.Unlock()
+
+	return bkpScheduler.restores[agentAddress{ ip: ip, port: port }] > 0
+}
@@ -0,0 +1,152 @@
+package scheduler
+
+import (
+	"os"
+	"net"
+	"time"
+	"strconv"
+	"testing"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/LaCumbancha/backup-server/backup-manager/utils"
+	"github.com/LaCumbancha/backup-server/backup-manager/common"
+)
+
+const testBackupSize = 64 * 1024 * 1024
+
+// Backup client node answering the handshake, then handling the restore request as the test needs.
+func startTestAgent(t *testing.T, handleRestore func(conn net.Conn)) (string, string, func()) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var hello utils.HelloMessage
+		if err := utils.ReadMessage(conn, utils.MESSAGE_HELLO, &hello); err != nil {
+			return
+		}
+
+		helloResponse := utils.HelloResponseMessage {
+			HelloMessage:	utils.HelloMessage {
+				ProtocolVersion:	utils.PROTOCOL_VERSION,
+				Version:			"test",
+				Capabilities:		utils.Capabilities{ Compression: []string{ utils.COMPRESSION_GZIP }, Restore: true },
+			},
+			Accepted:		true,
+		}
+		if err := utils.WriteMessage(conn, utils.MESSAGE_HELLO_RESPONSE, helloResponse); err != nil {
+			return
+		}
+
+		var restoreRequest utils.RestoreRequestMessage
+		if err := utils.ReadMessage(conn, utils.MESSAGE_RESTORE_REQUEST, &restoreRequest); err != nil {
+			return
+		}
+
+		handleRestore(conn)
+		<-done
+	}()
+
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+	return "127.0.0.1", port, func() { close(done); listener.Close() }
+}
+
+func newTestRestoreScheduler(t *testing.T, dir string) *BackupScheduler {
+	storage := common.NewBackupStorage(common.BackupStorageConfig{ Path: filepath.Join(dir, "backups") })
+	storage.BuildBackupStructure()
+
+	return &BackupScheduler {
+		storage:			storage,
+		restores:			make(map[agentAddress]int),
+		restoreIdleTimeout:	200 * time.Millisecond,
+		restoreTimeout:		500 * time.Millisecond,
+	}
+}
+
+func newTestBackupFile(t *testing.T, dir string) *os.File {
+	backupFile, err := os.Create(filepath.Join(dir, "Backup.tar.gz"))
+	if err != nil {
+		t.Fatalf("creating backup file: %s", err)
+	}
+
+	// Larger than the socket buffers, so agents not reading it block the transfer.
+	if err := backupFile.Truncate(testBackupSize); err != nil {
+		t.Fatalf("sizing backup file: %s", err)
+	}
+
+	return backupFile
+}
+
+func sendRestoreStatus(conn net.Conn, status string) {
+	utils.WriteMessage(conn, utils.MESSAGE_RESTORE_RESPONSE, utils.RestoreResponseMessage{ Status: status })
+}
+
+func TestRestoreBackup(t *testing.T) {
+	tests := []struct {
+		name 			string
+		handleRestore 	func(conn net.Conn)
+		code 			string
+	}{
+		{ "restored", func(conn net.Conn) {
+			utils.ReadFile(conn, ioutil.Discard)
+			sendRestoreStatus(conn, common.RESTORE_OK)
+		}, "" },
+		{ "refused before the transfer", func(conn net.Conn) {
+			sendRestoreStatus(conn, common.RESTORE_FORBIDDEN_PATH)
+		}, common.RESTORE_FORBIDDEN_PATH },
+		{ "failed extraction", func(conn net.Conn) {
+			utils.ReadFile(conn, ioutil.Discard)
+			sendRestoreStatus(conn, common.RESTORE_UNSAFE_ARCHIVE)
+		}, common.RESTORE_UNSAFE_ARCHIVE },
+		{ "agent not receiving", func(conn net.Conn) {}, common.RESTORE_TIMEOUT },
+		{ "agent hanging while extracting", func(conn net.Conn) {
+			utils.ReadFile(conn, ioutil.Discard)
+		}, common.RESTORE_TIMEOUT },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "backup-restore-test")
+			if err != nil {
+				t.Fatalf("creating temporary directory: %s", err)
+			}
+			defer os.RemoveAll(dir)
+
+			ip, port, stopAgent := startTestAgent(t, test.handleRestore)
+			defer stopAgent()
+
+			scheduler := newTestRestoreScheduler(t, dir)
+			backupRegister := common.BackupRegister{ Ip: ip, Port: port, Path: "/var/lib/app" }
+
+			result := make(chan error, 1)
+			go func() { result <- scheduler.RestoreBackup(backupRegister, newTestBackupFile(t, dir), testBackupSize, "/var/lib/app") }()
+
+			select {
+			case err = <-result:
+			case <-time.After(testTimeout):
+				t.Fatalf("restore didn't finish")
+			}
+
+			if test.code == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+			} else if restoreError, ok := err.(*RestoreError); !ok || restoreError.Code != test.code {
+				t.Fatalf("expected restore error %s, got %v", test.code, err)
+			}
+
+			if scheduler.isRestoring(ip, port) {
+				t.Fatalf("restore still registered as running")
+			}
+		})
+	}
+}
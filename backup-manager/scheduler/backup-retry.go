@@ -0,0 +1,126 @@
+package scheduler
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const DEFAULT_RETRY_BACKOFF = 30 * time.Second
+const DEFAULT_MAX_RETRY_BACKOFF = time.Hour
+const DEFAULT_MAX_RETRIES = 8
+
+// Failed scheduled backups retried, with an exponential backoff, before waiting for their next regular run.
+type backupRetry struct {
+	attempts 		int
+}
+
+// Dispatch a scheduled backup. Backups being retried, or whose node is known to be down, only start once their
+// backup client answers a heartbeat, so an unreachable node doesn't take a transfer worker.
+func (bkpScheduler *BackupScheduler) dispatchBackup(backupRequest BackupRequest) {
+	if !bkpScheduler.isRetrying(backupRequest.Id) && !bkpScheduler.isUnreachable(backupRequest.Ip, backupRequest.Port) {
+		bkpScheduler.enqueueBackup(backupRequest)
+		return
+	}
+
+	go func() {
+		latency, err := bkpScheduler.pingAgent(backupRequest.Ip, backupRequest.Port)
+		bkpScheduler.recordAvailability(backupRequest.Ip, backupRequest.Port, latency, err)
+		if err != nil {
+			backupRequest.logger().Infof("Backup client %s still unreachable at ('%s', %s). Err: '%s'", backupRequest.Id, backupRequest.Ip, backupRequest.Port, err)
+			bkpScheduler.retryBackup(backupRequest, "the backup client is unreachable")
+			return
+		}
+
+		backupRequest.logger().Infof("Backup client %s is reachable. Starting its backup.", backupRequest.Id)
+		bkpScheduler.enqueueBackup(backupRequest)
+	}()
+}
+
+func (bkpScheduler *BackupScheduler) enqueueBackup(backupRequest BackupRequest) {
+	if !bkpScheduler.queue.enqueue(backupRequest) {
+		backupRequest.logger().Warnf("Previous backup for client %s is still queued or running. Skipping this one.", backupRequest.Id)
+	}
+}
+
+func (bkpScheduler *BackupScheduler) isRetrying(backupId string) bool {
+	bkpScheduler.retriesMutex.Lock()
+	defer bkpScheduler.retriesMutex.Unlock()
+
+	_, ok := bkpScheduler.retries[backupId]
+	return ok
+}
+
+// Schedule the next attempt of a failed backup, before its next regular run. Once the retries are exhausted the
+// backup goes back to its regular schedule.
+func (bkpScheduler *BackupScheduler) retryBackup(backupRequest BackupRequest, reason string) {
+	bkpScheduler.retriesMutex.Lock()
+	retry, ok := bkpScheduler.retries[backupRequest.Id]
+	if !ok {
+		retry = &backupRetry{}
+		bkpScheduler.retries[backupRequest.Id] = retry
+	}
+	retry.attempts++
+	attempts := retry.attempts
+
+	exhausted := attempts > bkpScheduler.maxRetries
+	if exhausted {
+		delete(bkpScheduler.retries, backupRequest.Id)
+	}
+	bkpScheduler.retriesMutex.Unlock()
+
+	if exhausted {
+		if attempts > 1 {
+			backupRequest.logger().Warnf("Backup for client %s failed after %d retries. Waiting for its next scheduled backup.", backupRequest.Id, attempts - 1)
+			bkpScheduler.storage.RegisterRetryOutcome(backupRequest.Id, attempts - 1, false)
+		}
+		bkpScheduler.rescheduleBackup(backupRequest)
+		return
+	}
+
+	backupInfo, err := bkpScheduler.storage.FindBackupClient(backupRequest.Id)
+	if err != nil {
+		backupRequest.logger().Infof("Backup client %s was unregistered while its backup was running.", backupRequest.Id)
+		bkpScheduler.retriesMutex.Lock()
+		delete(bkpScheduler.retries, backupRequest.Id)
+		bkpScheduler.retriesMutex.Unlock()
+		return
+	}
+
+	now := time.Now()
+	retryAt := now.Add(bkpScheduler.retryDelay(attempts))
+	if nextBackup := bkpScheduler.updateBackupInformation(backupInfo, now).Next; nextBackup.Before(retryAt) {
+		retryAt = nextBackup
+	}
+
+	backupRequest.logger().Infof("Retry %d of %d for client %s backup setted at %s.", attempts, bkpScheduler.maxRetries, backupRequest.Id, retryAt.String())
+	bkpScheduler.storage.RegisterRetry(backupRequest.Id, attempts, bkpScheduler.maxRetries, retryAt, reason)
+	bkpScheduler.storage.UpdateBackupSchedules(map[string]time.Time{ backupRequest.Id: retryAt })
+}
+
+// Leave the retry state after a successful backup, recording how many retries it took.
+func (bkpScheduler *BackupScheduler) clearRetry(backupId string) {
+	bkpScheduler.retriesMutex.Lock()
+	retry, ok := bkpScheduler.retries[backupId]
+	delete(bkpScheduler.retries, backupId)
+	bkpScheduler.retriesMutex.Unlock()
+
+	if ok {
+		log.Infof("Backup for client %s succeeded after %d retries.", backupId, retry.attempts)
+		bkpScheduler.storage.RegisterRetryOutcome(backupId, retry.attempts, true)
+	}
+}
+
+// Backoff doubling with each attempt, from the configured one up to the maximum.
+func (bkpScheduler *BackupScheduler) retryDelay(attempts int) time.Duration {
+	backoff := bkpScheduler.retryBackoff
+	for attempt := 1; attempt < attempts && backoff < bkpScheduler.maxRetryBackoff; attempt++ {
+		backoff *= 2
+	}
+
+	if backoff > bkpScheduler.maxRetryBackoff {
+		backoff = bkpScheduler.maxRetryBackoff
+	}
+
+	return backoff
+}
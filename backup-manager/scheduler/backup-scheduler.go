@@ -1,29 +1,45 @@
 package scheduler
 
 import (
-	"io"
+	"os"
 	"net"
-	"math"
 	"time"
-	"strconv"
+	"sort"
+	"sync"
+	"crypto/tls"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/LaCumbancha/backup-server/backup-manager/utils"
 	"github.com/LaCumbancha/backup-server/backup-manager/common"
 )
 
+// Period, in seconds, in which at most MaxBurst backups are started.
 const BACKUP_TIME_WINDOW = 10
 
-const BUFFER_ETAG = 64
-const BUFFER_BACKUP_PATH = 256
-const BUFFER_BACKUP_FILE_SIZE = 10
-const BUFFER_BACKUP = 1024
+const DEFAULT_STARTUP_RAMP = time.Minute
+const DEFAULT_MAX_BURST = 20
 
+const BACKUP_STORED = "stored"
+const BACKUP_UNCHANGED = "unchanged"
+const BACKUP_FAILED = "failed"
 
 type BackupSchedulerConfig struct {
 	Port 			string
 	Storage 		*common.BackupStorage
+	TLS 			*tls.Config
+	SharedKey 		string
+	StartupRamp 	time.Duration
+	MaxBurst 		int
+	MaxTransfers 	int
+	MaxPerHost 		int
+	RetryBackoff 	time.Duration
+	MaxRetryBackoff time.Duration
+	MaxRetries 		int
+	HeartbeatInterval time.Duration
+	RestoreIdleTimeout time.Duration
+	RestoreTimeout 	time.Duration
 }
 
 type BackupRequest struct {
@@ -31,196 +47,496 @@ type BackupRequest struct {
 	Ip 				string
 	Port 			string
 	Path 			string
+	Force 			bool
+	Manual 			bool
+	Result 			chan BackupResult
+	CorrelationId 	string
+}
+
+type BackupResult struct {
+	Status 			string 						`json:"status"`
+	Size 			int64 						`json:"size"`
+	Error 			string 						`json:"error,omitempty"`
+	CorrelationId 	string 						`json:"correlation_id,omitempty"`
 }
 
 type BackupScheduler struct {
 	port 			string
 	storage 		*common.BackupStorage
-	requests   		chan BackupRequest
+	queue   		*backupQueue
+	tlsConfig 		*tls.Config
+	sharedKey 		string
+	startupRamp 	time.Duration
+	maxBurst 		int
+	backups 		*backupHeap
+	changes 		map[string]bool
+	changesMutex 	sync.Mutex
+	wakeup 			chan struct{}
+	burstStart 		time.Time
+	burstStarted 	int
+	retries 		map[string]*backupRetry
+	retriesMutex 	sync.Mutex
+	retryBackoff 	time.Duration
+	maxRetryBackoff time.Duration
+	maxRetries 		int
+	heartbeatInterval time.Duration
+	restoreIdleTimeout time.Duration
+	restoreTimeout 	time.Duration
+	restores 		map[agentAddress]int
+	restoresMutex 	sync.Mutex
 }
 
+// A zero startup ramp, burst, amount of retries or heartbeat interval disables them.
 func NewBackupScheduler(config BackupSchedulerConfig) *BackupScheduler {
 	backupScheduler := &BackupScheduler {
-		port:		config.Port,
-		storage:	config.Storage,
+		port:			config.Port,
+		storage:		config.Storage,
+		queue:			newBackupQueue(config.MaxTransfers, config.MaxPerHost),
+		tlsConfig:		config.TLS,
+		sharedKey:		config.SharedKey,
+		startupRamp:	config.StartupRamp,
+		maxBurst:		config.MaxBurst,
+		backups:		newBackupHeap(),
+		changes:		make(map[string]bool),
+		wakeup:			make(chan struct{}, 1),
+		retries:		make(map[string]*backupRetry),
+		retryBackoff:	config.RetryBackoff,
+		maxRetryBackoff: config.MaxRetryBackoff,
+		maxRetries:		config.MaxRetries,
+		heartbeatInterval: config.HeartbeatInterval,
+		restoreIdleTimeout: config.RestoreIdleTimeout,
+		restoreTimeout:	config.RestoreTimeout,
+		restores:		make(map[agentAddress]int),
+	}
+
+	backupScheduler.registerMetrics()
+
+	if backupScheduler.retryBackoff <= 0 {
+		backupScheduler.retryBackoff = DEFAULT_RETRY_BACKOFF
+	}
+	if backupScheduler.maxRetryBackoff < backupScheduler.retryBackoff {
+		backupScheduler.maxRetryBackoff = backupScheduler.retryBackoff
+	}
+	if backupScheduler.restoreIdleTimeout <= 0 {
+		backupScheduler.restoreIdleTimeout = DEFAULT_RESTORE_IDLE_TIMEOUT
+	}
+	if backupScheduler.restoreTimeout <= 0 {
+		backupScheduler.restoreTimeout = DEFAULT_RESTORE_TIMEOUT
 	}
 
 	return backupScheduler
 }
 
 func (bkpScheduler *BackupScheduler) updateBackupInformation(backupInfo common.BackupRegister, updatedTime time.Time) common.BackupRegister {
-	freqDuration, _ := time.ParseDuration(backupInfo.Freq)				// Error ignored because it was already checked at registration.
-	backupInfo.Next = updatedTime.Add(freqDuration)
+	next, err := bkpScheduler.storage.NextBackup(backupInfo.Freq, updatedTime)
+	if err != nil {
+		// Registers edited by hand could hold an invalid frequency. Retrying later instead of looping on them.
+		log.Errorf("Invalid frequency '%s' stored for backup client with path %s. Err: '%s'", backupInfo.Freq, backupInfo.Path, err)
+		backupInfo.Next = updatedTime.Add(time.Hour)
+		return backupInfo
+	}
+
+	backupInfo.Next = next
 	return backupInfo
 }
 
-func (bkpScheduler *BackupScheduler) checkBackups() chan BackupRequest {
-	channel := make(chan BackupRequest)
+// Spread the backups that became overdue while the manager was down over the startup ramp, oldest first, instead
+// of starting all of them in the first window.
+func (bkpScheduler *BackupScheduler) staggerOverdueBackups() {
+	if bkpScheduler.startupRamp <= 0 {
+		return
+	}
+
+	backups := bkpScheduler.storage.GetBackupClients()
+	startTime := time.Now()
+
+	overdueBackups := []string{}
+	for _, backupId := range sortByNextBackup(backups) {
+		if backupInfo := backups[backupId]; !backupInfo.Paused && startTime.After(backupInfo.Next) {
+			overdueBackups = append(overdueBackups, backupId)
+		}
+	}
+
+	if len(overdueBackups) == 0 {
+		return
+	}
+
+	updatedBackups := make(map[string]time.Time)
+	for idx, backupId := range overdueBackups {
+		updatedBackups[backupId] = startTime.Add(bkpScheduler.startupRamp * time.Duration(idx) / time.Duration(len(overdueBackups)))
+	}
+
+	bkpScheduler.storage.UpdateBackupSchedules(updatedBackups)
+	log.Infof("Spreading %d overdue backups over the next %s.", len(overdueBackups), bkpScheduler.startupRamp.String())
+}
+
+func sortByNextBackup(backups map[string]common.BackupRegister) []string {
+	backupIds := []string{}
+	for backupId := range backups {
+		backupIds = append(backupIds, backupId)
+	}
+
+	sort.Slice(backupIds, func(idx1, idx2 int) bool {
+		return backups[backupIds[idx1]].Next.Before(backups[backupIds[idx2]].Next)
+	})
+
+	return backupIds
+}
+
+// Load every backup client in the schedule and start waiting for them. From then on, the schedule is only updated
+// when the storage reports a change, so the backups information isn't scanned again.
+func (bkpScheduler *BackupScheduler) checkBackups() {
+	bkpScheduler.storage.OnChange(bkpScheduler.notifyChange)
+	bkpScheduler.staggerOverdueBackups()
+
+	for backupId, backupInfo := range bkpScheduler.storage.GetBackupClients() {
+		bkpScheduler.scheduleBackup(backupId, backupInfo)
+	}
+	log.Infof("Backup schedule loaded with %d backup clients.", bkpScheduler.backups.Len())
 
 	go func() {
 		for {
-			backups := bkpScheduler.storage.GetBackupClients()
+			bkpScheduler.refreshChangedBackups()
+			bkpScheduler.startDueBackups()
+			bkpScheduler.waitForBackups()
+		}
+	}()
+}
+
+// Called by the storage, which is locked, whenever a backup client changes.
+func (bkpScheduler *BackupScheduler) notifyChange(backupId string) {
+	bkpScheduler.changesMutex.Lock()
+	bkpScheduler.changes[backupId] = true
+	bkpScheduler.changesMutex.Unlock()
+
+	select {
+	case bkpScheduler.wakeup <- struct{}{}:
+	default:
+	}
+}
 
-			initialTime := time.Now()
-			log.Debugf("Starting backup window at %s.", initialTime.String())
+// Sleep until the next backup is due or a backup client changes.
+func (bkpScheduler *BackupScheduler) waitForBackups() {
+	nextDue, ok := bkpScheduler.backups.peek()
+	if !ok {
+		<-bkpScheduler.wakeup
+		return
+	}
+
+	if bkpScheduler.burstExhausted() && nextDue.Before(bkpScheduler.burstEnd()) {
+		nextDue = bkpScheduler.burstEnd()
+	}
 
-			var updatedBackups map[string]common.BackupRegister = make(map[string]common.BackupRegister)
+	timer := time.NewTimer(time.Until(nextDue))
+	defer timer.Stop()
 
-			for backupId, backupInfo := range backups {
-				updateTime := time.Now()
+	select {
+	case <-timer.C:
+	case <-bkpScheduler.wakeup:
+	}
+}
 
-				if updateTime.After(backupInfo.Next) {
-					log.Infof("Starting new backup for client %s at %s.", backupId, updateTime.String())
+func (bkpScheduler *BackupScheduler) burstExhausted() bool {
+	return bkpScheduler.maxBurst > 0 && bkpScheduler.burstStarted >= bkpScheduler.maxBurst
+}
 
-					// Sending backupID to request channel
-					channel <- BackupRequest{
-						Id: 			backupId,
-						Ip:				backupInfo.Ip,
-						Port:			backupInfo.Port,
-						Path:			backupInfo.Path,
-					}
+func (bkpScheduler *BackupScheduler) burstEnd() time.Time {
+	return bkpScheduler.burstStart.Add(time.Second * BACKUP_TIME_WINDOW)
+}
 
-					// Update next backup information
-					newBackupInfo := bkpScheduler.updateBackupInformation(backupInfo, updateTime)
-					updatedBackups[backupId] = newBackupInfo
+// Paused clients are only checked when they must be automatically resumed.
+func (bkpScheduler *BackupScheduler) scheduleBackup(backupId string, backupInfo common.BackupRegister) {
+	switch {
+	case !backupInfo.Paused:
+		bkpScheduler.backups.schedule(backupId, backupInfo.Next)
+	case !backupInfo.ResumeAt.IsZero():
+		bkpScheduler.backups.schedule(backupId, backupInfo.ResumeAt)
+	default:
+		bkpScheduler.backups.remove(backupId)
+	}
+}
+
+func (bkpScheduler *BackupScheduler) refreshChangedBackups() {
+	bkpScheduler.changesMutex.Lock()
+	changes := bkpScheduler.changes
+	bkpScheduler.changes = make(map[string]bool)
+	bkpScheduler.changesMutex.Unlock()
+
+	for backupId := range changes {
+		backupInfo, err := bkpScheduler.storage.FindBackupClient(backupId)
+		if err != nil {
+			log.Debugf("Backup client %s removed from schedule.", backupId)
+			bkpScheduler.backups.remove(backupId)
+			continue
+		}
+
+		bkpScheduler.scheduleBackup(backupId, backupInfo)
+	}
+}
+
+func (bkpScheduler *BackupScheduler) startDueBackups() {
+	updateTime := time.Now()
+	if !updateTime.Before(bkpScheduler.burstEnd()) {
+		bkpScheduler.burstStart = updateTime
+		bkpScheduler.burstStarted = 0
+	}
+
+	var updatedBackups map[string]time.Time = make(map[string]time.Time)
+	startedBackups := []BackupRequest{}
+
+	// Oldest backups go first, so the ones left by the burst limit are the most recent.
+	for {
+		nextDue, ok := bkpScheduler.backups.peek()
+		if !ok || nextDue.After(updateTime) {
+			break
+		}
 
-					log.Infof("Next backup for client %s setted at %s.", backupId, newBackupInfo.Next.String())
-				} else {
-					log.Debugf("Not in time for new backup for client %s.", backupId)
-				}
+		if bkpScheduler.burstExhausted() {
+			log.Debugf("Burst limit of %d backups reached. Remaining backups left until %s.", bkpScheduler.maxBurst, bkpScheduler.burstEnd().String())
+			break
+		}
+
+		backupId := bkpScheduler.backups.pop()
+		backupInfo, err := bkpScheduler.storage.FindBackupClient(backupId)
+		if err != nil {
+			continue
+		}
+
+		if backupInfo.Paused {
+			if backupInfo.ResumeAt.IsZero() || updateTime.Before(backupInfo.ResumeAt) {
+				bkpScheduler.scheduleBackup(backupId, backupInfo)
+				continue
+			}
+
+			log.Infof("Auto-resume time reached for client %s.", backupId)
+			if !bkpScheduler.storage.AutoResumeBackupClient(backupId) {
+				continue
 			}
+		}
 
-			bkpScheduler.storage.UpdateBackupClients(updatedBackups)
+		if updateTime.Before(backupInfo.Next) {
+			bkpScheduler.backups.schedule(backupId, backupInfo.Next)
+			continue
+		}
+
+		if deferredTime, deferred := bkpScheduler.storage.DeferBackup(backupInfo, updateTime); deferred {
+			deferredTime = bkpScheduler.storage.ApplyJitter(deferredTime)
+			log.Infof("Backup for client %s deferred until %s by a blackout window.", backupId, deferredTime.String())
+			bkpScheduler.storage.RegisterDeferral(backupId, deferredTime)
+			updatedBackups[backupId] = deferredTime
+			continue
+		}
 
-			endTime := time.Now()
-			log.Debugf("Finishing backup window at %s.", initialTime.String())
+		bkpScheduler.burstStarted++
 
-			// Sleeping to complete the 5 seconds period.
-			sleepTime := endTime.Add(time.Second * BACKUP_TIME_WINDOW).Sub(initialTime)
-			log.Debugf("Setting new backup window at %s.", endTime.Add(time.Second * BACKUP_TIME_WINDOW))
-			time.Sleep(sleepTime)
+		backupRequest := BackupRequest{
+			Id: 			backupId,
+			Ip:				backupInfo.Ip,
+			Port:			backupInfo.Port,
+			Path:			backupInfo.Path,
+			CorrelationId:	utils.NewCorrelationId(),
 		}
-	}()
-	
 
-	return channel
+		backupRequest.logger().Infof("Starting new backup for client %s at %s.", backupId, updateTime.String())
+		startedBackups = append(startedBackups, backupRequest)
+
+		// Update next backup information
+		newBackupInfo := bkpScheduler.updateBackupInformation(backupInfo, updateTime)
+		updatedBackups[backupId] = newBackupInfo.Next
+
+		log.Infof("Next backup for client %s setted at %s.", backupId, newBackupInfo.Next.String())
+	}
+
+	// The storage reports these changes back, placing the backups again in the schedule.
+	bkpScheduler.storage.UpdateBackupSchedules(updatedBackups)
+
+	// Queueing the backups once their next run is stored, so failures can reschedule them, without waiting for a worker.
+	for _, backupRequest := range startedBackups {
+		bkpScheduler.dispatchBackup(backupRequest)
+	}
+}
+
+// Request an immediate backup for a registered client, waiting for its result.
+func (bkpScheduler *BackupScheduler) TriggerBackup(backupId string, backupInfo common.BackupRegister, force bool) BackupResult {
+	result := make(chan BackupResult, 1)
+
+	bkpScheduler.queue.enqueue(BackupRequest{
+		Id: 			backupId,
+		Ip:				backupInfo.Ip,
+		Port:			backupInfo.Port,
+		Path:			backupInfo.Path,
+		Force:			force,
+		Manual:			true,
+		Result:			result,
+		CorrelationId:	utils.NewCorrelationId(),
+	})
+
+	return <-result
+}
+
+// Transfers running and waiting for a worker.
+func (bkpScheduler *BackupScheduler) QueueStatus() common.QueueStatus {
+	return bkpScheduler.queue.status()
 }
 
 func (bkpScheduler *BackupScheduler) handleBackupConnection(backupRequest BackupRequest) {
-	etag := bkpScheduler.storage.GenerateEtag(backupRequest.Id)
-	log.Infof("Requesting new backup to client %s with etag '%s'", backupRequest.Id, etag)
+	backupsStarted.Inc()
+	startTime := time.Now()
+
+	result := bkpScheduler.transferBackup(backupRequest)
+	transferDuration.Observe(time.Since(startTime).Seconds())
+
+	switch result.Status {
+	case BACKUP_STORED:
+		backupsSucceeded.Inc()
+		receivedBytes.Add(float64(result.Size))
+	case BACKUP_UNCHANGED:
+		backupsUnchanged.Inc()
+	case BACKUP_FAILED:
+		backupsFailed.Inc()
+	}
+	result.CorrelationId = backupRequest.CorrelationId
 
-	conn, err := net.Dial("tcp", backupRequest.Ip + ":" + backupRequest.Port)
-	if err != nil {
-		log.Errorf("Couldn't stablish connection with client %s", backupRequest.Ip)
-		bkpScheduler.rescheduleBackup(backupRequest)
-		return
+	// Manual backups don't move the regular schedule.
+	if !backupRequest.Manual {
+		if result.Status == BACKUP_FAILED {
+			bkpScheduler.retryBackup(backupRequest, result.Error)
+		} else {
+			bkpScheduler.clearRetry(backupRequest.Id)
+		}
 	}
-	defer conn.Close()
 
-	// Sending etag
-	etagMessage := utils.FillString(etag, BUFFER_ETAG)
-	
-	conn.Write([]byte(etagMessage))
-	log.Infof("Sending etag '%s' to backup connection ('%s', %s).", etag, backupRequest.Ip, backupRequest.Port)
-	log.Debugf("Sending message '%s' to backup connection ('%s', %s).", string(etagMessage), backupRequest.Ip, backupRequest.Port)
-
-	// Sending path
-	pathMessage := utils.FillString(backupRequest.Path, BUFFER_BACKUP_PATH)
-	
-	conn.Write([]byte(pathMessage))
-	log.Infof("Sending path '%s' to backup connection ('%s', %s).", backupRequest.Path, backupRequest.Ip, backupRequest.Port)
-	log.Debugf("Sending message '%s' to backup connection ('%s', %s).", string(pathMessage), backupRequest.Ip, backupRequest.Port)
-
-	// Receiving backup
-	bufferFileSize := make([]byte, BUFFER_BACKUP_FILE_SIZE)
-	_, err = conn.Read(bufferFileSize)
-	if err != nil {
-		log.Errorf("Error receiving backup size from client %s.", backupRequest.Id)
-		bkpScheduler.rescheduleBackup(backupRequest)
+	if backupRequest.Result != nil {
+		backupRequest.Result <- result
 	}
+}
 
-	log.Debugf("Received backup file size message (%s) from client %s.", string(bufferFileSize), backupRequest.Id)
-	fileSize, err := strconv.ParseInt(utils.UnfillString(bufferFileSize), 10, 64)
-	if err != nil {
-		log.Errorf("Error parsing backup file size from client %s.", backupRequest.Id)
-		bkpScheduler.rescheduleBackup(backupRequest)
-		return
+func failedBackup(message string) BackupResult {
+	return BackupResult {
+		Status:		BACKUP_FAILED,
+		Size:		0,
+		Error:		message,
 	}
-	log.Infof("Received backup file (%d) size from connection ('%s', %s).", fileSize, backupRequest.Ip, backupRequest.Port)
+}
 
-	if fileSize < 0 {
-		log.Infof("There was some errors in the information provided to backup.")
-	} else if fileSize == 0 {
-		log.Infof("Current backup etag matches with current client %s etag, no information is transfered.", backupRequest.Id)
+func (bkpScheduler *BackupScheduler) transferBackup(backupRequest BackupRequest) BackupResult {
+	logger := backupRequest.logger()
+
+	etag := ""
+	if backupRequest.Force {
+		logger.Infof("Ignoring etag for client %s backup.", backupRequest.Id)
 	} else {
-		log.Infof("Starting new backup transfer. File size: %d.", fileSize)
+		etag = bkpScheduler.storage.GenerateEtag(backupRequest.Id)
+	}
+	logger.Infof("Requesting new backup to client %s with etag '%s'", backupRequest.Id, etag)
 
-		newFile := bkpScheduler.storage.AddNewBackup(backupRequest.Id)
-		defer newFile.Close()
+	conn, agentInfo, err := bkpScheduler.connectAgent(backupRequest.Id, backupRequest.Ip, backupRequest.Port, backupRequest.CorrelationId)
+	if err != nil {
+		logger.Errorf("Couldn't stablish connection with client %s. Err: '%s'", backupRequest.Ip, err)
+		return failedBackup(connectionErrorMessage(err))
+	}
+	defer conn.Close()
 
-		var receivedBytes int64
-		
-		for {
-			idx := int(math.Ceil(float64(receivedBytes) / float64(BUFFER_BACKUP))) + 1
-			log.Debugf("Start receiving chunk #%d.", idx)
-
-			if (fileSize - receivedBytes) < BUFFER_BACKUP {
-				log.Debugf("Receiving EOF in chunk #%d.", idx)
-				io.CopyN(newFile, conn, (fileSize - receivedBytes))
-
-				_, err = conn.Read(make([]byte, (receivedBytes+BUFFER_BACKUP)-fileSize))
-				if err == io.EOF {
-					log.Debugf("Finish receiving chunk #%d.", idx)
-					io.CopyN(newFile, conn, BUFFER_BACKUP)
-					log.Infof("Backup connection ('%s', %s) closed.", backupRequest.Ip, backupRequest.Port)
-					break
-				} else if err != nil {
-					log.Errorf("Error receiving chunk %d from client %s.", idx, backupRequest.Id, err)
-					bkpScheduler.rescheduleBackup(backupRequest)
-					return
-				}
-			}
+	if !agentInfo.Capabilities.SupportsCompression(utils.COMPRESSION_GZIP) {
+		logger.Errorf("Backup client %s (version %s) doesn't support %s compression. Backup refused.", backupRequest.Id, agentInfo.Version, utils.COMPRESSION_GZIP)
+		return failedBackup("the backup client doesn't support gzip compression")
+	}
 
-			io.CopyN(newFile, conn, BUFFER_BACKUP)
-			log.Debugf("Finish receiving chunk #%d.", idx)
-			receivedBytes += BUFFER_BACKUP
-		}
+	// Sending backup request
+	backupRequestMessage := utils.BackupRequestMessage {
+		Etag:		etag,
+		Path:		backupRequest.Path,
+		CorrelationId:	backupRequest.CorrelationId,
+	}
 
-		fileInfo, err := newFile.Stat()
-		if err != nil {
-			log.Errorf("Error getting backup stats for ID %s.", backupRequest.Id, err)
-			bkpScheduler.storage.UpdateBackupLog(backupRequest.Id, -1)
-		} else {
-			bkpScheduler.storage.UpdateBackupLog(backupRequest.Id, fileInfo.Size())
+	if err = utils.WriteMessage(conn, utils.MESSAGE_BACKUP_REQUEST, backupRequestMessage); err != nil {
+		logger.Errorf("Error sending backup request to connection ('%s', %s). Err: '%s'", backupRequest.Ip, backupRequest.Port, err)
+		return failedBackup("error sending backup request")
+	}
+	logger.Infof("Sending etag '%s' and path '%s' to backup connection ('%s', %s).", etag, backupRequest.Path, backupRequest.Ip, backupRequest.Port)
+
+	// Receiving backup response
+	var backupResponse utils.BackupResponseMessage
+	if err = utils.ReadMessage(conn, utils.MESSAGE_BACKUP_RESPONSE, &backupResponse); err != nil {
+		logger.Errorf("Error receiving backup response from client %s. Err: '%s'", backupRequest.Id, err)
+		switch errors.Cause(err) {
+		case utils.ErrVersionMismatch:
+			return failedBackup("the backup client speaks a different protocol version")
+		case utils.ErrUnauthorized:
+			return failedBackup("the backup client refused the manager credentials")
 		}
-		
-		log.Infof("Backup file received from connection ('%s', %s).", backupRequest.Ip, backupRequest.Port)
+		return failedBackup("error receiving backup response")
+	}
+	logger.Debugf("Received backup response with status %s from client %s.", backupResponse.Status, backupRequest.Id)
+
+	switch backupResponse.Status {
+	case utils.PROTOCOL_STATUS_UNCHANGED:
+		logger.Infof("Current backup etag matches with current client %s etag, no information is transfered.", backupRequest.Id)
+		return BackupResult{ Status: BACKUP_UNCHANGED }
+	case utils.PROTOCOL_STATUS_OK:
+		logger.Infof("Starting new backup transfer from client %s.", backupRequest.Id)
+	case utils.PROTOCOL_STATUS_FORBIDDEN_PATH:
+		logger.Errorf("Backup client %s forbids backing up path '%s'. Message: '%s'", backupRequest.Id, backupRequest.Path, backupResponse.Message)
+		return failedBackup("the backup client forbids the requested path")
+	default:
+		logger.Infof("There was some errors in the information provided to backup. Message: '%s'", backupResponse.Message)
+		return failedBackup("the backup client couldn't generate the backup")
 	}
-	
+
+	newFile := bkpScheduler.storage.AddNewBackup(backupRequest.Id)
+	if newFile == nil {
+		return failedBackup("error storing the backup file")
+	}
+	defer newFile.Close()
+
+	fileSize, err := utils.ReadFile(conn, newFile)
+	if err != nil {
+		logger.Errorf("Error receiving backup file from client %s. Err: '%s'", backupRequest.Id, err)
+		os.Remove(newFile.Name())						// Incomplete backups must not be restored.
+		return failedBackup("error receiving backup file")
+	}
+
+	bkpScheduler.storage.UpdateBackupLog(backupRequest.Id, fileSize)
+	logger.Infof("Backup file (size %d) received from connection ('%s', %s).", fileSize, backupRequest.Ip, backupRequest.Port)
+	return BackupResult{ Status: BACKUP_STORED, Size: fileSize }
 }
 
 func (bkpScheduler *BackupScheduler) rescheduleBackup(backupRequest BackupRequest) {
-	log.Infof("Reseting backup for client %s for next iteration.", backupRequest.Id)
-	backups := bkpScheduler.storage.GetBackupClients()
+	backupRequest.logger().Infof("Reseting backup for client %s for next iteration.", backupRequest.Id)
+	backupInfo, err := bkpScheduler.storage.FindBackupClient(backupRequest.Id)
+	if err != nil {
+		backupRequest.logger().Infof("Backup client %s was unregistered while its backup was running.", backupRequest.Id)
+		return
+	}
 
-	var updatedBackups map[string]common.BackupRegister = make(map[string]common.BackupRegister)
-	updatedBackups[backupRequest.Id] = bkpScheduler.updateBackupInformation(backups[backupRequest.Id], time.Now())
+	var updatedBackups map[string]time.Time = make(map[string]time.Time)
+	updatedBackups[backupRequest.Id] = bkpScheduler.updateBackupInformation(backupInfo, time.Now()).Next
 
-	bkpScheduler.storage.UpdateBackupClients(updatedBackups)
+	bkpScheduler.storage.UpdateBackupSchedules(updatedBackups)
 }
 
 func (bkpScheduler *BackupScheduler) Run() {
 	listener, err := net.Listen("tcp", ":" + bkpScheduler.port)
 	if listener == nil || err != nil {
-		log.Fatalf("Error creating TCP BackupScheduler socket at port %s.", bkpScheduler.port, err)
+		log.Fatalf("Error creating TCP BackupScheduler socket at port %s. Err: '%s'", bkpScheduler.port, err)
 	}
 
+	// Start the transfer workers.
+	bkpScheduler.queue.start(bkpScheduler.handleBackupConnection)
+	log.Infof("Backup workers started. Max transfers: %d; per host: %d.", bkpScheduler.queue.maxTransfers, bkpScheduler.queue.maxPerHost)
+
 	// Start checking for new possible backups.
-	bkpScheduler.requests = bkpScheduler.checkBackups()
+	bkpScheduler.checkBackups()
 
-	// Start parallel backup request.
-	for {
-		go bkpScheduler.handleBackupConnection(<-bkpScheduler.requests)
+	if bkpScheduler.heartbeatInterval > 0 {
+		go bkpScheduler.runHeartbeats()
+		log.Infof("Sending heartbeats to backup client nodes every %s.", bkpScheduler.heartbeatInterval.String())
 	}
+
+	select {}
+}
+
+// Logger tagging every line with the backup attempt correlation ID.
+func (backupRequest BackupRequest) logger() *log.Entry {
+	return utils.CorrelationLogger(backupRequest.CorrelationId)
 }
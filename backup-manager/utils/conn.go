@@ -0,0 +1,27 @@
+package utils
+
+import (
+	"net"
+	"time"
+)
+
+// Connection failing reads and writes after being idle for the timeout, instead of bounding the whole exchange, so
+// long transfers are allowed while they keep moving.
+type IdleConn struct {
+	net.Conn
+	timeout 		time.Duration
+}
+
+func NewIdleConn(conn net.Conn, timeout time.Duration) *IdleConn {
+	return &IdleConn{ Conn: conn, timeout: timeout }
+}
+
+func (conn *IdleConn) Read(buffer []byte) (int, error) {
+	conn.Conn.SetReadDeadline(time.Now().Add(conn.timeout))
+	return conn.Conn.Read(buffer)
+}
+
+func (conn *IdleConn) Write(buffer []byte) (int, error) {
+	conn.Conn.SetWriteDeadline(time.Now().Add(conn.timeout))
+	return conn.Conn.Write(buffer)
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"os"
+	"strings"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+const LOG_FORMAT_TEXT = "text"
+const LOG_FORMAT_JSON = "json"
+
+const LOG_OUTPUT_STDOUT = "stdout"
+const LOG_OUTPUT_STDERR = "stderr"
+
+const DEFAULT_LOG_LEVEL = "info"
+
+// Field attached to every log line of a backup or restore, on both the manager and the agent.
+const CORRELATION_FIELD = "correlation_id"
+
+type LoggingConfig struct {
+	Level 			string
+	Format 			string
+	Output 			string
+}
+
+// Configure the standard logger. Empty values keep the defaults: info level, text format and standard error. Any
+// output other than stdout or stderr is taken as a file path, where logs are appended.
+func ConfigureLogging(config LoggingConfig) error {
+	levelName := config.Level
+	if levelName == "" {
+		levelName = DEFAULT_LOG_LEVEL
+	}
+
+	level, err := log.ParseLevel(levelName)
+	if err != nil {
+		return errors.Wrapf(err, "invalid log level '%s'", config.Level)
+	}
+
+	switch strings.ToLower(config.Format) {
+	case "", LOG_FORMAT_TEXT:
+		log.SetFormatter(&log.TextFormatter{})
+	case LOG_FORMAT_JSON:
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return errors.Errorf("invalid log format '%s' (expected %s or %s)", config.Format, LOG_FORMAT_TEXT, LOG_FORMAT_JSON)
+	}
+
+	switch config.Output {
+	case "", LOG_OUTPUT_STDERR:
+		log.SetOutput(os.Stderr)
+	case LOG_OUTPUT_STDOUT:
+		log.SetOutput(os.Stdout)
+	default:
+		file, err := os.OpenFile(config.Output, os.O_CREATE | os.O_WRONLY | os.O_APPEND, 0644)
+		if err != nil {
+			return errors.Wrapf(err, "couldn't open log file '%s'", config.Output)
+		}
+		log.SetOutput(file)
+	}
+
+	log.SetLevel(level)
+	return nil
+}
+
+// Random identifier for a backup or restore attempt, sent to the agent so both sides log it.
+func NewCorrelationId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		log.Warnf("Couldn't generate a correlation ID. Err: '%s'", err)
+		return ""
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// Logger tagging every line with the given correlation ID. Requests without one, as the ones from legacy peers,
+// log as usual.
+func CorrelationLogger(correlationId string) *log.Entry {
+	if correlationId == "" {
+		return log.NewEntry(log.StandardLogger())
+	}
+
+	return log.WithField(CORRELATION_FIELD, correlationId)
+}
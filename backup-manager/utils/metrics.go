@@ -0,0 +1,260 @@
+package utils
+
+import (
+	"io"
+	"fmt"
+	"sort"
+	"sync"
+	"strconv"
+	"strings"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const METRICS_PATH = "/metrics"
+
+// Metrics exposed in the Prometheus text format. Metrics are created in the default registry, usually as package
+// variables, and served by ServeMetrics.
+var DefaultRegistry = NewRegistry()
+
+type metric interface {
+	write(writer io.Writer, name string)
+}
+
+type Registry struct {
+	metrics 		map[string]registeredMetric
+	mutex 			sync.Mutex
+}
+
+type registeredMetric struct {
+	help 			string
+	kind 			string
+	metric 			metric
+}
+
+// Value only going up, as the amount of requests served.
+type Counter struct {
+	value 			float64
+	mutex 			sync.Mutex
+}
+
+// Counters split by the value of a label.
+type CounterVec struct {
+	label 			string
+	counters 		map[string]*Counter
+	mutex 			sync.Mutex
+}
+
+// Value going up and down, as the amount of queued requests.
+type Gauge struct {
+	value 			float64
+	mutex 			sync.Mutex
+}
+
+// Gauge whose value is computed when the metrics are collected.
+type GaugeFunc struct {
+	collect 		func() float64
+}
+
+// Observations counted in cumulative buckets, as request durations.
+type Histogram struct {
+	buckets 		[]float64
+	counts 			[]uint64
+	count 			uint64
+	sum 			float64
+	mutex 			sync.Mutex
+}
+
+func NewRegistry() *Registry {
+	return &Registry {
+		metrics:		make(map[string]registeredMetric),
+	}
+}
+
+func (registry *Registry) register(name string, help string, kind string, metric metric) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if _, ok := registry.metrics[name]; ok {
+		log.Warnf("Metric %s registered twice. Keeping the last one.", name)
+	}
+
+	registry.metrics[name] = registeredMetric{ help: help, kind: kind, metric: metric }
+}
+
+func NewCounter(name string, help string) *Counter {
+	counter := &Counter{}
+	DefaultRegistry.register(name, help, "counter", counter)
+	return counter
+}
+
+func NewCounterVec(name string, help string, label string) *CounterVec {
+	counterVec := &CounterVec{ label: label, counters: make(map[string]*Counter) }
+	DefaultRegistry.register(name, help, "counter", counterVec)
+	return counterVec
+}
+
+func NewGauge(name string, help string) *Gauge {
+	gauge := &Gauge{}
+	DefaultRegistry.register(name, help, "gauge", gauge)
+	return gauge
+}
+
+func NewGaugeFunc(name string, help string, collect func() float64) *GaugeFunc {
+	gaugeFunc := &GaugeFunc{ collect: collect }
+	DefaultRegistry.register(name, help, "gauge", gaugeFunc)
+	return gaugeFunc
+}
+
+// Buckets are the upper bounds of each one, in increasing order. The '+Inf' bucket is added automatically.
+func NewHistogram(name string, help string, buckets []float64) *Histogram {
+	histogram := &Histogram{ buckets: buckets, counts: make([]uint64, len(buckets)) }
+	DefaultRegistry.register(name, help, "histogram", histogram)
+	return histogram
+}
+
+// Buckets starting at the given bound, each one the given factor times the previous.
+func ExponentialBuckets(start float64, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for idx := range buckets {
+		buckets[idx] = start
+		start *= factor
+	}
+
+	return buckets
+}
+
+func (counter *Counter) Inc() {
+	counter.Add(1)
+}
+
+func (counter *Counter) Add(value float64) {
+	counter.mutex.Lock()
+	counter.value += value
+	counter.mutex.Unlock()
+}
+
+func (counter *Counter) write(writer io.Writer, name string) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	fmt.Fprintf(writer, "%s %s\n", name, formatValue(counter.value))
+}
+
+func (counterVec *CounterVec) With(value string) *Counter {
+	counterVec.mutex.Lock()
+	defer counterVec.mutex.Unlock()
+
+	counter, ok := counterVec.counters[value]
+	if !ok {
+		counter = &Counter{}
+		counterVec.counters[value] = counter
+	}
+
+	return counter
+}
+
+func (counterVec *CounterVec) write(writer io.Writer, name string) {
+	counterVec.mutex.Lock()
+	defer counterVec.mutex.Unlock()
+
+	values := []string{}
+	for value := range counterVec.counters {
+		values = append(values, value)
+	}
+	sort.Strings(values)
+
+	for _, value := range values {
+		counterVec.counters[value].write(writer, fmt.Sprintf("%s{%s=\"%s\"}", name, counterVec.label, escapeLabel(value)))
+	}
+}
+
+func (gauge *Gauge) Set(value float64) {
+	gauge.mutex.Lock()
+	gauge.value = value
+	gauge.mutex.Unlock()
+}
+
+func (gauge *Gauge) Add(value float64) {
+	gauge.mutex.Lock()
+	gauge.value += value
+	gauge.mutex.Unlock()
+}
+
+func (gauge *Gauge) write(writer io.Writer, name string) {
+	gauge.mutex.Lock()
+	defer gauge.mutex.Unlock()
+	fmt.Fprintf(writer, "%s %s\n", name, formatValue(gauge.value))
+}
+
+func (gaugeFunc *GaugeFunc) write(writer io.Writer, name string) {
+	fmt.Fprintf(writer, "%s %s\n", name, formatValue(gaugeFunc.collect()))
+}
+
+func (histogram *Histogram) Observe(value float64) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	for idx, bound := range histogram.buckets {
+		if value <= bound {
+			histogram.counts[idx]++
+		}
+	}
+
+	histogram.count++
+	histogram.sum += value
+}
+
+func (histogram *Histogram) write(writer io.Writer, name string) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+
+	for idx, bound := range histogram.buckets {
+		fmt.Fprintf(writer, "%s_bucket{le=\"%s\"} %d\n", name, formatValue(bound), histogram.counts[idx])
+	}
+
+	fmt.Fprintf(writer, "%s_bucket{le=\"+Inf\"} %d\n", name, histogram.count)
+	fmt.Fprintf(writer, "%s_sum %s\n", name, formatValue(histogram.sum))
+	fmt.Fprintf(writer, "%s_count %d\n", name, histogram.count)
+}
+
+// Write every metric in the Prometheus text format, sorted by name.
+func (registry *Registry) WriteMetrics(writer io.Writer) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	names := []string{}
+	for name := range registry.metrics {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		registered := registry.metrics[name]
+		fmt.Fprintf(writer, "# HELP %s %s\n", name, registered.help)
+		fmt.Fprintf(writer, "# TYPE %s %s\n", name, registered.kind)
+		registered.metric.write(writer, name)
+	}
+}
+
+// Serve the default registry metrics over HTTP in the given port.
+func ServeMetrics(port string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc(METRICS_PATH, func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		DefaultRegistry.WriteMetrics(writer)
+	})
+
+	log.Infof("Serving metrics at port %s (path %s).", port, METRICS_PATH)
+	if err := http.ListenAndServe(":" + port, mux); err != nil {
+		log.Fatalf("Error serving metrics at port %s. Err: '%s'", port, err)
+	}
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\n", "\\n").Replace(value)
+}
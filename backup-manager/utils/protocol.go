@@ -0,0 +1,271 @@
+package utils
+
+import (
+	"io"
+	"time"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+// Protocol shared by the backup scheduler and the backup clients. Every message is a frame with a header holding
+// the protocol version (1 byte), the message type (1 byte) and the payload length (8 bytes, big endian). Control
+// messages carry a JSON payload, while file frames are followed by the raw file bytes.
+const PROTOCOL_VERSION byte = 1
+const MIN_PROTOCOL_VERSION byte = 1
+const FRAME_HEADER_SIZE = 10
+const MAX_MESSAGE_SIZE = 1 << 20
+
+const MESSAGE_ERROR byte = 0
+const MESSAGE_BACKUP_REQUEST byte = 1
+const MESSAGE_BACKUP_RESPONSE byte = 2
+const MESSAGE_RESTORE_REQUEST byte = 3
+const MESSAGE_RESTORE_RESPONSE byte = 4
+const MESSAGE_FILE byte = 5
+const MESSAGE_HELLO byte = 6
+const MESSAGE_HELLO_RESPONSE byte = 7
+const MESSAGE_AUTH byte = 8
+const MESSAGE_AUTH_RESPONSE byte = 9
+const MESSAGE_PING byte = 10
+const MESSAGE_PONG byte = 11
+
+const PROTOCOL_STATUS_OK = "OK"
+const PROTOCOL_STATUS_UNCHANGED = "UNCHANGED"
+const PROTOCOL_STATUS_ERROR = "ERROR"
+const PROTOCOL_STATUS_VERSION_MISMATCH = "VERSION_MISMATCH"
+const PROTOCOL_STATUS_UNEXPECTED_MESSAGE = "UNEXPECTED_MESSAGE"
+const PROTOCOL_STATUS_UNAUTHORIZED = "UNAUTHORIZED"
+const PROTOCOL_STATUS_FORBIDDEN_PATH = "FORBIDDEN_PATH"
+
+const COMPRESSION_GZIP = "gzip"
+
+var ErrVersionMismatch = errors.New("protocol version mismatch")
+var ErrUnexpectedMessage = errors.New("unexpected protocol message")
+var ErrMessageTooLarge = errors.New("protocol message too large")
+var ErrUnauthorized = errors.New("peer not authorized")
+
+type FrameHeader struct {
+	Version 		byte
+	Type 			byte
+	Length 			uint64
+}
+
+type ErrorMessage struct {
+	Status 			string 						`json:"status"`
+	Message 		string 						`json:"message"`
+}
+
+// Features supported by each side, exchanged in the opening handshake.
+type Capabilities struct {
+	Compression 	[]string 					`json:"compression" yaml:"compression"`
+	Incremental 	bool 						`json:"incremental" yaml:"incremental"`
+	Restore 		bool 						`json:"restore" yaml:"restore"`
+}
+
+type HelloMessage struct {
+	ProtocolVersion byte 						`json:"protocol_version"`
+	Version 		string 						`json:"version"`
+	Capabilities 	Capabilities 				`json:"capabilities"`
+	CorrelationId 	string 						`json:"correlation_id,omitempty"`
+}
+
+type HelloResponseMessage struct {
+	HelloMessage
+	Accepted 		bool 						`json:"accepted"`
+	Reason 			string 						`json:"reason,omitempty"`
+	Challenge 		string 						`json:"challenge,omitempty"`
+}
+
+// Answer to the agent challenge, proving the scheduler knows the shared key.
+type AuthMessage struct {
+	Signature 		string 						`json:"signature"`
+}
+
+type AuthResponseMessage struct {
+	Accepted 		bool 						`json:"accepted"`
+}
+
+// Liveness check, answered by the agent without any handshake.
+type PingMessage struct {
+	SentAt 			time.Time 					`json:"sent_at"`
+}
+
+type PongMessage struct {
+	SentAt 			time.Time 					`json:"sent_at"`
+	Version 		string 						`json:"version"`
+}
+
+type BackupRequestMessage struct {
+	Etag 			string 						`json:"etag"`
+	Path 			string 						`json:"path"`
+	CorrelationId 	string 						`json:"correlation_id,omitempty"`
+}
+
+type BackupResponseMessage struct {
+	Status 			string 						`json:"status"`
+	Message 		string 						`json:"message,omitempty"`
+}
+
+type RestoreRequestMessage struct {
+	Path 			string 						`json:"path"`
+	Target 			string 						`json:"target"`
+	CorrelationId 	string 						`json:"correlation_id,omitempty"`
+}
+
+type RestoreResponseMessage struct {
+	Status 			string 						`json:"status"`
+}
+
+// Write a frame header.
+func WriteFrameHeader(writer io.Writer, messageType byte, length uint64) error {
+	header := make([]byte, FRAME_HEADER_SIZE)
+	header[0] = PROTOCOL_VERSION
+	header[1] = messageType
+	binary.BigEndian.PutUint64(header[2:], length)
+
+	_, err := writer.Write(header)
+	return err
+}
+
+// Read a frame header, checking the sender speaks the same protocol version.
+func ReadFrameHeader(reader io.Reader) (FrameHeader, error) {
+	header := make([]byte, FRAME_HEADER_SIZE)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return FrameHeader{}, err
+	}
+
+	frameHeader := FrameHeader {
+		Version:	header[0],
+		Type:		header[1],
+		Length:		binary.BigEndian.Uint64(header[2:]),
+	}
+
+	if frameHeader.Version != PROTOCOL_VERSION {
+		return frameHeader, errors.Wrapf(ErrVersionMismatch, "received version %d, expected %d", frameHeader.Version, PROTOCOL_VERSION)
+	}
+
+	return frameHeader, nil
+}
+
+// Write a control message as a JSON frame.
+func WriteMessage(writer io.Writer, messageType byte, message interface{}) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	if err = WriteFrameHeader(writer, messageType, uint64(len(payload))); err != nil {
+		return err
+	}
+
+	_, err = writer.Write(payload)
+	return err
+}
+
+// Read a whole control frame, returning its header and payload.
+func ReadFrame(reader io.Reader) (FrameHeader, []byte, error) {
+	frameHeader, err := ReadFrameHeader(reader)
+	if err != nil {
+		return frameHeader, nil, err
+	}
+
+	if frameHeader.Length > MAX_MESSAGE_SIZE {
+		return frameHeader, nil, errors.Wrapf(ErrMessageTooLarge, "received %d bytes, limit is %d", frameHeader.Length, MAX_MESSAGE_SIZE)
+	}
+
+	payload := make([]byte, frameHeader.Length)
+	if _, err = io.ReadFull(reader, payload); err != nil {
+		return frameHeader, nil, err
+	}
+
+	return frameHeader, payload, nil
+}
+
+// Read a control message of the expected type. Error frames sent by the peer are returned as errors.
+func ReadMessage(reader io.Reader, messageType byte, message interface{}) error {
+	frameHeader, payload, err := ReadFrame(reader)
+	if err != nil {
+		return err
+	}
+
+	if frameHeader.Type == MESSAGE_ERROR && messageType != MESSAGE_ERROR {
+		var errorMessage ErrorMessage
+		json.Unmarshal(payload, &errorMessage)
+		switch errorMessage.Status {
+		case PROTOCOL_STATUS_VERSION_MISMATCH:
+			return errors.Wrap(ErrVersionMismatch, errorMessage.Message)
+		case PROTOCOL_STATUS_UNEXPECTED_MESSAGE:
+			return errors.Wrap(ErrUnexpectedMessage, errorMessage.Message)
+		case PROTOCOL_STATUS_UNAUTHORIZED:
+			return errors.Wrap(ErrUnauthorized, errorMessage.Message)
+		}
+		return errors.Errorf("peer error %s: %s", errorMessage.Status, errorMessage.Message)
+	}
+
+	if frameHeader.Type != messageType {
+		return errors.Wrapf(ErrUnexpectedMessage, "received type %d, expected %d", frameHeader.Type, messageType)
+	}
+
+	return json.Unmarshal(payload, message)
+}
+
+// Write a file frame, streaming its content after the header.
+func WriteFile(writer io.Writer, file io.Reader, size int64) error {
+	if err := WriteFrameHeader(writer, MESSAGE_FILE, uint64(size)); err != nil {
+		return err
+	}
+
+	_, err := io.CopyN(writer, file, size)
+	return err
+}
+
+// Read a file frame, streaming its content into the given writer. Returns the amount of bytes received.
+func ReadFile(reader io.Reader, file io.Writer) (int64, error) {
+	frameHeader, err := ReadFrameHeader(reader)
+	if err != nil {
+		return 0, err
+	}
+
+	if frameHeader.Type != MESSAGE_FILE {
+		return 0, errors.Wrapf(ErrUnexpectedMessage, "received type %d, expected %d", frameHeader.Type, MESSAGE_FILE)
+	}
+
+	return io.CopyN(file, reader, int64(frameHeader.Length))
+}
+
+// Answer a frame that couldn't be processed, letting the peer know why.
+func WriteError(writer io.Writer, err error) error {
+	status := PROTOCOL_STATUS_ERROR
+	switch errors.Cause(err) {
+	case ErrVersionMismatch:
+		status = PROTOCOL_STATUS_VERSION_MISMATCH
+	case ErrUnexpectedMessage:
+		status = PROTOCOL_STATUS_UNEXPECTED_MESSAGE
+	case ErrUnauthorized:
+		status = PROTOCOL_STATUS_UNAUTHORIZED
+	}
+
+	return WriteMessage(writer, MESSAGE_ERROR, ErrorMessage{ Status: status, Message: err.Error() })
+}
+
+// Check if a compression algorithm is supported.
+func (capabilities Capabilities) SupportsCompression(algorithm string) bool {
+	for _, supported := range capabilities.Compression {
+		if supported == algorithm {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sign an agent challenge with the shared key (HMAC-SHA256).
+func SignChallenge(sharedKey string, challenge string) string {
+	mac := hmac.New(sha256.New, []byte(sharedKey))
+	mac.Write([]byte(challenge))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,139 @@
+package utils
+
+import (
+	"net"
+	"time"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+)
+
+// Certificate paths for TLS connections. Mutual TLS is enabled when a CA is given, verifying the peer certificates
+// against it.
+type TLSFiles struct {
+	CertFile 		string
+	KeyFile 		string
+	CAFile 			string
+}
+
+// TLS configuration for listeners. Returns nil when no certificate was configured.
+func NewServerTLSConfig(files TLSFiles) (*tls.Config, error) {
+	if files.CertFile == "" && files.KeyFile == "" {
+		if files.CAFile != "" {
+			return nil, errors.New("TLS CA configured without certificate and key")
+		}
+		return nil, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't load TLS certificate %s", files.CertFile)
+	}
+
+	tlsConfig := &tls.Config {
+		Certificates:	[]tls.Certificate{ certificate },
+		MinVersion:		tls.VersionTLS12,
+	}
+
+	if files.CAFile != "" {
+		certPool, err := loadCertPool(files.CAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.ClientCAs = certPool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+// TLS configuration for dialers. The CA verifies the server certificate (system roots are used if missing), while
+// the certificate and key are presented to servers requiring mutual TLS.
+func NewClientTLSConfig(files TLSFiles) (*tls.Config, error) {
+	tlsConfig := &tls.Config {
+		MinVersion:		tls.VersionTLS12,
+	}
+
+	if files.CertFile != "" || files.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "couldn't load TLS certificate %s", files.CertFile)
+		}
+		tlsConfig.Certificates = []tls.Certificate{ certificate }
+	}
+
+	if files.CAFile != "" {
+		certPool, err := loadCertPool(files.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = certPool
+	}
+
+	return tlsConfig, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	caContent, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "couldn't read TLS CA %s", caFile)
+	}
+
+	certPool := x509.NewCertPool()
+	if !certPool.AppendCertsFromPEM(caContent) {
+		return nil, errors.Errorf("no certificates found in TLS CA %s", caFile)
+	}
+
+	return certPool, nil
+}
+
+// Listen in the given port, with TLS if configured.
+func Listen(port string, tlsConfig *tls.Config) (net.Listener, error) {
+	if tlsConfig == nil {
+		return net.Listen("tcp", ":" + port)
+	}
+
+	return tls.Listen("tcp", ":" + port, tlsConfig)
+}
+
+// Dial the given address, with TLS if configured. The handshake is completed before returning.
+func Dial(address string, tlsConfig *tls.Config) (net.Conn, error) {
+	if tlsConfig == nil {
+		return net.Dial("tcp", address)
+	}
+
+	return tls.Dial("tcp", address, tlsConfig)
+}
+
+// Dial the given address as Dial does, giving up after the timeout.
+func DialTimeout(address string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{ Timeout: timeout }
+	if tlsConfig == nil {
+		return dialer.Dial("tcp", address)
+	}
+
+	return tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+}
+
+// Identity of the peer of a connection, taken from its verified TLS certificate. Completes the handshake if needed.
+// Returns an empty string for plain connections or peers without certificate.
+func PeerName(conn net.Conn) (string, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
+
+	if err := tlsConn.Handshake(); err != nil {
+		return "", err
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", nil
+	}
+
+	return state.VerifiedChains[0][0].Subject.CommonName, nil
+}
@@ -0,0 +1,393 @@
+package utils
+
+import (
+	"os"
+	"net"
+	"time"
+	"bufio"
+	"testing"
+	"strconv"
+	"math/big"
+	"io/ioutil"
+	"crypto/tls"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/ecdsa"
+	"encoding/pem"
+	"path/filepath"
+	"crypto/elliptic"
+	"crypto/x509/pkix"
+)
+
+const testTimeout = 5 * time.Second
+
+type testAuthority struct {
+	cert 			*x509.Certificate
+	key 			*ecdsa.PrivateKey
+	certFile 		string
+}
+
+func newTestDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "tls-test")
+	if err != nil {
+		t.Fatalf("creating temporary directory: %s", err)
+	}
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func writePEM(t *testing.T, path string, blockType string, content []byte) {
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{ Type: blockType, Bytes: content }), 0600); err != nil {
+		t.Fatalf("writing %s: %s", path, err)
+	}
+}
+
+func newTestKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+
+	return key
+}
+
+func newTestAuthority(t *testing.T, dir string, name string) testAuthority {
+	key := newTestKey(t)
+	template := &x509.Certificate {
+		SerialNumber:			big.NewInt(1),
+		Subject:				pkix.Name{ CommonName: name },
+		NotBefore:				time.Now().Add(-time.Hour),
+		NotAfter:				time.Now().Add(time.Hour),
+		KeyUsage:				x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid:	true,
+		IsCA:					true,
+	}
+
+	content, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("creating CA %s: %s", name, err)
+	}
+
+	cert, err := x509.ParseCertificate(content)
+	if err != nil {
+		t.Fatalf("parsing CA %s: %s", name, err)
+	}
+
+	certFile := filepath.Join(dir, name + "-ca.pem")
+	writePEM(t, certFile, "CERTIFICATE", content)
+
+	return testAuthority{ cert: cert, key: key, certFile: certFile }
+}
+
+// Issue a certificate signed by the authority, returning the files of its certificate and key.
+func (authority testAuthority) issue(t *testing.T, dir string, name string, usage x509.ExtKeyUsage) TLSFiles {
+	key := newTestKey(t)
+	template := &x509.Certificate {
+		SerialNumber:	big.NewInt(time.Now().UnixNano()),
+		Subject:		pkix.Name{ CommonName: name },
+		NotBefore:		time.Now().Add(-time.Hour),
+		NotAfter:		time.Now().Add(time.Hour),
+		KeyUsage:		x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:	[]x509.ExtKeyUsage{ usage },
+		IPAddresses:	[]net.IP{ net.ParseIP("127.0.0.1") },
+		DNSNames:		[]string{ "localhost" },
+	}
+
+	content, err := x509.CreateCertificate(rand.Reader, template, authority.cert, &key.PublicKey, authority.key)
+	if err != nil {
+		t.Fatalf("creating certificate %s: %s", name, err)
+	}
+
+	keyContent, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("encoding key %s: %s", name, err)
+	}
+
+	files := TLSFiles {
+		CertFile:	filepath.Join(dir, name + ".pem"),
+		KeyFile:	filepath.Join(dir, name + "-key.pem"),
+	}
+	writePEM(t, files.CertFile, "CERTIFICATE", content)
+	writePEM(t, files.KeyFile, "EC PRIVATE KEY", keyContent)
+
+	return files
+}
+
+type testPeer struct {
+	name 			string
+	message 		string
+	err 			error
+}
+
+// Accept a single connection, reading its peer name and first line.
+func acceptTestPeer(listener net.Listener) chan testPeer {
+	result := make(chan testPeer, 1)
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			result <- testPeer{ err: err }
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(testTimeout))
+
+		name, err := PeerName(conn)
+		if err != nil {
+			result <- testPeer{ err: err }
+			return
+		}
+
+		message, err := bufio.NewReader(conn).ReadString('\n')
+		if err == nil {
+			_, err = conn.Write([]byte(message))
+		}
+		result <- testPeer{ name: name, message: message, err: err }
+	}()
+
+	return result
+}
+
+func listenTestServer(t *testing.T, tlsConfig *tls.Config) (net.Listener, string) {
+	listener, err := Listen("0", tlsConfig)
+	if err != nil {
+		t.Fatalf("listening: %s", err)
+	}
+
+	return listener, net.JoinHostPort("127.0.0.1", strconv.Itoa(listener.Addr().(*net.TCPAddr).Port))
+}
+
+func waitTestPeer(t *testing.T, result chan testPeer) testPeer {
+	select {
+	case peer := <-result:
+		return peer
+	case <-time.After(testTimeout):
+		t.Fatalf("server didn't handle the connection")
+		return testPeer{}
+	}
+}
+
+func TestNewServerTLSConfig(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	authority := newTestAuthority(t, dir, "test")
+	files := authority.issue(t, dir, "manager", x509.ExtKeyUsageServerAuth)
+
+	tlsConfig, err := NewServerTLSConfig(files)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if tlsConfig == nil || len(tlsConfig.Certificates) != 1 || tlsConfig.ClientAuth != tls.NoClientCert {
+		t.Fatalf("unexpected server TLS config without CA: %+v", tlsConfig)
+	}
+
+	files.CAFile = authority.certFile
+	if tlsConfig, err = NewServerTLSConfig(files); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if tlsConfig.ClientAuth != tls.RequireAndVerifyClientCert || tlsConfig.ClientCAs == nil {
+		t.Fatalf("expected client certificates to be required with a CA")
+	}
+}
+
+func TestNewServerTLSConfigWithoutCertificate(t *testing.T) {
+	tlsConfig, err := NewServerTLSConfig(TLSFiles{})
+	if err != nil || tlsConfig != nil {
+		t.Fatalf("expected plain connections without certificate, got %v, %v", tlsConfig, err)
+	}
+
+	if _, err := NewServerTLSConfig(TLSFiles{ CAFile: "ca.pem" }); err == nil {
+		t.Fatalf("expected error with a CA but no certificate and key")
+	}
+}
+
+func TestNewServerTLSConfigInvalidFiles(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	authority := newTestAuthority(t, dir, "test")
+	files := authority.issue(t, dir, "manager", x509.ExtKeyUsageServerAuth)
+
+	invalidCAFile := filepath.Join(dir, "invalid-ca.pem")
+	if err := ioutil.WriteFile(invalidCAFile, []byte("not a certificate"), 0600); err != nil {
+		t.Fatalf("writing %s: %s", invalidCAFile, err)
+	}
+
+	tests := []struct {
+		name 			string
+		files 			TLSFiles
+	}{
+		{ "missing key", TLSFiles{ CertFile: files.CertFile } },
+		{ "missing certificate file", TLSFiles{ CertFile: filepath.Join(dir, "missing.pem"), KeyFile: files.KeyFile } },
+		{ "missing CA file", TLSFiles{ CertFile: files.CertFile, KeyFile: files.KeyFile, CAFile: filepath.Join(dir, "missing.pem") } },
+		{ "invalid CA file", TLSFiles{ CertFile: files.CertFile, KeyFile: files.KeyFile, CAFile: invalidCAFile } },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if _, err := NewServerTLSConfig(test.files); err == nil {
+				t.Fatalf("expected error loading %+v", test.files)
+			}
+			if _, err := NewClientTLSConfig(test.files); err == nil {
+				t.Fatalf("expected error loading %+v", test.files)
+			}
+		})
+	}
+}
+
+func TestNewClientTLSConfig(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	tlsConfig, err := NewClientTLSConfig(TLSFiles{})
+	if err != nil || tlsConfig == nil || len(tlsConfig.Certificates) != 0 || tlsConfig.RootCAs != nil {
+		t.Fatalf("unexpected client TLS config without files: %+v, %v", tlsConfig, err)
+	}
+
+	authority := newTestAuthority(t, dir, "test")
+	files := authority.issue(t, dir, "agent", x509.ExtKeyUsageClientAuth)
+	files.CAFile = authority.certFile
+
+	if tlsConfig, err = NewClientTLSConfig(files); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(tlsConfig.Certificates) != 1 || tlsConfig.RootCAs == nil {
+		t.Fatalf("expected client certificate and CA to be loaded")
+	}
+}
+
+func TestPlainListenDial(t *testing.T) {
+	listener, address := listenTestServer(t, nil)
+	defer listener.Close()
+	result := acceptTestPeer(listener)
+
+	conn, err := DialTimeout(address, nil, testTimeout)
+	if err != nil {
+		t.Fatalf("dialing: %s", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatalf("writing: %s", err)
+	}
+
+	if peer := waitTestPeer(t, result); peer.err != nil || peer.name != "" || peer.message != "ping\n" {
+		t.Fatalf("unexpected plain peer %+v", peer)
+	}
+}
+
+func TestMutualTLSRoundTrip(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	authority := newTestAuthority(t, dir, "test")
+	serverFiles := authority.issue(t, dir, "manager", x509.ExtKeyUsageServerAuth)
+	serverFiles.CAFile = authority.certFile
+	clientFiles := authority.issue(t, dir, "agent-1", x509.ExtKeyUsageClientAuth)
+	clientFiles.CAFile = authority.certFile
+
+	serverConfig, err := NewServerTLSConfig(serverFiles)
+	if err != nil {
+		t.Fatalf("server TLS config: %s", err)
+	}
+	clientConfig, err := NewClientTLSConfig(clientFiles)
+	if err != nil {
+		t.Fatalf("client TLS config: %s", err)
+	}
+
+	listener, address := listenTestServer(t, serverConfig)
+	defer listener.Close()
+	result := acceptTestPeer(listener)
+
+	conn, err := Dial(address, clientConfig)
+	if err != nil {
+		t.Fatalf("dialing: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(testTimeout))
+
+	if _, err := conn.Write([]byte("ping\n")); err != nil {
+		t.Fatalf("writing: %s", err)
+	}
+
+	response, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || response != "ping\n" {
+		t.Fatalf("unexpected response %q: %v", response, err)
+	}
+
+	peer := waitTestPeer(t, result)
+	if peer.err != nil {
+		t.Fatalf("server error: %s", peer.err)
+	}
+	if peer.name != "agent-1" {
+		t.Fatalf("peer name = %q, expected agent-1", peer.name)
+	}
+
+	// The client sees the server certificate too.
+	if name, err := PeerName(conn); err != nil || name != "manager" {
+		t.Fatalf("server name = %q, %v, expected manager", name, err)
+	}
+}
+
+func TestMutualTLSRejectsUntrustedClient(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	authority := newTestAuthority(t, dir, "test")
+	untrusted := newTestAuthority(t, dir, "untrusted")
+
+	serverFiles := authority.issue(t, dir, "manager", x509.ExtKeyUsageServerAuth)
+	serverFiles.CAFile = authority.certFile
+	clientFiles := untrusted.issue(t, dir, "intruder", x509.ExtKeyUsageClientAuth)
+	clientFiles.CAFile = authority.certFile
+
+	serverConfig, err := NewServerTLSConfig(serverFiles)
+	if err != nil {
+		t.Fatalf("server TLS config: %s", err)
+	}
+	clientConfig, err := NewClientTLSConfig(clientFiles)
+	if err != nil {
+		t.Fatalf("client TLS config: %s", err)
+	}
+
+	listener, address := listenTestServer(t, serverConfig)
+	defer listener.Close()
+	result := acceptTestPeer(listener)
+
+	// With TLS 1.3 the client may finish its handshake before the server rejects the certificate.
+	if conn, err := DialTimeout(address, clientConfig, testTimeout); err == nil {
+		conn.Write([]byte("ping\n"))
+		conn.Close()
+	}
+
+	if peer := waitTestPeer(t, result); peer.err == nil {
+		t.Fatalf("expected untrusted client to be rejected, accepted as %q", peer.name)
+	}
+}
+
+func TestDialRejectsUntrustedServer(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	authority := newTestAuthority(t, dir, "test")
+	untrusted := newTestAuthority(t, dir, "untrusted")
+
+	serverConfig, err := NewServerTLSConfig(untrusted.issue(t, dir, "manager", x509.ExtKeyUsageServerAuth))
+	if err != nil {
+		t.Fatalf("server TLS config: %s", err)
+	}
+	clientConfig, err := NewClientTLSConfig(TLSFiles{ CAFile: authority.certFile })
+	if err != nil {
+		t.Fatalf("client TLS config: %s", err)
+	}
+
+	listener, address := listenTestServer(t, serverConfig)
+	defer listener.Close()
+	acceptTestPeer(listener)
+
+	if conn, err := DialTimeout(address, clientConfig, testTimeout); err == nil {
+		conn.Close()
+		t.Fatalf("expected server signed by an untrusted CA to be rejected")
+	}
+}
@@ -11,8 +11,6 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
-const PADDING_CHARACTER = "|"
-
 // Get configuration file's path structure. 
 func GetConfigFile(configFileName string) (string, string, string) {
 	path := filepath.Dir(configFileName)
@@ -47,39 +45,12 @@ func SocketWrite(message string, socket net.Conn) {
 	ip, port := ParseAddress(socket.RemoteAddr().String())
 
 	if _, err := writer.WriteString(message); err != nil {
-		log.Errorf("Error sending message to client from connection ('%s', %s). Message: %s", ip, port, message, err)
+		log.Errorf("Error sending message to client from connection ('%s', %s). Message: %s. Err: '%s'", ip, port, message, err)
 	} else {
 		writer.Flush()
 	}
 }
 
-// Fill string with '|' for packange sending
-func FillString(message string, size int) string {
-	missingPositions := size - len(message)
-	return message + strings.Repeat(PADDING_CHARACTER, missingPositions)
-}
-
-// Remove padding '|'
-func UnfillString(message []byte) string {
-	reversedMessage := reversed(string(message))
-
-	for idx, char := range reversedMessage {
-		if string(char) != PADDING_CHARACTER {
-			return reversed(reversedMessage[idx:])
-		}
-	}
-
-	return ""
-}
-
-func reversed(str string) string {
-	result := ""
-	for _, char := range str { 
-        result = string(char) + result 
-    }
-    return result
-}
-
 func Filter(arr []os.FileInfo, cond func(os.FileInfo) bool) []os.FileInfo {
    result := []os.FileInfo{}
    for i := range arr {
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"flag"
+	"time"
+	"strings"
+	"crypto/tls"
+	"encoding/json"
+
+	"github.com/LaCumbancha/backup-server/backup-manager/utils"
+	"github.com/LaCumbancha/backup-server/backup-manager/common"
+	"github.com/LaCumbancha/backup-server/backup-manager/client"
+)
+
+const DEFAULT_SERVER = "localhost:10000"
+
+const EXIT_OK = 0
+const EXIT_ERROR = 1
+const EXIT_USAGE = 2
+
+type command struct {
+	description 	string
+	run 			func(backupClient *client.BackupClient, args []string) (interface{}, error)
+}
+
+var commands = map[string]command {
+	"register": 	{ "Register a new backup client.", runRegister },
+	"unregister": 	{ "Unregister a backup client.", runUnregister },
+	"query": 		{ "Query the backups stored for a client.", runQuery },
+	"list": 		{ "List registered backup clients.", runList },
+	"update": 		{ "Update the frequency, path or blackout windows of a client.", runUpdate },
+	"pause": 		{ "Pause the backups of a client.", runPause },
+	"resume": 		{ "Resume the backups of a paused client.", runResume },
+	"trigger": 		{ "Run a backup of a client right now.", runTrigger },
+	"restore": 		{ "Download a stored backup.", runRestore },
+	"recover": 		{ "Push a stored backup back to the client node.", runRecover },
+	"status": 		{ "Show the backups running and queued in the scheduler.", runStatus },
+}
+
+var commandOrder = []string{ "register", "unregister", "query", "list", "update", "pause", "resume", "trigger", "restore", "recover", "status" }
+
+// Output printed for every command, keeping the manager response fields.
+type output struct {
+	Status 			string 						`json:"status"`
+	Code 			int 						`json:"code,omitempty"`
+	Message 		string 						`json:"message,omitempty"`
+	Data 			interface{} 				`json:"data,omitempty"`
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: bkpctl [global flags] <command> [flags]\n\nCommands:\n")
+	for _, name := range commandOrder {
+		fmt.Fprintf(os.Stderr, "  %-12s%s\n", name, commands[name].description)
+	}
+	fmt.Fprintf(os.Stderr, "\nGlobal flags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nRun 'bkpctl <command> -h' for the command flags.\n")
+}
+
+func main() {
+	defaultServer := os.Getenv("BKPCTL_SERVER")
+	if defaultServer == "" {
+		defaultServer = DEFAULT_SERVER
+	}
+
+	server := flag.String("server", defaultServer, "Backup manager address (or BKPCTL_SERVER env variable).")
+	timeout := flag.Duration("timeout", client.DEFAULT_TIMEOUT, "Time a request may wait for the manager without any progress.")
+	operationTimeout := flag.Duration("operation-timeout", client.DEFAULT_OPERATION_TIMEOUT, "Time to wait for the manager to finish triggered backups and recoveries.")
+	retries := flag.Int("retries", 2, "Retries when the manager can't be reached.")
+	token := flag.String("token", os.Getenv("BKPCTL_TOKEN"), "Authentication token (or BKPCTL_TOKEN env variable).")
+	sign := flag.Bool("sign", false, "Sign requests with the token (HMAC) instead of sending it.")
+	useTLS := flag.Bool("tls", false, "Connect to the manager using TLS.")
+	tlsCA := flag.String("tls-ca", "", "CA certificate to verify the manager (defaults to the system ones).")
+	tlsCert := flag.String("tls-cert", "", "Client certificate, for managers requiring mutual TLS.")
+	tlsKey := flag.String("tls-key", "", "Client certificate key.")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(EXIT_USAGE)
+	}
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command '%s'.\n\n", flag.Arg(0))
+		usage()
+		os.Exit(EXIT_USAGE)
+	}
+
+	var tlsConfig *tls.Config
+	if *useTLS || *tlsCA != "" || *tlsCert != "" {
+		var err error
+		tlsConfig, err = utils.NewClientTLSConfig(utils.TLSFiles{ CertFile: *tlsCert, KeyFile: *tlsKey, CAFile: *tlsCA })
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid TLS configuration: %s.\n", err)
+			os.Exit(EXIT_USAGE)
+		}
+	}
+
+	backupClient := client.NewBackupClient(client.BackupClientConfig {
+		Address:		*server,
+		Timeout:		*timeout,
+		OperationTimeout:	*operationTimeout,
+		Retries:		*retries,
+		RetryDelay:		time.Second,
+		Token:			*token,
+		Sign:			*sign,
+		TLS:			tlsConfig,
+	})
+
+	result, err := cmd.run(backupClient, flag.Args()[1:])
+	os.Exit(printResult(os.Stdout, result, err))
+}
+
+func printResult(writer io.Writer, result interface{}, err error) int {
+	exitCode := EXIT_OK
+	commandOutput := output{ Status: "ok", Data: result }
+
+	if responseError, ok := err.(*client.ResponseError); ok {
+		exitCode = EXIT_ERROR
+		commandOutput = output{ Status: "error", Code: responseError.Code, Message: responseError.Message }
+		if len(responseError.Data) > 0 {
+			commandOutput.Data = responseError.Data
+		}
+	} else if err != nil {
+		exitCode = EXIT_ERROR
+		commandOutput = output{ Status: "error", Message: err.Error() }
+	}
+
+	outputJson, _ := json.MarshalIndent(commandOutput, "", "  ")
+	fmt.Fprintln(writer, string(outputJson))
+	return exitCode
+}
+
+// Parse command flags, requiring the given ones.
+func parseFlags(flagSet *flag.FlagSet, args []string, required ...string) {
+	flagSet.Parse(args)
+
+	missing := []string{}
+	for _, name := range required {
+		if flagSet.Lookup(name).Value.String() == "" {
+			missing = append(missing, "-" + name)
+		}
+	}
+
+	if len(missing) > 0 {
+		fmt.Fprintf(os.Stderr, "Missing mandatory flags: %s.\n\n", strings.Join(missing, ", "))
+		flagSet.Usage()
+		os.Exit(EXIT_USAGE)
+	}
+}
+
+func targetFlags(flagSet *flag.FlagSet) *client.Target {
+	target := &client.Target{}
+	flagSet.StringVar(&target.Ip, "ip", "", "Backup client IP.")
+	flagSet.StringVar(&target.Port, "port", "", "Backup client port.")
+	flagSet.StringVar(&target.Path, "path", "", "Backup client path.")
+	return target
+}
+
+func runRegister(backupClient *client.BackupClient, args []string) (interface{}, error) {
+	flagSet := flag.NewFlagSet("register", flag.ExitOnError)
+	target := targetFlags(flagSet)
+	freq := flagSet.String("freq", "", "Backup frequency: a duration (30m), an anchored interval (\"every 6h starting 00:30 UTC\") or a cron expression (\"0 2 * * *\").")
+	blackouts := flagSet.String("blackouts", "", "Blackout windows separated by ';' (e.g. \"MON-FRI 09:00-18:00 UTC\").")
+	parseFlags(flagSet, args, "ip", "port", "path", "freq")
+
+	return backupClient.Register(*target, *freq, common.SplitBlackoutWindows(*blackouts))
+}
+
+func runUnregister(backupClient *client.BackupClient, args []string) (interface{}, error) {
+	flagSet := flag.NewFlagSet("unregister", flag.ExitOnError)
+	target := targetFlags(flagSet)
+	parseFlags(flagSet, args, "ip", "port", "path")
+
+	return backupClient.Unregister(*target)
+}
+
+func runQuery(backupClient *client.BackupClient, args []string) (interface{}, error) {
+	flagSet := flag.NewFlagSet("query", flag.ExitOnError)
+	target := targetFlags(flagSet)
+	parseFlags(flagSet, args, "ip", "port", "path")
+
+	return backupClient.Query(*target)
+}
+
+func runList(backupClient *client.BackupClient, args []string) (interface{}, error) {
+	flagSet := flag.NewFlagSet("list", flag.ExitOnError)
+	ip := flagSet.String("ip", "", "Filter by backup client IP.")
+	pathPrefix := flagSet.String("path", "", "Filter by backup path prefix.")
+	parseFlags(flagSet, args)
+
+	return backupClient.List(*ip, *pathPrefix)
+}
+
+func runStatus(backupClient *client.BackupClient, args []string) (interface{}, error) {
+	flagSet := flag.NewFlagSet("status", flag.ExitOnError)
+	parseFlags(flagSet, args)
+
+	return backupClient.Status()
+}
+
+func runUpdate(backupClient *client.BackupClient, args []string) (interface{}, error) {
+	flagSet := flag.NewFlagSet("update", flag.ExitOnError)
+	target := targetFlags(flagSet)
+	options := client.UpdateOptions{}
+	flagSet.StringVar(&options.Freq, "new-freq", "", "New backup frequency (same formats as register).")
+	flagSet.StringVar(&options.Path, "new-path", "", "New backup path.")
+	flagSet.StringVar(&options.Policy, "policy", "", "Next backup policy: 'keep' the current slot or 'restart' from now.")
+	blackouts := flagSet.String("new-blackouts", "", "New blackout windows separated by ';' (empty to remove them).")
+	parseFlags(flagSet, args, "ip", "port", "path")
+
+	flagSet.Visit(func(setFlag *flag.Flag) {
+		if setFlag.Name == "new-blackouts" {
+			newBlackouts := common.SplitBlackoutWindows(*blackouts)
+			options.Blackouts = &newBlackouts
+		}
+	})
+
+	return backupClient.Update(*target, options)
+}
+
+func runPause(backupClient *client.BackupClient, args []string) (interface{}, error) {
+	flagSet := flag.NewFlagSet("pause", flag.ExitOnError)
+	target := targetFlags(flagSet)
+	resume := flagSet.String("resume", "", "Automatic resume, as a duration or an RFC3339 date.")
+	parseFlags(flagSet, args, "ip", "port", "path")
+
+	return backupClient.Pause(*target, *resume)
+}
+
+func runResume(backupClient *client.BackupClient, args []string) (interface{}, error) {
+	flagSet := flag.NewFlagSet("resume", flag.ExitOnError)
+	target := targetFlags(flagSet)
+	parseFlags(flagSet, args, "ip", "port", "path")
+
+	return backupClient.Resume(*target)
+}
+
+func runTrigger(backupClient *client.BackupClient, args []string) (interface{}, error) {
+	flagSet := flag.NewFlagSet("trigger", flag.ExitOnError)
+	target := targetFlags(flagSet)
+	force := flagSet.Bool("force", false, "Ignore the etag, always storing a new backup.")
+	parseFlags(flagSet, args, "ip", "port", "path")
+
+	return backupClient.Trigger(*target, *force)
+}
+
+func runRestore(backupClient *client.BackupClient, args []string) (interface{}, error) {
+	flagSet := flag.NewFlagSet("restore", flag.ExitOnError)
+	target := targetFlags(flagSet)
+	backup := flagSet.String("backup", "", "Backup timestamp (defaults to the latest one).")
+	outputName := flagSet.String("output", "", "Output file ('-' for stdout).")
+	parseFlags(flagSet, args, "ip", "port", "path", "output")
+
+	if *outputName == "-" {
+		result, err := backupClient.Restore(*target, *backup, os.Stdout)
+		os.Exit(printResult(os.Stderr, result, err))
+	}
+
+	outputFile, err := os.Create(*outputName)
+	if err != nil {
+		return nil, err
+	}
+	defer outputFile.Close()
+
+	result, err := backupClient.Restore(*target, *backup, outputFile)
+	if err != nil {
+		outputFile.Close()
+		os.Remove(*outputName)
+	}
+
+	return result, err
+}
+
+func runRecover(backupClient *client.BackupClient, args []string) (interface{}, error) {
+	flagSet := flag.NewFlagSet("recover", flag.ExitOnError)
+	target := targetFlags(flagSet)
+	backup := flagSet.String("backup", "", "Backup timestamp (defaults to the latest one).")
+	targetPath := flagSet.String("target", "", "Path where the backup is extracted (defaults to the registered one).")
+	parseFlags(flagSet, args, "ip", "port", "path")
+
+	return backupClient.Recover(*target, *backup, *targetPath)
+}
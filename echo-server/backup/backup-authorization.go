@@ -0,0 +1,110 @@
+package backup
+
+import (
+	"net"
+	"strings"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/pkg/errors"
+
+	"github.com/LaCumbancha/backup-server/backup-manager/utils"
+	"github.com/LaCumbancha/backup-server/echo-server/common"
+)
+
+const CHALLENGE_SIZE = 32
+
+type backupAuthorizer struct {
+	networks 		[]*net.IPNet
+	names 			map[string]bool
+	sharedKey 		string
+}
+
+// Build the authorizer, accepting single addresses or CIDR networks.
+func newBackupAuthorizer(config common.AuthorizationConfig) (*backupAuthorizer, error) {
+	authorizer := &backupAuthorizer {
+		networks:	[]*net.IPNet{},
+		names:		make(map[string]bool),
+		sharedKey:	config.SharedKey,
+	}
+
+	for _, address := range config.Addresses {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+
+		if !strings.Contains(address, "/") {
+			if ip := net.ParseIP(address); ip != nil && ip.To4() != nil {
+				address += "/32"
+			} else {
+				address += "/128"
+			}
+		}
+
+		_, network, err := net.ParseCIDR(address)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid allowed manager address '%s'", address)
+		}
+		authorizer.networks = append(authorizer.networks, network)
+	}
+
+	for _, name := range config.Names {
+		if name = strings.TrimSpace(name); name != "" {
+			authorizer.names[name] = true
+		}
+	}
+
+	return authorizer, nil
+}
+
+// Check the peer address and its TLS certificate name against the allowlists.
+func (authorizer *backupAuthorizer) authorizePeer(ip string, peerName string) error {
+	if len(authorizer.networks) > 0 && !authorizer.allowedAddress(ip) {
+		return errors.Wrapf(utils.ErrUnauthorized, "address %s not allowed", ip)
+	}
+
+	if len(authorizer.names) > 0 {
+		if peerName == "" {
+			return errors.Wrap(utils.ErrUnauthorized, "a client certificate is required")
+		} else if !authorizer.names[peerName] {
+			return errors.Wrapf(utils.ErrUnauthorized, "certificate name '%s' not allowed", peerName)
+		}
+	}
+
+	return nil
+}
+
+func (authorizer *backupAuthorizer) allowedAddress(ip string) bool {
+	parsedIp := net.ParseIP(ip)
+	if parsedIp == nil {
+		return false
+	}
+
+	for _, network := range authorizer.networks {
+		if network.Contains(parsedIp) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (authorizer *backupAuthorizer) requiresSharedKey() bool {
+	return authorizer.sharedKey != ""
+}
+
+func (authorizer *backupAuthorizer) newChallenge() (string, error) {
+	challenge := make([]byte, CHALLENGE_SIZE)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(challenge), nil
+}
+
+func (authorizer *backupAuthorizer) verifyChallenge(challenge string, signature string) bool {
+	expectedSignature := utils.SignChallenge(authorizer.sharedKey, challenge)
+	return hmac.Equal([]byte(expectedSignature), []byte(signature))
+}
@@ -0,0 +1,16 @@
+package backup
+
+import (
+	"github.com/LaCumbancha/backup-server/backup-manager/utils"
+)
+
+const REQUEST_BACKUP = "backup"
+const REQUEST_RESTORE = "restore"
+const REQUEST_PING = "ping"
+const REQUEST_UNKNOWN = "unknown"
+
+var archiveBuildBuckets = []float64{ 0.01, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 900 }
+
+var requestsServed = utils.NewCounterVec("backup_agent_requests_total", "Requests received from backup schedulers, by type.", "type")
+var archiveBuildDuration = utils.NewHistogram("backup_agent_archive_build_seconds", "Time spent building backup archives.", archiveBuildBuckets)
+var archiveSize = utils.NewHistogram("backup_agent_archive_size_bytes", "Size of the backup archives built.", utils.ExponentialBuckets(1024, 4, 12))
@@ -0,0 +1,155 @@
+package backup
+
+import (
+	"sync"
+	"time"
+	"strings"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/LaCumbancha/backup-server/echo-server/common"
+	"github.com/LaCumbancha/backup-server/backup-manager/client"
+	managerCommon "github.com/LaCumbancha/backup-server/backup-manager/common"
+)
+
+const REGISTRATION_RETRY_DELAY = 5 * time.Second
+const REGISTRATION_MAX_RETRY_DELAY = time.Minute
+
+// Registers the agent datasets in a backup manager, so nodes don't have to be added by hand.
+type backupRegistrar struct {
+	client 			*client.BackupClient
+	host 			string
+	port 			string
+	datasets 		[]common.Dataset
+	unregister 		bool
+	registered 		[]common.Dataset
+	mutex 			sync.Mutex
+}
+
+// Returns nil when no manager was configured.
+func newBackupRegistrar(config common.RegistrationConfig, port string) *backupRegistrar {
+	if config.ManagerAddress == "" {
+		return nil
+	}
+
+	clientConfig := client.BackupClientConfig {
+		Address:		config.ManagerAddress,
+		Token:			config.Token,
+		Sign:			config.Token != "",
+		TLS:			config.TLS,
+	}
+
+	return &backupRegistrar {
+		client:			client.NewBackupClient(clientConfig),
+		host:			config.Host,
+		port:			port,
+		datasets:		config.Datasets,
+		unregister:		config.Unregister,
+	}
+}
+
+// Register every dataset, retrying the ones the manager couldn't take until it's available.
+func (registrar *backupRegistrar) registerDatasets() {
+	pending := registrar.datasets
+	retryDelay := REGISTRATION_RETRY_DELAY
+
+	for len(pending) > 0 {
+		failed := []common.Dataset{}
+		for _, dataset := range pending {
+			if retryable := registrar.registerDataset(dataset); retryable {
+				failed = append(failed, dataset)
+			}
+		}
+
+		if pending = failed; len(pending) == 0 {
+			break
+		}
+
+		log.Infof("Retrying registration of %d datasets in %s.", len(pending), retryDelay.String())
+		time.Sleep(retryDelay)
+
+		if retryDelay *= 2; retryDelay > REGISTRATION_MAX_RETRY_DELAY {
+			retryDelay = REGISTRATION_MAX_RETRY_DELAY
+		}
+	}
+}
+
+// Register a dataset, updating it when the manager knows it with other settings, as the agent configuration
+// prevails. Returns true if it must be retried.
+func (registrar *backupRegistrar) registerDataset(dataset common.Dataset) bool {
+	target := client.Target{ Ip: registrar.host, Port: registrar.port, Path: dataset.Path }
+
+	result, err := registrar.client.Register(target, dataset.Freq, nil)
+	if responseError, ok := err.(*client.ResponseError); ok && responseError.Code == managerCommon.CODE_CONFLICT {
+		err = registrar.updateDataset(target, dataset)
+	} else if err == nil {
+		log.Infof("Dataset %s registered in the backup manager with ID %s and frequency %s.", dataset.Path, result.Id, dataset.Freq)
+	}
+
+	if err != nil {
+		if responseError, ok := err.(*client.ResponseError); ok && responseError.Code < managerCommon.CODE_INTERNAL_ERROR {
+			log.Errorf("Backup manager refused the registration of dataset %s. Err: '%s'", dataset.Path, err)
+			return false
+		}
+
+		log.Warnf("Couldn't register dataset %s in the backup manager. Err: '%s'", dataset.Path, err)
+		return true
+	}
+
+	registrar.mutex.Lock()
+	registrar.registered = append(registrar.registered, dataset)
+	registrar.mutex.Unlock()
+	return false
+}
+
+// Bring a dataset registered with other settings to the agent frequency. Blackout windows aren't part of the agent
+// configuration, so the ones set in the manager are kept.
+func (registrar *backupRegistrar) updateDataset(target client.Target, dataset common.Dataset) error {
+	backupId := managerCommon.AsSha256(managerCommon.BackupRegister{ Ip: target.Ip, Port: target.Port, Path: target.Path })
+
+	backupClients, err := registrar.client.List(target.Ip, target.Path)
+	if err != nil {
+		return err
+	}
+
+	for _, backupClient := range backupClients {
+		if backupClient.Id != backupId {
+			continue
+		}
+
+		if backupClient.Freq == dataset.Freq {
+			log.Infof("Dataset %s already registered with frequency %s. Keeping its blackout windows (%s).", dataset.Path, dataset.Freq, strings.Join(backupClient.Blackouts, "; "))
+			return nil
+		}
+
+		if _, err = registrar.client.Update(target, client.UpdateOptions{ Freq: dataset.Freq }); err == nil {
+			log.Infof("Dataset %s was registered with frequency %s. Updated to frequency %s.", dataset.Path, backupClient.Freq, dataset.Freq)
+		}
+		return err
+	}
+
+	// Unregistered between both requests, so it's registered again in the next attempt.
+	return errors.Errorf("backup client %s not found after a registration conflict", backupId)
+}
+
+// Unregister the datasets registered by the agent, if configured to.
+func (registrar *backupRegistrar) unregisterDatasets() {
+	if !registrar.unregister {
+		return
+	}
+
+	registrar.mutex.Lock()
+	registered := registrar.registered
+	registrar.registered = nil
+	registrar.mutex.Unlock()
+
+	for _, dataset := range registered {
+		target := client.Target{ Ip: registrar.host, Port: registrar.port, Path: dataset.Path }
+		if _, err := registrar.client.Unregister(target); err != nil {
+			log.Errorf("Couldn't unregister dataset %s from the backup manager. Err: '%s'", dataset.Path, err)
+		} else {
+			log.Infof("Dataset %s unregistered from the backup manager.", dataset.Path)
+		}
+	}
+}
@@ -3,35 +3,63 @@ package backup
 import (
 	"os"
 	"io"
+	"fmt"
 	"net"
-	"math"
-	"strconv"
+	"time"
+	"sync"
+	"strings"
+	"crypto/tls"
+	"encoding/json"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/LaCumbancha/backup-server/echo-server/common"
-	"github.com/LaCumbancha/backup-server/echo-server/utils"
+	"github.com/LaCumbancha/backup-server/backup-manager/utils"
+	managerCommon "github.com/LaCumbancha/backup-server/backup-manager/common"
 )
 
-const BUFFER_ETAG = 64
-const BUFFER_BACKUP_PATH = 256
-const BUFFER_BACKUP_FILE_SIZE = 10
-const BUFFER_BACKUP = 1024
+// Time given to a backup scheduler to finish the handshake and send its request after connecting.
+const REQUEST_TIMEOUT = 30 * time.Second
+
+var agentCapabilities = utils.Capabilities {
+	Compression:	[]string{ utils.COMPRESSION_GZIP },
+	Incremental:	false,
+	Restore:		true,
+}
 
 
 type BackupServer struct {
 	port 		string
 	storage 	*common.StorageManager
+	tlsConfig 	*tls.Config
+	authorizer 	*backupAuthorizer
+	registrar 	*backupRegistrar
+	transfers 	sync.Mutex
 }
 
 func NewBackupServer(config common.ServerConfig) *BackupServer {
+	pathPolicy, err := common.NewPathPolicy(config.Paths)
+	if err != nil {
+		log.Fatalf("Invalid backup paths configuration. Err: '%s'", err)
+	}
+
 	echoStorage := &common.StorageManager {
 		Path: 		config.StoragePath,
+		Paths:		pathPolicy,
+	}
+
+	authorizer, err := newBackupAuthorizer(config.Authorization)
+	if err != nil {
+		log.Fatalf("Invalid backup authorization configuration. Err: '%s'", err)
 	}
 
 	server := &BackupServer {
 		port: 		config.Port,
 		storage:	echoStorage,
+		tlsConfig:	config.TLS,
+		authorizer:	authorizer,
+		registrar:	newBackupRegistrar(config.Registration, config.Port),
 	}
 	
 	return server
@@ -42,110 +70,376 @@ func (backupServer *BackupServer) listenBackups(listener net.Listener) {
 		client, err := listener.Accept()
 
 		if client == nil || err != nil {
-			log.Errorf("Couldn't accept backup client.", err)
+			log.Errorf("Couldn't accept backup client. Err: '%s'", err)
 			continue
 		}
 
 		ip, port := utils.ParseAddress(client.RemoteAddr().String())
 		log.Infof("Got backup connection from ('%s', %s).", ip, port)
 
-		etagBuffer := make([]byte, BUFFER_ETAG)
-		_, err = client.Read(etagBuffer)
-		if err != nil {
-			log.Errorf("Error receiving etag from backup scheduler at ('%s', %s).", ip, port, err)
+		// Connections are handled concurrently, so heartbeats are answered while transfers run.
+		go backupServer.handleConnection(client)
+	}
+}
+
+func (backupServer *BackupServer) handleConnection(client net.Conn) {
+	ip, port := utils.ParseAddress(client.RemoteAddr().String())
+	client.SetDeadline(time.Now().Add(REQUEST_TIMEOUT))
+
+	peerName, err := utils.PeerName(client)
+	if err != nil {
+		log.Errorf("TLS handshake failed with backup scheduler at ('%s', %s). Err: '%s'", ip, port, err)
+		client.Close()
+		return
+	} else if peerName != "" {
+		log.Infof("Backup scheduler at ('%s', %s) identified as '%s'.", ip, port, peerName)
+	}
+
+	// The first frame is read before refusing peers, so they get the error instead of a reset connection.
+	frameHeader, payload, err := utils.ReadFrame(client)
+	correlationId := ""
+	if err == nil {
+		if authError := backupServer.authorizer.authorizePeer(ip, peerName); authError != nil {
+			backupServer.refuseConnection(client, peerName, authError)
 			return
 		}
+	}
 
-		receivedEtag := utils.UnfillString(etagBuffer)
-		log.Infof("Backup request received from connection ('%s', %s). E-Tag: %s", ip, port, receivedEtag)
-		backupServer.handleBackup(client, receivedEtag)
+	// Heartbeats don't need the handshake, as they only tell the agent is alive.
+	if err == nil && frameHeader.Type == utils.MESSAGE_PING {
+		requestsServed.With(REQUEST_PING).Inc()
+		backupServer.handlePing(client, payload)
+		return
 	}
-}
 
-func (backupServer *BackupServer) handleBackup(client net.Conn, receivedEtag string) {
-	ip, port := utils.ParseAddress(client.RemoteAddr().String())
+	if err == nil && frameHeader.Type == utils.MESSAGE_HELLO {
+		hello, accepted, challenge := backupServer.handleHello(client, payload)
+		correlationId = hello.CorrelationId
+		if !accepted {
+			client.Close()
+			return
+		}
+
+		if challenge != "" {
+			var authMessage utils.AuthMessage
+			if err = utils.ReadMessage(client, utils.MESSAGE_AUTH, &authMessage); err != nil {
+				backupServer.refuseConnection(client, peerName, errors.Wrapf(utils.ErrUnauthorized, "shared key challenge not answered (%s)", err))
+				return
+			} else if !backupServer.authorizer.verifyChallenge(challenge, authMessage.Signature) {
+				backupServer.refuseConnection(client, peerName, errors.Wrap(utils.ErrUnauthorized, "invalid shared key"))
+				return
+			}
+
+			if err = utils.WriteMessage(client, utils.MESSAGE_AUTH_RESPONSE, utils.AuthResponseMessage{ Accepted: true }); err != nil {
+				utils.CorrelationLogger(correlationId).Errorf("Error sending authentication response to connection ('%s', %s). Err: '%s'", ip, port, err)
+				client.Close()
+				return
+			}
+		}
+
+		frameHeader, payload, err = utils.ReadFrame(client)
+	} else if err == nil && backupServer.authorizer.requiresSharedKey() {
+		backupServer.refuseConnection(client, peerName, errors.Wrap(utils.ErrUnauthorized, "shared key required, but no handshake was received"))
+		return
+	} else if err == nil {
+		log.Warnf("Request received from connection ('%s', %s) without handshake. Assuming a legacy backup scheduler.", ip, port)
+	}
 
-	backupPath := make([]byte, BUFFER_BACKUP_PATH)
-	_, err := client.Read(backupPath)
 	if err != nil {
-		log.Errorf("Error receiving path from backup scheduler at ('%s', %s).", ip, port, err)
+		utils.CorrelationLogger(correlationId).Errorf("Error receiving request from backup scheduler at ('%s', %s). Err: '%s'", ip, port, err)
+		utils.WriteError(client, err)
+		client.Close()
 		return
 	}
-	receivedPath := utils.UnfillString(backupPath)
-	log.Infof("Path requested to backup from connection (%s, %s): %s.", ip, port, receivedPath)
 
-	currentEtag, backupFile := backupServer.storage.GenerateBackup(receivedPath)
+	// Transfers take as long as the archive needs.
+	client.SetDeadline(time.Time{})
+
+	switch frameHeader.Type {
+	case utils.MESSAGE_BACKUP_REQUEST:
+		requestsServed.With(REQUEST_BACKUP).Inc()
+		backupServer.handleBackup(client, payload, correlationId)
+	case utils.MESSAGE_RESTORE_REQUEST:
+		requestsServed.With(REQUEST_RESTORE).Inc()
+		backupServer.handleRestore(client, payload, correlationId)
+	default:
+		requestsServed.With(REQUEST_UNKNOWN).Inc()
+		log.Errorf("Message type %d received from connection ('%s', %s) not recognized.", frameHeader.Type, ip, port)
+		utils.WriteError(client, errors.Wrapf(utils.ErrUnexpectedMessage, "received type %d", frameHeader.Type))
+		client.Close()
+	}
+}
+
+func (backupServer *BackupServer) handlePing(client net.Conn, payload []byte) {
 	defer client.Close()
+	ip, port := utils.ParseAddress(client.RemoteAddr().String())
+
+	var ping utils.PingMessage
+	if err := json.Unmarshal(payload, &ping); err != nil {
+		log.Warnf("Invalid heartbeat received from connection ('%s', %s). Err: '%s'", ip, port, err)
+	}
+
+	pong := utils.PongMessage {
+		SentAt:		ping.SentAt,
+		Version:	common.AGENT_VERSION,
+	}
 
-	if backupFile == nil {
-		errorSize := utils.FillString(strconv.FormatInt(-1, 10), 10)
-		client.Write([]byte(errorSize))
+	if err := utils.WriteMessage(client, utils.MESSAGE_PONG, pong); err != nil {
+		log.Errorf("Error answering heartbeat from connection ('%s', %s). Err: '%s'", ip, port, err)
+		return
 	}
-	if currentEtag == receivedEtag {
-		backupFile.Close()
-		log.Infof("There's no difference beetween current version and last sent. Backup skipped.")
-		emptySize := utils.FillString(strconv.FormatInt(0, 10), 10)
-		client.Write([]byte(emptySize))
+	log.Debugf("Heartbeat answered to connection ('%s', %s).", ip, port)
+}
+
+// Log and answer a request from a backup scheduler that isn't allowed.
+func (backupServer *BackupServer) refuseConnection(client net.Conn, peerName string, err error) {
+	ip, port := utils.ParseAddress(client.RemoteAddr().String())
+	log.Warnf("Request from backup scheduler at ('%s', %s) with certificate '%s' refused. Reason: %s.", ip, port, peerName, err)
+
+	utils.WriteError(client, err)
+	client.Close()
+}
+
+// Answer the scheduler handshake, accepting it only if both sides share a protocol version and a compression algorithm.
+// When a shared key is configured, a challenge is sent that the scheduler must sign before its request.
+func (backupServer *BackupServer) handleHello(client net.Conn, payload []byte) (utils.HelloMessage, bool, string) {
+	ip, port := utils.ParseAddress(client.RemoteAddr().String())
+
+	response := utils.HelloResponseMessage {
+		HelloMessage:	utils.HelloMessage {
+			ProtocolVersion:	utils.PROTOCOL_VERSION,
+			Version:			common.AGENT_VERSION,
+			Capabilities:		agentCapabilities,
+		},
+		Accepted:		true,
+	}
+
+	var hello utils.HelloMessage
+	if err := json.Unmarshal(payload, &hello); err != nil {
+		response.Accepted = false
+		response.Reason = "invalid handshake message"
+	} else if hello.ProtocolVersion < utils.MIN_PROTOCOL_VERSION {
+		response.Accepted = false
+		response.Reason = fmt.Sprintf("protocol version %d not supported (minimum %d)", hello.ProtocolVersion, utils.MIN_PROTOCOL_VERSION)
+	} else if !hello.Capabilities.SupportsCompression(utils.COMPRESSION_GZIP) {
+		response.Accepted = false
+		response.Reason = fmt.Sprintf("no common compression algorithm (agent supports %s)", strings.Join(agentCapabilities.Compression, ", "))
+	} else if hello.ProtocolVersion < utils.PROTOCOL_VERSION {
+		response.ProtocolVersion = hello.ProtocolVersion
+	}
+
+	if response.Accepted && backupServer.authorizer.requiresSharedKey() {
+		challenge, err := backupServer.authorizer.newChallenge()
+		if err != nil {
+			response.Accepted = false
+			response.Reason = "couldn't generate the shared key challenge"
+		}
+		response.Challenge = challenge
+	}
+
+	// The scheduler correlation ID is echoed back, tagging the rest of the connection logs.
+	response.CorrelationId = hello.CorrelationId
+	logger := utils.CorrelationLogger(hello.CorrelationId)
+
+	if response.Accepted {
+		logger.Infof("Handshake from backup scheduler version %s at ('%s', %s) accepted. Protocol version %d.", hello.Version, ip, port, response.ProtocolVersion)
 	} else {
-		log.Infof("Sending new backup with E-Tag: %s", currentEtag)
-		backupServer.sendBackupFile(client, backupFile)
+		logger.Errorf("Handshake from backup scheduler version %s at ('%s', %s) refused. Reason: %s.", hello.Version, ip, port, response.Reason)
 	}
+
+	if err := utils.WriteMessage(client, utils.MESSAGE_HELLO_RESPONSE, response); err != nil {
+		logger.Errorf("Error sending handshake response to connection ('%s', %s). Err: '%s'", ip, port, err)
+		return hello, false, ""
+	}
+
+	return hello, response.Accepted, response.Challenge
 }
 
-func (backupServer *BackupServer) sendBackupFile(client net.Conn, backupFile *os.File) {
-	fileInfo, err := backupFile.Stat()
+func (backupServer *BackupServer) handleBackup(client net.Conn, payload []byte, correlationId string) {
+	defer client.Close()
+	ip, port := utils.ParseAddress(client.RemoteAddr().String())
+
+	var backupRequest utils.BackupRequestMessage
+	err := json.Unmarshal(payload, &backupRequest)
+	if backupRequest.CorrelationId != "" {
+		correlationId = backupRequest.CorrelationId
+	}
+	logger := utils.CorrelationLogger(correlationId)
+
+	if err != nil || backupRequest.Path == "" {
+		logger.Errorf("Invalid backup request received from connection ('%s', %s).", ip, port)
+		backupServer.sendBackupResponse(client, utils.PROTOCOL_STATUS_ERROR, "invalid backup request")
+		return
+	}
+	logger.Infof("Backup request received from connection ('%s', %s). E-Tag: %s", ip, port, backupRequest.Etag)
+	logger.Infof("Path requested to backup from connection (%s, %s): %s.", ip, port, backupRequest.Path)
+
+	// Archives are built in a single file, so transfers run one at a time.
+	backupServer.transfers.Lock()
+	defer backupServer.transfers.Unlock()
+
+	buildStart := time.Now()
+	currentEtag, backupFile, err := backupServer.storage.GenerateBackup(backupRequest.Path)
 	if err != nil {
-		log.Errorf("Couldn't retrieve backup file information. Aborting backup.", err)
+		switch errors.Cause(err) {
+		case common.ErrForbiddenPath:
+			logger.Warnf("Backup of forbidden path requested from connection ('%s', %s). Request refused. Err: '%s'", ip, port, err)
+			backupServer.sendBackupResponse(client, utils.PROTOCOL_STATUS_FORBIDDEN_PATH, "the requested path is not allowed")
+		case common.ErrMissingPath:
+			logger.Errorf("Requested path to backup doesn't exist. Err: '%s'", err)
+			backupServer.sendBackupResponse(client, utils.PROTOCOL_STATUS_ERROR, "the requested path doesn't exist")
+		case common.ErrArchiveFailed:
+			logger.Errorf("Error archiving requested path. Err: '%s'", err)
+			backupServer.sendBackupResponse(client, utils.PROTOCOL_STATUS_ERROR, "couldn't archive the requested path")
+		default:
+			logger.Errorf("Error generating backup file. Err: '%s'", err)
+			backupServer.sendBackupResponse(client, utils.PROTOCOL_STATUS_ERROR, "couldn't generate the backup file")
+		}
 		return
 	}
+	defer backupFile.Close()
+
+	archiveBuildDuration.Observe(time.Since(buildStart).Seconds())
+	if fileInfo, err := backupFile.Stat(); err == nil {
+		archiveSize.Observe(float64(fileInfo.Size()))
+	}
+
+	if currentEtag == backupRequest.Etag {
+		logger.Infof("There's no difference beetween current version and last sent. Backup skipped.")
+		backupServer.sendBackupResponse(client, utils.PROTOCOL_STATUS_UNCHANGED, "")
+	} else {
+		logger.Infof("Sending new backup with E-Tag: %s", currentEtag)
+		backupServer.sendBackupFile(client, backupFile, logger)
+	}
+}
+
+func (backupServer *BackupServer) sendBackupResponse(client net.Conn, status string, message string) error {
+	backupResponse := utils.BackupResponseMessage {
+		Status:		status,
+		Message:	message,
+	}
+
+	return utils.WriteMessage(client, utils.MESSAGE_BACKUP_RESPONSE, backupResponse)
+}
 
+func (backupServer *BackupServer) handleRestore(client net.Conn, payload []byte, correlationId string) {
+	defer client.Close()
 	ip, port := utils.ParseAddress(client.RemoteAddr().String())
-	fileSize := strconv.FormatInt(fileInfo.Size(), 10)
-	fileSizeMessage := utils.FillString(fileSize, BUFFER_BACKUP_FILE_SIZE)
-	
-	client.Write([]byte(fileSizeMessage))
-	log.Infof("Sending backup file size to connection ('%s', %s).", ip, port)
-	
-	sendBuffer := make([]byte, BUFFER_BACKUP)
-	log.Infof("Start sending backup file (size %s) to connection ('%s', %s).", fileSize, ip, port)
 
-	var currentByte int64 = 0
-	for {
-		idx := int(math.Ceil(float64(currentByte) / float64(BUFFER_BACKUP))) + 1
-		log.Debugf("Start sending chunk #%d.", idx)
+	var restoreRequest utils.RestoreRequestMessage
+	err := json.Unmarshal(payload, &restoreRequest)
+	if restoreRequest.CorrelationId != "" {
+		correlationId = restoreRequest.CorrelationId
+	}
+	logger := utils.CorrelationLogger(correlationId)
 
-		sentBytes, err := backupFile.ReadAt(sendBuffer, currentByte)
+	if err != nil || restoreRequest.Path == "" || restoreRequest.Target == "" {
+		logger.Errorf("Invalid restore request received from connection ('%s', %s). Path: '%s'; Target: '%s'.", ip, port, restoreRequest.Path, restoreRequest.Target)
+		backupServer.sendRestoreStatus(client, managerCommon.RESTORE_INVALID_REQUEST)
+		return
+	}
+	sourcePath := restoreRequest.Path
+	targetPath := restoreRequest.Target
+	logger.Infof("Restore requested from connection ('%s', %s) for path %s into %s.", ip, port, sourcePath, targetPath)
 
-		if sentBytes != 0 {
-			_, err = client.Write(sendBuffer[:sentBytes])
-			if err != nil {
-				log.Errorf("Error sending chunk #%d, with %d bytes.", idx, sentBytes)
-			}
-			log.Debugf("Finish sending chunk #%d, with %d bytes.", idx, sentBytes)
+	// Refused targets are answered before the file is sent, so it isn't transferred for nothing.
+	if err = backupServer.storage.CheckRestorePath(targetPath); err != nil {
+		if errors.Cause(err) == common.ErrForbiddenPath {
+			logger.Warnf("Restore into forbidden path requested from connection ('%s', %s). Request refused. Err: '%s'", ip, port, err)
+			backupServer.sendRestoreStatus(client, managerCommon.RESTORE_FORBIDDEN_PATH)
+		} else {
+			logger.Errorf("Error checking restore path %s. Err: '%s'", targetPath, err)
+			backupServer.sendRestoreStatus(client, managerCommon.RESTORE_WRITE_ERROR)
 		}
+		return
+	}
 
-		if err != nil {
-			if err == io.EOF {
-				log.Debugf("Sending EOF in chunk #%d.", idx)
-				break
-			} else {
-				log.Errorf("Error sending backup file to connection ('%s', %s).", ip, port, err)
-			}
+	backupServer.transfers.Lock()
+	defer backupServer.transfers.Unlock()
+
+	restoreFile, err := os.Create(common.RESTORE_FILE)
+	if err != nil {
+		logger.Errorf("Error creating restore file. Err: '%s'", err)
+		backupServer.sendRestoreStatus(client, managerCommon.RESTORE_WRITE_ERROR)
+		return
+	}
+
+	fileSize, err := utils.ReadFile(client, restoreFile)
+	restoreFile.Close()
+	if err != nil || fileSize == 0 {
+		logger.Errorf("Error receiving restore file (size %d) from connection ('%s', %s). Err: '%v'", fileSize, ip, port, err)
+		os.Remove(common.RESTORE_FILE)
+		backupServer.sendRestoreStatus(client, managerCommon.RESTORE_TRANSFER_ERROR)
+		return
+	}
+	logger.Infof("Restore file (size %d) received from connection ('%s', %s).", fileSize, ip, port)
+
+	err = backupServer.storage.RestoreBackup(sourcePath, targetPath)
+	if err != nil {
+		logger.Errorf("Error restoring backup of path %s into %s. Err: '%s'", sourcePath, targetPath, err)
+
+		switch errors.Cause(err) {
+		case common.ErrForbiddenPath:
+			logger.Warnf("Restore into forbidden path requested from connection ('%s', %s). Request refused.", ip, port)
+			backupServer.sendRestoreStatus(client, managerCommon.RESTORE_FORBIDDEN_PATH)
+		case common.ErrUnsafeArchive:
+			backupServer.sendRestoreStatus(client, managerCommon.RESTORE_UNSAFE_ARCHIVE)
+		case common.ErrInvalidArchive:
+			backupServer.sendRestoreStatus(client, managerCommon.RESTORE_INVALID_ARCHIVE)
+		default:
+			backupServer.sendRestoreStatus(client, managerCommon.RESTORE_WRITE_ERROR)
 		}
+		return
+	}
+
+	logger.Infof("Backup of path %s restored into %s.", sourcePath, targetPath)
+	backupServer.sendRestoreStatus(client, managerCommon.RESTORE_OK)
+}
+
+func (backupServer *BackupServer) sendRestoreStatus(client net.Conn, status string) {
+	utils.WriteMessage(client, utils.MESSAGE_RESTORE_RESPONSE, utils.RestoreResponseMessage{ Status: status })
+}
 
-		currentByte += BUFFER_BACKUP
+func (backupServer *BackupServer) sendBackupFile(client net.Conn, backupFile *os.File, logger *log.Entry) {
+	fileInfo, err := backupFile.Stat()
+	if err != nil {
+		logger.Errorf("Couldn't retrieve backup file information. Aborting backup. Err: '%s'", err)
+		backupServer.sendBackupResponse(client, utils.PROTOCOL_STATUS_ERROR, "couldn't read the backup file")
+		return
+	}
+
+	ip, port := utils.ParseAddress(client.RemoteAddr().String())
+	if err = backupServer.sendBackupResponse(client, utils.PROTOCOL_STATUS_OK, ""); err != nil {
+		logger.Errorf("Error sending backup response to connection ('%s', %s). Err: '%s'", ip, port, err)
+		return
 	}
 
-	backupFile.Close()
-	log.Infof("Backup file sent to connection ('%s', %s).", ip, port)
+	logger.Infof("Start sending backup file (size %d) to connection ('%s', %s).", fileInfo.Size(), ip, port)
+	if err = utils.WriteFile(client, io.NewSectionReader(backupFile, 0, fileInfo.Size()), fileInfo.Size()); err != nil {
+		logger.Errorf("Error sending backup file to connection ('%s', %s). Err: '%s'", ip, port, err)
+		return
+	}
+
+	logger.Infof("Backup file sent to connection ('%s', %s).", ip, port)
 }
 
 func (backupServer *BackupServer) Run() {
 	// Create server
-	listener, err := net.Listen("tcp", ":" + backupServer.port)
+	listener, err := utils.Listen(backupServer.port, backupServer.tlsConfig)
 	if listener == nil || err != nil {
 		log.Fatalf("[SERVER] Error creating TCP server socket at port %s.", backupServer.port)
 	}
 
+	if backupServer.registrar != nil {
+		go backupServer.registrar.registerDatasets()
+	}
+
 	backupServer.listenBackups(listener)
 }
+
+// Leave the backup manager, unregistering the datasets if configured to.
+func (backupServer *BackupServer) Shutdown() {
+	if backupServer.registrar != nil {
+		backupServer.registrar.unregisterDatasets()
+	}
+}
@@ -4,16 +4,25 @@ import (
 	"os"
 	"io"
 	"strings"
+	"path/filepath"
 	"archive/tar"
 	"compress/gzip"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
-func TarAppender(filePath string, tarWriter *tar.Writer, fileInfo os.FileInfo) {
+var ErrInvalidArchive = errors.New("invalid backup archive")
+var ErrUnsafeArchive = errors.New("unsafe backup archive")
+var ErrArchiveFailed = errors.New("couldn't archive backup path")
+
+// Decide if an entry found while archiving must be included. Directories rejected are not walked.
+type EntryFilter func(path string, fileInfo os.FileInfo) bool
+
+func TarAppender(filePath string, tarWriter *tar.Writer, fileInfo os.FileInfo) error {
 	file, err := os.Open(filePath)
 	if err != nil {
-	    log.Fatal("Error opening file %s.", filePath, err)
+		return errors.Wrapf(err, "error opening file %s", filePath)
 	}
 	defer file.Close()
 
@@ -23,60 +32,175 @@ func TarAppender(filePath string, tarWriter *tar.Writer, fileInfo os.FileInfo) {
 	header.Mode = int64(fileInfo.Mode())
 	header.ModTime = fileInfo.ModTime()
 
-	err = tarWriter.WriteHeader(header)
-	if err != nil {
-	    log.Fatal("Error writing Tar header for file %s.", filePath, err)
+	if err = tarWriter.WriteHeader(header); err != nil {
+		return errors.Wrapf(err, "error writing tar header for file %s", filePath)
 	}
 
-	_, err = io.Copy(tarWriter, file)
-	if err != nil {
-	    log.Fatal("Error appending file %s content to tar file.", filePath, err)
+	if _, err = io.Copy(tarWriter, file); err != nil {
+		return errors.Wrapf(err, "error appending file %s content to tar file", filePath)
 	}
+
+	return nil
 }
 
-func IterativeCompression(dirPath string, tarWriter *tar.Writer) {
+func IterativeCompression(dirPath string, tarWriter *tar.Writer, filter EntryFilter) error {
 	dir, err := os.Open(dirPath)
 	if err != nil {
-	    log.Fatal("Error opening directory %s for backup.", dirPath, err)
+		return errors.Wrapf(err, "error opening directory %s for backup", dirPath)
 	}
 	defer dir.Close()
 
 	filesInfo, err := dir.Readdir(0)
 	if err != nil {
-	    log.Fatal("Error reading directory %s for backup.", dirPath, err)
+		return errors.Wrapf(err, "error reading directory %s for backup", dirPath)
 	}
 
 	for _, fileInfo := range filesInfo {
 	  fullPath := dirPath + "/" + fileInfo.Name()
 
+	  if filter != nil && !filter(fullPath, fileInfo) {
+	  	continue
+	  }
+
+	  // Symlinks accepted by the filter are archived as the file they point to. Directories are never followed, as
+	  // they could loop or take the backup outside its path.
+	  if fileInfo.Mode() & os.ModeSymlink != 0 {
+	  	if fileInfo, err = os.Stat(fullPath); err != nil {
+	  		log.Warnf("Skipping symlink %s from backup. Err: '%s'", fullPath, err)
+	  		continue
+	  	}
+
+	  	if fileInfo.IsDir() {
+	  		log.Warnf("Skipping symlink %s from backup, as it points to a directory.", fullPath)
+	  		continue
+	  	}
+	  }
+
 	  if fileInfo.IsDir() {
 	  	log.Debugf("Accessing new directory for compression in %s", fullPath)
-	    IterativeCompression(fullPath, tarWriter)
+	    if err := IterativeCompression(fullPath, tarWriter, filter); err != nil {
+	    	return err
+	    }
+	  } else if !fileInfo.Mode().IsRegular() {
+	  	log.Warnf("Skipping %s from backup, as it isn't a regular file.", fullPath)
 	  } else {
 	  	log.Debugf("Adding file %s to TarGz", fullPath)
-	    TarAppender(fullPath, tarWriter, fileInfo)
+	    if err := TarAppender(fullPath, tarWriter, fileInfo); err != nil {
+	    	return err
+	    }
 	  }
 	}
+
+	return nil
 }
 
-func GenerateBackupFile(outputName string, inPath string) {
+// Archive the path into the output file, which is removed if the archive can't be completed.
+func GenerateBackupFile(outputName string, inPath string, filter EntryFilter) error {
 	fileWriter, err := os.Create(outputName)
 	if err != nil {
-	    log.Fatal("Error creating fileWriter for compressor.", err)
+		return errors.Wrapf(err, "error creating fileWriter for compressor")
 	}
-	defer fileWriter.Close()
 
 	gzipWriter := gzip.NewWriter(fileWriter)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	err = IterativeCompression(strings.TrimRight(inPath,"/"), tarWriter, filter)
+	if err == nil {
+		err = errors.Wrapf(tarWriter.Close(), "error closing tarWriter for compressor")
+	}
+	if err == nil {
+		err = errors.Wrapf(gzipWriter.Close(), "error closing gzipWriter for compressor")
+	}
+	if closeErr := fileWriter.Close(); err == nil {
+		err = errors.Wrapf(closeErr, "error closing fileWriter for compressor")
+	}
+
 	if err != nil {
-	    log.Fatal("Error creating gzipWriter for compressor.", err)
+		os.Remove(outputName)
 	}
-	defer gzipWriter.Close()
 
-	tarWriter := tar.NewWriter(gzipWriter)
+	return err
+}
+
+func ExtractBackupFile(inputName string, sourcePath string, targetPath string) error {
+	fileReader, err := os.Open(inputName)
+	if err != nil {
+		return errors.Wrapf(err, "error opening fileReader for extractor")
+	}
+	defer fileReader.Close()
+
+	gzipReader, err := gzip.NewReader(fileReader)
+	if err != nil {
+		return errors.Wrapf(ErrInvalidArchive, "error creating gzipReader for extractor: %s", err)
+	}
+	defer gzipReader.Close()
+
+	sourceRoot := strings.TrimRight(sourcePath, "/") + "/"
+	targetRoot, err := CanonicalPath(targetPath)
+	if err != nil {
+		return errors.Wrapf(err, "error resolving restore path %s", targetPath)
+	}
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrapf(ErrInvalidArchive, "error reading tar header: %s", err)
+		}
+
+		// Entries are stored with the original backup path, as done by GenerateBackupFile.
+		if !strings.HasPrefix(header.Name, sourceRoot) {
+			return errors.Wrapf(ErrUnsafeArchive, "entry %s outside backup path %s", header.Name, sourcePath)
+		}
+
+		relativePath := strings.TrimPrefix(header.Name, sourceRoot)
+		fullPath := filepath.Join(targetRoot, relativePath)
+		if fullPath != targetRoot && !strings.HasPrefix(fullPath, targetRoot + string(os.PathSeparator)) {
+			return errors.Wrapf(ErrUnsafeArchive, "entry %s escapes restore path %s", header.Name, targetPath)
+		}
+
+		// Symlinks already in the restore path can't take entries outside of it.
+		if canonicalPath, err := CanonicalPath(fullPath); err != nil || (canonicalPath != targetRoot && !strings.HasPrefix(canonicalPath, targetRoot + string(os.PathSeparator))) {
+			return errors.Wrapf(ErrUnsafeArchive, "entry %s escapes restore path %s through a symlink", header.Name, targetPath)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			log.Debugf("Restoring directory %s", fullPath)
+			if err := os.MkdirAll(fullPath, os.ModePerm); err != nil {
+				return errors.Wrapf(err, "error creating directory %s", fullPath)
+			}
+		case tar.TypeReg:
+			log.Debugf("Restoring file %s", fullPath)
+			if err := extractFile(tarReader, header, fullPath); err != nil {
+				return err
+			}
+		default:
+			return errors.Wrapf(ErrUnsafeArchive, "entry %s has unsupported type %c", header.Name, header.Typeflag)
+		}
+	}
+
+	return nil
+}
+
+func extractFile(tarReader *tar.Reader, header *tar.Header, fullPath string) error {
+	err := os.MkdirAll(filepath.Dir(fullPath), os.ModePerm)
 	if err != nil {
-	    log.Fatal("Error creating tarWriter for compressor.", err)
+		return errors.Wrapf(err, "error creating directory for file %s", fullPath)
+	}
+
+	file, err := os.OpenFile(fullPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+	if err != nil {
+		return errors.Wrapf(err, "error creating file %s", fullPath)
+	}
+	defer file.Close()
+
+	if _, err = io.Copy(file, tarReader); err != nil {
+		return errors.Wrapf(err, "error writing file %s", fullPath)
 	}
-	defer tarWriter.Close()
 
-	IterativeCompression(strings.TrimRight(inPath,"/"), tarWriter)
+	return os.Chtimes(fullPath, header.ModTime, header.ModTime)
 }
@@ -0,0 +1,292 @@
+package common
+
+import (
+	"io"
+	"os"
+	"testing"
+	"io/ioutil"
+	"archive/tar"
+	"path/filepath"
+	"compress/gzip"
+
+	"github.com/pkg/errors"
+)
+
+const testSourcePath = "/var/lib/app"
+
+type testEntry struct {
+	name 			string
+	typeflag 		byte
+	content 		string
+	linkname 		string
+}
+
+func writeTestArchive(t *testing.T, archivePath string, entries []testEntry) {
+	file, err := os.Create(archivePath)
+	if err != nil {
+		t.Fatalf("creating archive: %s", err)
+	}
+	defer file.Close()
+
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	for _, entry := range entries {
+		header := &tar.Header {
+			Name:		entry.name,
+			Typeflag:	entry.typeflag,
+			Mode:		0644,
+			Size:		int64(len(entry.content)),
+			Linkname:	entry.linkname,
+		}
+
+		if entry.typeflag != tar.TypeReg {
+			header.Size = 0
+			header.Mode = 0755
+		}
+
+		if err := tarWriter.WriteHeader(header); err != nil {
+			t.Fatalf("writing header %s: %s", entry.name, err)
+		}
+
+		if header.Size > 0 {
+			if _, err := tarWriter.Write([]byte(entry.content)); err != nil {
+				t.Fatalf("writing entry %s: %s", entry.name, err)
+			}
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		t.Fatalf("closing tar writer: %s", err)
+	}
+	if err := gzipWriter.Close(); err != nil {
+		t.Fatalf("closing gzip writer: %s", err)
+	}
+}
+
+func newTestDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "echo-server-test")
+	if err != nil {
+		t.Fatalf("creating temporary directory: %s", err)
+	}
+
+	// Resolved, as temporary directories may be behind a symlink.
+	dir, err = filepath.EvalSymlinks(dir)
+	if err != nil {
+		t.Fatalf("resolving temporary directory: %s", err)
+	}
+
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func TestExtractBackupFile(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	archivePath := filepath.Join(dir, "backup.tar.gz")
+	writeTestArchive(t, archivePath, []testEntry{
+		{ name: testSourcePath + "/", typeflag: tar.TypeDir },
+		{ name: testSourcePath + "/sub/", typeflag: tar.TypeDir },
+		{ name: testSourcePath + "/a.txt", typeflag: tar.TypeReg, content: "hello" },
+		{ name: testSourcePath + "/sub/b.txt", typeflag: tar.TypeReg, content: "world" },
+	})
+
+	targetPath := filepath.Join(dir, "restored")
+	if err := ExtractBackupFile(archivePath, testSourcePath, targetPath); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for name, expected := range map[string]string{ "a.txt": "hello", "sub/b.txt": "world" } {
+		content, err := ioutil.ReadFile(filepath.Join(targetPath, name))
+		if err != nil {
+			t.Errorf("reading restored %s: %s", name, err)
+		} else if string(content) != expected {
+			t.Errorf("restored %s = %q, expected %q", name, content, expected)
+		}
+	}
+}
+
+func TestExtractBackupFileRejectsUnsafeEntries(t *testing.T) {
+	tests := []struct {
+		name 			string
+		entries 		[]testEntry
+	}{
+		{ "entry outside backup path", []testEntry{{ name: "/etc/passwd", typeflag: tar.TypeReg, content: "x" }} },
+		{ "sibling with backup path prefix", []testEntry{{ name: testSourcePath + "-other/a.txt", typeflag: tar.TypeReg, content: "x" }} },
+		{ "parent traversal", []testEntry{{ name: testSourcePath + "/../../escaped.txt", typeflag: tar.TypeReg, content: "x" }} },
+		{ "nested parent traversal", []testEntry{{ name: testSourcePath + "/sub/../../../escaped.txt", typeflag: tar.TypeReg, content: "x" }} },
+		{ "symlink entry", []testEntry{{ name: testSourcePath + "/link", typeflag: tar.TypeSymlink, linkname: "/etc" }} },
+		{ "hard link entry", []testEntry{{ name: testSourcePath + "/link", typeflag: tar.TypeLink, linkname: "/etc/passwd" }} },
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir, cleanup := newTestDir(t)
+			defer cleanup()
+
+			archivePath := filepath.Join(dir, "backup.tar.gz")
+			writeTestArchive(t, archivePath, test.entries)
+
+			targetPath := filepath.Join(dir, "restored")
+			err := ExtractBackupFile(archivePath, testSourcePath, targetPath)
+			if errors.Cause(err) != ErrUnsafeArchive {
+				t.Fatalf("expected unsafe archive error, got %v", err)
+			}
+
+			if _, err := os.Stat(filepath.Join(dir, "escaped.txt")); !os.IsNotExist(err) {
+				t.Errorf("entry written outside the restore path")
+			}
+		})
+	}
+}
+
+func TestExtractBackupFileRejectsExistingSymlinks(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	outsidePath := filepath.Join(dir, "outside")
+	targetPath := filepath.Join(dir, "restored")
+	for _, path := range []string{ outsidePath, targetPath } {
+		if err := os.MkdirAll(path, os.ModePerm); err != nil {
+			t.Fatalf("creating %s: %s", path, err)
+		}
+	}
+
+	// A symlink already in the restore path must not take entries out of it.
+	if err := os.Symlink(outsidePath, filepath.Join(targetPath, "link")); err != nil {
+		t.Fatalf("creating symlink: %s", err)
+	}
+
+	archivePath := filepath.Join(dir, "backup.tar.gz")
+	writeTestArchive(t, archivePath, []testEntry{
+		{ name: testSourcePath + "/link/escaped.txt", typeflag: tar.TypeReg, content: "x" },
+	})
+
+	err := ExtractBackupFile(archivePath, testSourcePath, targetPath)
+	if errors.Cause(err) != ErrUnsafeArchive {
+		t.Fatalf("expected unsafe archive error, got %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(outsidePath, "escaped.txt")); !os.IsNotExist(err) {
+		t.Errorf("entry written through the symlink")
+	}
+}
+
+func TestExtractBackupFileRejectsInvalidArchives(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	archivePath := filepath.Join(dir, "backup.tar.gz")
+	if err := ioutil.WriteFile(archivePath, []byte("not a gzip file"), 0644); err != nil {
+		t.Fatalf("writing archive: %s", err)
+	}
+
+	err := ExtractBackupFile(archivePath, testSourcePath, filepath.Join(dir, "restored"))
+	if errors.Cause(err) != ErrInvalidArchive {
+		t.Fatalf("expected invalid archive error, got %v", err)
+	}
+}
+
+func readTestArchiveNames(t *testing.T, archivePath string) map[string]bool {
+	file, err := os.Open(archivePath)
+	if err != nil {
+		t.Fatalf("opening archive: %s", err)
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("reading gzip stream: %s", err)
+	}
+
+	names := make(map[string]bool)
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("reading tar header: %s", err)
+		}
+		names[header.Name] = true
+	}
+
+	return names
+}
+
+func TestGenerateBackupFileSkipsDirectorySymlinks(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	sourcePath := filepath.Join(dir, "source")
+	outsidePath := filepath.Join(dir, "outside")
+	for _, path := range []string{ sourcePath, outsidePath } {
+		if err := os.MkdirAll(path, os.ModePerm); err != nil {
+			t.Fatalf("creating %s: %s", path, err)
+		}
+	}
+
+	for _, path := range []string{ filepath.Join(sourcePath, "a.txt"), filepath.Join(outsidePath, "secret.txt") } {
+		if err := ioutil.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatalf("writing %s: %s", path, err)
+		}
+	}
+
+	// No filter is given, so the directory symlinks must be refused by the compression itself.
+	links := map[string]string{ "loop": sourcePath, "escape": outsidePath, "file": filepath.Join(sourcePath, "a.txt") }
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(sourcePath, name)); err != nil {
+			t.Fatalf("creating symlink %s: %s", name, err)
+		}
+	}
+
+	archivePath := filepath.Join(dir, "backup.tar.gz")
+	if err := GenerateBackupFile(archivePath, sourcePath, nil); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	names := readTestArchiveNames(t, archivePath)
+	expected := []string{ sourcePath + "/a.txt", sourcePath + "/file" }
+	if len(names) != len(expected) {
+		t.Fatalf("expected entries %v, got %v", expected, names)
+	}
+	for _, name := range expected {
+		if !names[name] {
+			t.Fatalf("expected entries %v, got %v", expected, names)
+		}
+	}
+}
+
+func TestGenerateBackupFileReturnsErrors(t *testing.T) {
+	dir, cleanup := newTestDir(t)
+	defer cleanup()
+
+	sourcePath := filepath.Join(dir, "source")
+	if err := os.MkdirAll(sourcePath, os.ModePerm); err != nil {
+		t.Fatalf("creating %s: %s", sourcePath, err)
+	}
+
+	filePath := filepath.Join(sourcePath, "a.txt")
+	if err := ioutil.WriteFile(filePath, []byte("x"), 0644); err != nil {
+		t.Fatalf("writing %s: %s", filePath, err)
+	}
+
+	// Files removed while archiving can't be opened, failing the backup.
+	removeFile := func(path string, fileInfo os.FileInfo) bool {
+		os.Remove(path)
+		return true
+	}
+
+	archivePath := filepath.Join(dir, "backup.tar.gz")
+	if err := GenerateBackupFile(archivePath, sourcePath, removeFile); err == nil {
+		t.Fatalf("expected an error archiving a missing file")
+	}
+
+	if _, err := os.Stat(archivePath); !os.IsNotExist(err) {
+		t.Errorf("incomplete archive kept")
+	}
+
+	if err := GenerateBackupFile(archivePath, filepath.Join(dir, "missing"), nil); err == nil {
+		t.Fatalf("expected an error archiving a missing path")
+	}
+}
@@ -1,8 +1,63 @@
 package common
 
+import (
+	"strings"
+	"crypto/tls"
+
+	"github.com/pkg/errors"
+)
+
+const DATASET_SEPARATOR = ";"
+
+const AGENT_VERSION = "1.1.0"
+
 type ServerConfig struct {
 	Port 			string
 	StoragePath		string
+	TLS 			*tls.Config
+	Authorization 	AuthorizationConfig
+	Paths 			PathPolicyConfig
+	Registration 	RegistrationConfig
+}
+
+// Managers allowed to request backups. Every configured check must pass, and nothing is checked if empty.
+type AuthorizationConfig struct {
+	Addresses 		[]string
+	Names 			[]string
+	SharedKey 		string
+}
+
+// Datasets the agent registers in a backup manager when starting, advertising itself with the given host. Nothing
+// is registered without a manager address.
+type RegistrationConfig struct {
+	ManagerAddress 	string
+	Token 			string
+	TLS 			*tls.Config
+	Host 			string
+	Datasets 		[]Dataset
+	Unregister 		bool
+}
+
+type Dataset struct {
+	Path 			string
+	Freq 			string
 }
 
-const PADDING_CHARACTER = "|"
+// Parse a list of datasets, written as "<path>=<frequency>" and separated by ';'.
+func ParseDatasets(list string) ([]Dataset, error) {
+	datasets := []Dataset{}
+	for _, entry := range strings.Split(list, DATASET_SEPARATOR) {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		fields := strings.SplitN(entry, "=", 2)
+		if len(fields) != 2 || strings.TrimSpace(fields[0]) == "" || strings.TrimSpace(fields[1]) == "" {
+			return nil, errors.Errorf("datasets must look like '/var/lib/app=1h', got '%s'", entry)
+		}
+
+		datasets = append(datasets, Dataset{ Path: strings.TrimSpace(fields[0]), Freq: strings.TrimSpace(fields[1]) })
+	}
+
+	return datasets, nil
+}
@@ -0,0 +1,169 @@
+package common
+
+import (
+	"os"
+	"strings"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+var ErrForbiddenPath = errors.New("forbidden backup path")
+var ErrMissingPath = errors.New("backup path doesn't exist")
+
+// Paths the agent may back up or restore into. Without allowed roots every path is allowed. Deny patterns are globs
+// matched against the whole path when they contain a '/', or against the file name otherwise.
+type PathPolicyConfig struct {
+	AllowedRoots 	[]string
+	DeniedPatterns 	[]string
+}
+
+type PathPolicy struct {
+	roots 			[]string
+	denied 			[]string
+}
+
+func NewPathPolicy(config PathPolicyConfig) (*PathPolicy, error) {
+	policy := &PathPolicy {
+		roots:		[]string{},
+		denied:		[]string{},
+	}
+
+	for _, root := range config.AllowedRoots {
+		if root = strings.TrimSpace(root); root == "" {
+			continue
+		}
+
+		canonicalRoot, err := CanonicalPath(root)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid allowed root '%s'", root)
+		}
+		policy.roots = append(policy.roots, canonicalRoot)
+	}
+
+	for _, pattern := range config.DeniedPatterns {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid deny pattern '%s'", pattern)
+		}
+		policy.denied = append(policy.denied, pattern)
+	}
+
+	return policy, nil
+}
+
+// Absolute path with '..' and symlinks resolved. Missing trailing elements are kept as given, resolving the nearest
+// existing parent.
+func CanonicalPath(path string) (string, error) {
+	absolutePath, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+
+	existingPath := absolutePath
+	missingElements := []string{}
+	for {
+		resolvedPath, err := filepath.EvalSymlinks(existingPath)
+		if err == nil {
+			return filepath.Join(append([]string{ resolvedPath }, missingElements...)...), nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		}
+
+		parentPath := filepath.Dir(existingPath)
+		if parentPath == existingPath {
+			return absolutePath, nil
+		}
+
+		missingElements = append([]string{ filepath.Base(existingPath) }, missingElements...)
+		existingPath = parentPath
+	}
+}
+
+// Check a requested path, returning its canonical form.
+func (policy *PathPolicy) CheckPath(path string) (string, error) {
+	canonicalPath, err := CanonicalPath(path)
+	if err != nil {
+		return "", errors.Wrapf(ErrForbiddenPath, "couldn't resolve path '%s': %s", path, err)
+	}
+
+	if !policy.insideRoots(canonicalPath) {
+		return canonicalPath, errors.Wrapf(ErrForbiddenPath, "path '%s' is outside the allowed roots", canonicalPath)
+	}
+
+	// Paths inside a denied directory are denied too.
+	for checkedPath := canonicalPath; ; checkedPath = filepath.Dir(checkedPath) {
+		if pattern := policy.deniedBy(checkedPath); pattern != "" {
+			return canonicalPath, errors.Wrapf(ErrForbiddenPath, "path '%s' denied by pattern '%s'", canonicalPath, pattern)
+		}
+
+		if filepath.Dir(checkedPath) == checkedPath {
+			break
+		}
+	}
+
+	return canonicalPath, nil
+}
+
+// Check an entry found while archiving, given its canonical path. Symlinks must point inside the allowed roots.
+func (policy *PathPolicy) AllowedEntry(canonicalPath string, fileInfo os.FileInfo) bool {
+	if pattern := policy.deniedBy(canonicalPath); pattern != "" {
+		log.Debugf("Skipping %s from backup, denied by pattern '%s'.", canonicalPath, pattern)
+		return false
+	}
+
+	if fileInfo.Mode() & os.ModeSymlink == 0 {
+		return true
+	}
+
+	targetPath, err := filepath.EvalSymlinks(canonicalPath)
+	if err != nil {
+		log.Warnf("Skipping broken symlink %s from backup.", canonicalPath)
+		return false
+	}
+
+	if _, err = policy.CheckPath(targetPath); err != nil {
+		log.Warnf("Skipping symlink %s from backup. Err: '%s'", canonicalPath, err)
+		return false
+	}
+
+	if targetInfo, err := os.Stat(targetPath); err != nil || targetInfo.IsDir() {
+		log.Warnf("Skipping symlink %s from backup, as it doesn't point to a regular file.", canonicalPath)
+		return false
+	}
+
+	return true
+}
+
+func (policy *PathPolicy) insideRoots(canonicalPath string) bool {
+	if len(policy.roots) == 0 {
+		return true
+	}
+
+	for _, root := range policy.roots {
+		if canonicalPath == root || strings.HasPrefix(canonicalPath, strings.TrimRight(root, "/") + "/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (policy *PathPolicy) deniedBy(canonicalPath string) string {
+	for _, pattern := range policy.denied {
+		target := canonicalPath
+		if !strings.Contains(pattern, "/") {
+			target = filepath.Base(canonicalPath)
+		}
+
+		if matched, _ := filepath.Match(pattern, target); matched {
+			return pattern
+		}
+	}
+
+	return ""
+}
@@ -4,10 +4,13 @@ import (
 	"io"
 	"os"
 	"fmt"
+	"strings"
+	"path/filepath"
 	"crypto/md5"
 	"archive/tar"
 	"compress/gzip"
 
+	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -17,32 +20,34 @@ const LOG_DIR = "./data/logs/"
 const LOG_FILE = "Log.info"
 const INFO_FILE = "Data.info"
 const BACKUP_FILE = "Backup.tar.gz"
+const RESTORE_FILE = "Restore.tar.gz"
 
 type StorageManager struct {
 	Path			string
+	Paths 			*PathPolicy
 }
 
 func (storageManager *StorageManager) BuildStorage() {
 	err := os.MkdirAll(LOG_DIR, os.ModePerm)
 	if err != nil {
-		log.Fatalf("Error creating ConnectionLogs directory.", err)
+		log.Fatalf("Error creating ConnectionLogs directory. Err: '%s'", err)
 	}
 
 	connectionFile, err := os.Create(LOG_DIR + LOG_FILE)
 	if err != nil {
-		log.Fatalf("Error creating ConnectionLogs file.", err)
+		log.Fatalf("Error creating ConnectionLogs file. Err: '%s'", err)
 	}
 
 	connectionFile.Close()
 
 	err = os.MkdirAll(storageManager.Path, os.ModePerm)
 	if err != nil {
-		log.Fatalf("Error creating StorageManager directory.", err)
+		log.Fatalf("Error creating StorageManager directory. Err: '%s'", err)
 	}
 
 	file, err := os.Create(storageManager.Path + "/" + INFO_FILE)
 	if err != nil {
-		log.Fatalf("Error creating StorageManager file.", err)
+		log.Fatalf("Error creating StorageManager file. Err: '%s'", err)
 	}
 
 	file.Close()
@@ -51,54 +56,98 @@ func (storageManager *StorageManager) BuildStorage() {
 func (storageManager *StorageManager) UpdateStorage(line, ip, port string) {
 	file, err := os.OpenFile(storageManager.Path + "/" + INFO_FILE, os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-        log.Fatalf("Error opening StorageManager file.", err)
+        log.Fatalf("Error opening StorageManager file. Err: '%s'", err)
     }
 
     defer file.Close()
  
     _, err = file.WriteString(line)
     if err != nil {
-        log.Fatalf("Error writing StorageManager file.", err)
+        log.Fatalf("Error writing StorageManager file. Err: '%s'", err)
     }
 
     log.Infof("New message stored in server: %s", line)
 
     connectionFile, err := os.OpenFile(LOG_DIR + LOG_FILE, os.O_WRONLY|os.O_APPEND, 0644)
 	if err != nil {
-        log.Fatalf("Error opening ConnectionLog file.", err)
+        log.Fatalf("Error opening ConnectionLog file. Err: '%s'", err)
     }
 
     defer connectionFile.Close()
  
     _, err = connectionFile.WriteString(fmt.Sprintf("Connection (%s, %s)\n", ip, port))
     if err != nil {
-        log.Errorf("Error writing ConnectionLog file.", err)
+        log.Errorf("Error writing ConnectionLog file. Err: '%s'", err)
     }
 
     log.Infof("New connection stored in log: (%s, %s)", ip, port)
 }
 
-func (storageManager *StorageManager) GenerateBackup(path string) (string, *os.File) {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-	  	log.Errorf("Requested path to backup doesn't exist.")
-        return NO_ETAG, nil
+func (storageManager *StorageManager) GenerateBackup(path string) (string, *os.File, error) {
+	canonicalPath, err := storageManager.checkPath(path)
+	if err != nil {
+		return NO_ETAG, nil, err
+	}
+
+	if _, err := os.Stat(canonicalPath); os.IsNotExist(err) {
+		return NO_ETAG, nil, errors.Wrapf(ErrMissingPath, "path '%s'", path)
 	}
 
-	GenerateBackupFile(BACKUP_FILE, path)
+	// Entries keep the requested path as name, while the policy is checked against their canonical path.
+	var filter EntryFilter
+	if storageManager.Paths != nil {
+		requestedPath := strings.TrimRight(path, "/")
+		filter = func(entryPath string, fileInfo os.FileInfo) bool {
+			return storageManager.Paths.AllowedEntry(filepath.Join(canonicalPath, strings.TrimPrefix(entryPath, requestedPath)), fileInfo)
+		}
+	}
+
+	if err := GenerateBackupFile(BACKUP_FILE, path, filter); err != nil {
+		return NO_ETAG, nil, errors.Wrapf(ErrArchiveFailed, "path '%s': %s", path, err)
+	}
 
 	file, err := os.Open(BACKUP_FILE)
 	if err != nil {
-        log.Errorf("Error opening compressed backup file.", err)
-        return NO_ETAG, nil
-    }
+		return NO_ETAG, nil, errors.Wrapf(err, "error opening compressed backup file")
+	}
+
+	return storageManager.generateEtag(file), file, nil
+}
+
+func (storageManager *StorageManager) RestoreBackup(sourcePath string, targetPath string) error {
+	defer os.Remove(RESTORE_FILE)
+
+	canonicalPath, err := storageManager.checkPath(targetPath)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(canonicalPath, os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return ExtractBackupFile(RESTORE_FILE, sourcePath, canonicalPath)
+}
+
+// Check a restore target before receiving its archive.
+func (storageManager *StorageManager) CheckRestorePath(targetPath string) error {
+	_, err := storageManager.checkPath(targetPath)
+	return err
+}
+
+func (storageManager *StorageManager) checkPath(path string) (string, error) {
+	if storageManager.Paths == nil {
+		return CanonicalPath(path)
+	}
 
-    return storageManager.generateEtag(file), file
+	return storageManager.Paths.CheckPath(path)
 }
 
 func (storageManager *StorageManager) generateEtag(backupFile *os.File) string {
     gzipFile, err := gzip.NewReader(backupFile)
     if err != nil {
-        log.Errorf("Error reading backup gzip file.", err)
+        log.Errorf("Error reading backup gzip file. Err: '%s'", err)
         return NO_ETAG
     }
 
@@ -111,13 +160,13 @@ func (storageManager *StorageManager) generateEtag(backupFile *os.File) string {
     	if err == io.EOF {
     		break
     	} else if err != nil {
-    		log.Errorf("Error retreaving inner tar files for backup.", err)
+    		log.Errorf("Error retreaving inner tar files for backup. Err: '%s'", err)
     	} else if fileHeader == nil {
     		continue
     	}
 
     	if _, err = io.Copy(hasher, tarReader); err != nil {
-    	    log.Errorf("Error building hash for compressed backup file.", err)
+    	    log.Errorf("Error building hash for compressed backup file. Err: '%s'", err)
     	    return NO_ETAG
     	}
 
@@ -1,14 +1,18 @@
 package main
 
 import (
+	"os"
 	"fmt"
+	"strings"
+	"syscall"
+	"os/signal"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/viper"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/LaCumbancha/backup-server/echo-server/backup"
-	"github.com/LaCumbancha/backup-server/echo-server/utils"
+	"github.com/LaCumbancha/backup-server/backup-manager/utils"
 	"github.com/LaCumbancha/backup-server/echo-server/server"
 	"github.com/LaCumbancha/backup-server/echo-server/common"
 )
@@ -23,7 +27,26 @@ func InitConfig() (*viper.Viper, *viper.Viper, error) {
 	// Add env variables supported
 	configEnv.BindEnv("echo", "port")
 	configEnv.BindEnv("backup", "port")
+	configEnv.BindEnv("metrics", "port")
 	configEnv.BindEnv("storage", "path")
+	configEnv.BindEnv("tls", "cert_file")
+	configEnv.BindEnv("tls", "key_file")
+	configEnv.BindEnv("tls", "ca_file")
+	configEnv.BindEnv("allowed", "managers")
+	configEnv.BindEnv("allowed", "manager_names")
+	configEnv.BindEnv("shared", "key")
+	configEnv.BindEnv("allowed", "paths")
+	configEnv.BindEnv("denied", "paths")
+	configEnv.BindEnv("manager", "address")
+	configEnv.BindEnv("manager", "token")
+	configEnv.BindEnv("manager", "tls")
+	configEnv.BindEnv("manager", "tls_ca_file")
+	configEnv.BindEnv("advertise", "host")
+	configEnv.BindEnv("datasets")
+	configEnv.BindEnv("unregister", "on_shutdown")
+	configEnv.BindEnv("log", "level")
+	configEnv.BindEnv("log", "format")
+	configEnv.BindEnv("log", "output")
 	configEnv.BindEnv("config", "file")
 
 	// Read config file if it's present
@@ -44,14 +67,32 @@ func InitConfig() (*viper.Viper, *viper.Viper, error) {
 	return configEnv, configFile, nil
 }
 
+func splitConfigList(value string) []string {
+	if value == "" {
+		return []string{}
+	}
+
+	return strings.Split(value, ",")
+}
+
 func main() {
-	log.SetLevel(log.DebugLevel)
 	configEnv, configFile, err := InitConfig()
 
 	if err != nil {
 		log.Fatalf("%s", err)
 	}
 
+	// Logging defaults to the info level, in text format, to the standard error.
+	loggingConfig := utils.LoggingConfig {
+		Level:		utils.GetConfigValue(configEnv, configFile, "log_level"),
+		Format:		utils.GetConfigValue(configEnv, configFile, "log_format"),
+		Output:		utils.GetConfigValue(configEnv, configFile, "log_output"),
+	}
+
+	if err = utils.ConfigureLogging(loggingConfig); err != nil {
+		log.Fatalf("Invalid logging configuration. Err: '%s'", err)
+	}
+
 	echoPort := utils.GetConfigValue(configEnv, configFile, "echo_port")
 	
 	if echoPort == "" {
@@ -64,20 +105,106 @@ func main() {
 		log.Fatalf("BackupPort variable missing")
 	}
 
+	// Metrics endpoint is optional.
+	metricsPort := utils.GetConfigValue(configEnv, configFile, "metrics_port")
+
 	storage := utils.GetConfigValue(configEnv, configFile, "storage_path")
 	
 	if storage == "" {
 		log.Fatalf("StoragePath variable missing")
 	}
 
+	// TLS is optional. Configuring a CA requires the backup scheduler to present a certificate signed by it.
+	tlsFiles := utils.TLSFiles {
+		CertFile:		utils.GetConfigValue(configEnv, configFile, "tls_cert_file"),
+		KeyFile:		utils.GetConfigValue(configEnv, configFile, "tls_key_file"),
+		CAFile:			utils.GetConfigValue(configEnv, configFile, "tls_ca_file"),
+	}
+
+	tlsConfig, err := utils.NewServerTLSConfig(tlsFiles)
+	if err != nil {
+		log.Fatalf("Error loading TLS configuration. Err: '%s'", err)
+	}
+
+	// Managers allowed to request backups, by address (IPs or CIDRs), certificate name or shared key.
+	authorizationConfig := common.AuthorizationConfig {
+		Addresses:		splitConfigList(utils.GetConfigValue(configEnv, configFile, "allowed_managers")),
+		Names:			splitConfigList(utils.GetConfigValue(configEnv, configFile, "allowed_manager_names")),
+		SharedKey:		utils.GetConfigValue(configEnv, configFile, "shared_key"),
+	}
+
+	if len(authorizationConfig.Addresses) == 0 && len(authorizationConfig.Names) == 0 && authorizationConfig.SharedKey == "" {
+		log.Warnf("No allowed managers configured. Backups will be sent to any peer.")
+	}
+
+	// Paths allowed to back up or restore into, and glob patterns excluded from them.
+	pathsConfig := common.PathPolicyConfig {
+		AllowedRoots:	splitConfigList(utils.GetConfigValue(configEnv, configFile, "allowed_paths")),
+		DeniedPatterns:	splitConfigList(utils.GetConfigValue(configEnv, configFile, "denied_paths")),
+	}
+
+	if len(pathsConfig.AllowedRoots) == 0 {
+		log.Warnf("No allowed paths configured. Any path can be backed up or restored into.")
+	}
+
+	// Datasets registered in a backup manager when starting, advertising the agent with the given host.
+	registrationConfig := common.RegistrationConfig {
+		ManagerAddress:	utils.GetConfigValue(configEnv, configFile, "manager_address"),
+		Token:			utils.GetConfigValue(configEnv, configFile, "manager_token"),
+		Host:			utils.GetConfigValue(configEnv, configFile, "advertise_host"),
+		Unregister:		utils.GetConfigValue(configEnv, configFile, "unregister_on_shutdown") == "true",
+	}
+
+	if registrationConfig.Datasets, err = common.ParseDatasets(utils.GetConfigValue(configEnv, configFile, "datasets")); err != nil {
+		log.Fatalf("Invalid datasets. Err: '%s'", err)
+	}
+
+	if registrationConfig.ManagerAddress != "" {
+		if registrationConfig.Host == "" {
+			if registrationConfig.Host, err = os.Hostname(); err != nil {
+				log.Fatalf("Couldn't get the host to advertise. Err: '%s'", err)
+			}
+		}
+
+		// The agent certificate, if any, is presented to managers requiring mutual TLS.
+		managerCA := utils.GetConfigValue(configEnv, configFile, "manager_tls_ca_file")
+		if utils.GetConfigValue(configEnv, configFile, "manager_tls") == "true" || managerCA != "" {
+			managerTLSFiles := utils.TLSFiles{ CertFile: tlsFiles.CertFile, KeyFile: tlsFiles.KeyFile, CAFile: managerCA }
+			if registrationConfig.TLS, err = utils.NewClientTLSConfig(managerTLSFiles); err != nil {
+				log.Fatalf("Error loading manager TLS configuration. Err: '%s'", err)
+			}
+		}
+	} else if len(registrationConfig.Datasets) > 0 {
+		log.Warnf("Datasets configured without a manager address. They won't be registered.")
+	}
+
 	backupServerConfig := common.ServerConfig {
 		Port: 			backupPort,
 		StoragePath:	storage,
+		TLS:			tlsConfig,
+		Authorization:	authorizationConfig,
+		Paths:			pathsConfig,
+		Registration:	registrationConfig,
 	}
 
 	backupServer := backup.NewBackupServer(backupServerConfig)
 	go backupServer.Run()
 
+	if metricsPort != "" {
+		go utils.ServeMetrics(metricsPort)
+	}
+
+	// Leaving the backup manager on a clean shutdown.
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		received := <-signals
+
+		log.Infof("Signal %s received. Shutting down.", received)
+		backupServer.Shutdown()
+		os.Exit(0)
+	}()
+
 	echoServerConfig := common.ServerConfig {
 		Port: 			echoPort,
 		StoragePath:	storage,
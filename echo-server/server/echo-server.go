@@ -8,7 +8,7 @@ import (
 	log "github.com/sirupsen/logrus"
 
 	"github.com/LaCumbancha/backup-server/echo-server/common"
-	"github.com/LaCumbancha/backup-server/echo-server/utils"
+	"github.com/LaCumbancha/backup-server/backup-manager/utils"
 )
 
 type EchoServer struct {
@@ -40,7 +40,7 @@ func (echoServer *EchoServer) acceptConnections(listener net.Listener) chan net.
 			client, err := listener.Accept()
 
 			if client == nil || err != nil {
-				log.Errorf("Couldn't accept client", err)
+				log.Errorf("Couldn't accept client. Err: '%s'", err)
 				continue
 			}
 
@@ -66,7 +66,7 @@ func (echoServer *EchoServer) handleConnections(client net.Conn) {
 			log.Infof("Connection ('%s', %s) closed.", ip, port)
 			break
 		} else if err != nil {
-			log.Errorf("Couldn't read line", err)
+			log.Errorf("Couldn't read line. Err: '%s'", err)
 		}
 
 		strLine := string(line)
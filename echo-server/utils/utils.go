@@ -1,64 +0,0 @@
-package utils
-
-import (
-	"strings"
-	"path/filepath"
-	"github.com/spf13/viper"
-
-	"github.com/LaCumbancha/backup-server/echo-server/common"
-)
-
-// Get configuration file's path structure. 
-func GetConfigFile(configFileName string) (string, string, string) {
-	path := filepath.Dir(configFileName)
-	file := filepath.Base(configFileName)
-	ctype := filepath.Ext(configFileName)[1:]
-
-	return path, file, ctype
-}
-
-// Give precedence to environment variables over configuration file's
-func GetConfigValue(configEnv *viper.Viper, configFile *viper.Viper, key string) (string) {
-	value := configEnv.GetString(key)
-	if value == "" {
-		value = configFile.GetString(key)
-	}
-
-	return value
-}
-
-// Parse address into IP and port
-func ParseAddress(address string) (string, string) {
-	split := strings.Split(address, ":")
-	ip := split[0]
-	port := split[1]
-
-	return ip, port
-}
-
-// Fill string with '|' for packange sending
-func FillString(message string, size int) string {
-	missingPositions := size - len(message)
-	return message + strings.Repeat(common.PADDING_CHARACTER, missingPositions)
-}
-
-// Remove padding '|'
-func UnfillString(message []byte) string {
-	reversedMessage := reversed(string(message))
-
-	for idx, char := range reversedMessage {
-		if string(char) != common.PADDING_CHARACTER {
-			return reversed(reversedMessage[idx:])
-		}
-	}
-
-	return ""
-}
-
-func reversed(str string) string {
-	result := ""
-	for _, char := range str { 
-        result = string(char) + result 
-    }
-    return result
-}